@@ -0,0 +1,46 @@
+package accounts
+
+import (
+	"context"
+	"mux-mongo-api/events"
+	"mux-mongo-api/models"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// RevokeUserSessions revokes every session of a user but except, which may be
+// primitive.NilObjectID. Call it inside configs.WithTransaction.
+func RevokeUserSessions(ctx context.Context, userId, except primitive.ObjectID) (int, error) {
+	filter := bson.M{"user": userId}
+	if !except.IsZero() {
+		filter["_id"] = bson.M{"$ne": except}
+	}
+	results, err := userSessionCollection.Find(ctx, filter, options.Find().SetProjection(bson.M{"_id": 1}))
+	if err != nil {
+		return 0, err
+	}
+	var sessions []models.UserSession
+	if err := results.All(ctx, &sessions); err != nil {
+		return 0, err
+	}
+	for _, session := range sessions {
+		if _, err := RevokeSession(ctx, bson.M{"_id": session.Id}); err != nil {
+			return 0, err
+		}
+	}
+	return len(sessions), nil
+}
+
+// RevokeSession deletes the session matching filter and records SessionRevoked.
+// Call it inside configs.WithTransaction.
+func RevokeSession(ctx context.Context, filter bson.M) (models.UserSession, error) {
+	var session models.UserSession
+	err := userSessionCollection.FindOneAndDelete(ctx, filter).Decode(&session)
+	if err != nil {
+		return session, err
+	}
+	err = events.Record(ctx, models.SessionRevoked, session.User, models.SessionEventData{Session: session.Id, User: session.User, UserAgent: session.UserAgent})
+	return session, err
+}
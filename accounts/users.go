@@ -0,0 +1,149 @@
+package accounts
+
+import (
+	"context"
+	"mux-mongo-api/configs"
+	"mux-mongo-api/events"
+	"mux-mongo-api/models"
+	"mux-mongo-api/responses"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var userCollection *mongo.Collection = configs.GetCollection(configs.DB, "users")
+var userSessionCollection *mongo.Collection = configs.GetCollection(configs.DB, "usersession")
+var guardCollection *mongo.Collection = configs.GetCollection(configs.DB, "write_guards")
+
+// InsertUser creates user and records UserCreated. The email check, and the
+// one-user-per-role check when uniqueRole is set, run in the same transaction
+// as the insert. Concurrent registrations for a role both write the role's
+// guard document, so one of them aborts and is retried by the driver, seeing
+// the committed user. On standalone servers the unique indexes on email and
+// superadmin catch the race instead. Only the superadmin is unique.
+func InsertUser(ctx context.Context, user models.User, uniqueRole bool) error {
+	err := configs.WithTransaction(ctx, configs.DB, func(ctx context.Context) error {
+		return CreateUser(ctx, user, uniqueRole)
+	})
+	return DuplicateUserError(err)
+}
+
+// CreateUser is the body of InsertUser for callers that already run a
+// transaction.
+func CreateUser(ctx context.Context, user models.User, uniqueRole bool) error {
+	taken, err := EmailTaken(ctx, user.Email, user.Id)
+	if err != nil {
+		return err
+	}
+	if taken {
+		return responses.ErrEmailTaken
+	}
+	if uniqueRole {
+		if err := Guard(ctx, "role:"+user.Role); err != nil {
+			return err
+		}
+		count, err := userCollection.CountDocuments(ctx, bson.M{"role": user.Role}, options.Count().SetLimit(1))
+		if err != nil {
+			return err
+		}
+		if count > 0 {
+			return responses.ErrRoleTaken
+		}
+	}
+	if _, err := userCollection.InsertOne(ctx, user); err != nil {
+		return err
+	}
+	return events.Record(ctx, models.UserCreated, user.Id, EventUser(user))
+}
+
+// NormalizeEmail trims and lowercases an email address. Addresses are stored
+// and looked up normalized.
+func NormalizeEmail(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
+
+// EmailTaken reports whether email belongs to a user other than except or is
+// held for another user who may still recover it after changing their address.
+func EmailTaken(ctx context.Context, email string, except primitive.ObjectID) (bool, error) {
+	count, err := userCollection.CountDocuments(ctx, bson.M{
+		"_id": bson.M{"$ne": except},
+		"$or": bson.A{
+			bson.M{"email": email},
+			bson.M{
+				"emailchange.oldemail":     email,
+				"emailchange.confirmedat":  bson.M{"$exists": true},
+				"emailchange.recoveruntil": bson.M{"$gt": time.Now()},
+			},
+		},
+	}, options.Count().SetLimit(1))
+	return count > 0, err
+}
+
+// SetActive activates or deactivates user and records UserActivated or
+// UserDeactivated when that changed anything. Deactivating doesn't revoke
+// sessions, callers do that with RevokeUserSessions. Call it inside
+// configs.WithTransaction.
+func SetActive(ctx context.Context, user *models.User, active bool) error {
+	result, err := userCollection.UpdateOne(ctx, bson.M{"_id": user.Id, "isactive": bson.M{"$ne": active}}, bson.M{"$set": bson.M{"isactive": active, "tsupdated": time.Now()}})
+	if err != nil {
+		return err
+	}
+	user.IsActive = active
+	if result.ModifiedCount == 0 {
+		return nil
+	}
+	eventType := models.UserDeactivated
+	if active {
+		eventType = models.UserActivated
+	}
+	return events.Record(ctx, eventType, user.Id, EventUser(*user))
+}
+
+// SetPassword stores hash as the password of user, revokes every session but
+// except, which may be primitive.NilObjectID, and records PasswordChanged.
+// Call it inside configs.WithTransaction.
+func SetPassword(ctx context.Context, user models.User, hash string, except primitive.ObjectID) (int, error) {
+	_, err := userCollection.UpdateOne(ctx, bson.M{"_id": user.Id}, bson.M{"$set": bson.M{"password": hash, "tsupdated": time.Now()}})
+	if err != nil {
+		return 0, err
+	}
+	revoked, err := RevokeUserSessions(ctx, user.Id, except)
+	if err != nil {
+		return 0, err
+	}
+	return revoked, events.Record(ctx, models.PasswordChanged, user.Id, EventUser(user))
+}
+
+// Guard writes the guard document for key inside a transaction. Two
+// transactions guarding the same key conflict, so check-then-write sequences
+// behind a guard can't interleave.
+func Guard(ctx context.Context, key string) error {
+	_, err := guardCollection.UpdateOne(ctx, bson.M{"_id": key},
+		bson.M{"$set": bson.M{"tsupdated": time.Now()}}, options.Update().SetUpsert(true))
+	return err
+}
+
+// DuplicateUserError turns a duplicate key error on the users indexes into the
+// matching 409 error.
+func DuplicateUserError(err error) error {
+	if !mongo.IsDuplicateKeyError(err) {
+		return err
+	}
+	switch {
+	case strings.Contains(err.Error(), "email_unique"):
+		return responses.ErrEmailTaken
+	case strings.Contains(err.Error(), "superadmin_unique"):
+		return responses.ErrRoleTaken
+	}
+	return err
+}
+
+// EventUser strips the password hash from a user before it goes into an event.
+func EventUser(user models.User) models.User {
+	user.Password = ""
+	return user
+}
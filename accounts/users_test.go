@@ -0,0 +1,81 @@
+//go:build integration
+
+// These tests create users against a real MongoDB replica set, since the
+// one-superadmin check only holds up under concurrency inside transactions.
+// Run them from the repository root with
+//
+//	cp .env accounts/.env
+//	MONGOURI='mongodb://localhost:27017/?replicaSet=rs0' go test -tags integration ./accounts
+//
+// They create users in the configured database and delete them again.
+package accounts
+
+import (
+	"context"
+	"fmt"
+	"mux-mongo-api/models"
+	"mux-mongo-api/responses"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+func TestInsertSuperadminConcurrently(t *testing.T) {
+	if !strings.Contains(os.Getenv("MONGOURI"), "replicaSet=") {
+		t.Skip("MONGOURI does not name a replica set")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	count, err := userCollection.CountDocuments(ctx, bson.M{"role": models.RoleSuperAdmin}, options.Count().SetLimit(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count > 0 {
+		t.Skip("the database already has a superadmin")
+	}
+
+	users := make([]models.User, 8)
+	emails := make([]string, len(users))
+	for i := range users {
+		emails[i] = fmt.Sprintf("race-%s@example.com", primitive.NewObjectID().Hex())
+		users[i] = models.User{Id: primitive.NewObjectID(), Name: "Race Test", Email: emails[i], Role: models.RoleSuperAdmin, TsCreated: time.Now(), TsUpdated: time.Now()}
+	}
+	t.Cleanup(func() {
+		if _, err := userCollection.DeleteMany(context.Background(), bson.M{"email": bson.M{"$in": emails}}); err != nil {
+			t.Error(err)
+		}
+	})
+
+	errs := make([]error, len(users))
+	start := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := range users {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			<-start
+			errs[i] = InsertUser(ctx, users[i], true)
+		}(i)
+	}
+	close(start)
+	wg.Wait()
+
+	created, taken := 0, 0
+	for _, err := range errs {
+		switch err {
+		case nil:
+			created++
+		case responses.ErrRoleTaken:
+			taken++
+		}
+	}
+	if created != 1 || taken != len(users)-1 {
+		t.Errorf("got errors %v, want one nil and %d times %v", errs, len(users)-1, responses.ErrRoleTaken)
+	}
+}
@@ -0,0 +1,122 @@
+package commands
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+	"time"
+)
+
+// command is a maintenance subcommand run as "<binary> <name> [flags]".
+type command struct {
+	usage string
+	run   func(ctx context.Context, args []string) error
+}
+
+var registry = map[string]command{}
+
+func register(name, usage string, run func(ctx context.Context, args []string) error) {
+	registry[name] = command{usage: usage, run: run}
+}
+
+// Run executes the subcommand named by args[0] and returns the process exit
+// code. It talks to MongoDB directly, using the same configuration as the
+// HTTP server.
+func Run(args []string) int {
+	if len(args) == 0 || args[0] == "help" || args[0] == "-h" || args[0] == "--help" {
+		printUsage(os.Stdout)
+		return 0
+	}
+	cmd, ok := registry[args[0]]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\n", args[0])
+		printUsage(os.Stderr)
+		return 2
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Minute)
+	defer cancel()
+	err := cmd.run(ctx, args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		return 0
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error:", err)
+		return 1
+	}
+	return 0
+}
+
+func printUsage(w io.Writer) {
+	fmt.Fprintln(w, "usage: mux-mongo-api [command] [flags]")
+	fmt.Fprintln(w, "\nWithout a command the HTTP server is started. Commands:")
+	names := make([]string, 0, len(registry))
+	for name := range registry {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(w, "  %-20s %s\n", name, registry[name].usage)
+	}
+	fmt.Fprintln(w, "\nRun \"mux-mongo-api <command> -h\" for the flags of a command.")
+}
+
+var stdin = bufio.NewReader(os.Stdin)
+
+// prompt asks for a line of input unless value is already set.
+func prompt(label, value string) (string, error) {
+	if value != "" {
+		return value, nil
+	}
+	fmt.Fprintf(os.Stderr, "%s: ", label)
+	line, err := stdin.ReadString('\n')
+	if err != nil && line == "" {
+		return "", err
+	}
+	return strings.TrimSpace(line), nil
+}
+
+// promptPassword reads a password twice without echoing it when stdin is a
+// terminal.
+func promptPassword(label string) (string, error) {
+	first, err := readSecret(label)
+	if err != nil {
+		return "", err
+	}
+	second, err := readSecret("Repeat " + strings.ToLower(label))
+	if err != nil {
+		return "", err
+	}
+	if first != second {
+		return "", errors.New("passwords do not match")
+	}
+	return first, nil
+}
+
+func readSecret(label string) (string, error) {
+	fmt.Fprintf(os.Stderr, "%s: ", label)
+	if err := stty("-echo"); err == nil {
+		defer func() {
+			stty("echo")
+			fmt.Fprintln(os.Stderr)
+		}()
+	}
+	line, err := stdin.ReadString('\n')
+	if err != nil && line == "" {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+func stty(arg string) error {
+	cmd := exec.Command("stty", arg)
+	cmd.Stdin = os.Stdin
+	return cmd.Run()
+}
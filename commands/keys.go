@@ -0,0 +1,84 @@
+package commands
+
+import (
+	"bufio"
+	"context"
+	"flag"
+	"fmt"
+	"mux-mongo-api/helpers"
+	"os"
+	"strings"
+
+	"aidanwoods.dev/go-paseto"
+)
+
+func init() {
+	register("rotate-token-key", "generate a new token key, keeping the old one for validation", rotateTokenKey)
+}
+
+// rotateTokenKey makes a new TOKENSECRET and moves the current one to the
+// front of TOKENSECRET_PREVIOUS so issued tokens stay valid until they expire.
+// Keys beyond -keep are dropped. The result is printed or written to -env-file.
+func rotateTokenKey(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("rotate-token-key", flag.ContinueOnError)
+	envFile := flags.String("env-file", "", "env file to update in place, print the new values when empty")
+	keep := flags.Int("keep", 2, "number of previous keys to keep accepting")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	previous := helpers.GetPreviousSecretKeys()
+	if current := helpers.GetSecretKey(); current != "" {
+		previous = append([]string{current}, previous...)
+	}
+	if len(previous) > *keep {
+		previous = previous[:*keep]
+	}
+	values := map[string]string{
+		"TOKENSECRET":          paseto.NewV4SymmetricKey().ExportHex(),
+		"TOKENSECRET_PREVIOUS": strings.Join(previous, ","),
+	}
+
+	if *envFile == "" {
+		for _, key := range []string{"TOKENSECRET", "TOKENSECRET_PREVIOUS"} {
+			fmt.Printf("%s=%s\n", key, values[key])
+		}
+		return nil
+	}
+	if err := updateEnvFile(*envFile, values); err != nil {
+		return err
+	}
+	fmt.Println("updated", *envFile, "- restart every server for the new key to take effect")
+	return nil
+}
+
+// updateEnvFile replaces the given keys in an env file, appending missing ones.
+func updateEnvFile(path string, values map[string]string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var lines []string
+	seen := map[string]bool{}
+	scanner := bufio.NewScanner(strings.NewReader(string(data)))
+	for scanner.Scan() {
+		line := scanner.Text()
+		key, _, found := strings.Cut(line, "=")
+		key = strings.TrimSpace(key)
+		if value, ok := values[key]; found && ok {
+			line = key + "=" + value
+			seen[key] = true
+		}
+		lines = append(lines, line)
+	}
+	for _, key := range []string{"TOKENSECRET", "TOKENSECRET_PREVIOUS"} {
+		if !seen[key] {
+			lines = append(lines, key+"="+values[key])
+		}
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, []byte(strings.Join(lines, "\n")+"\n"), info.Mode())
+}
@@ -0,0 +1,84 @@
+package commands
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"mux-mongo-api/migrations"
+)
+
+func init() {
+	register("migrate", "apply, revert or list schema migrations (up|down|status|validators)", migrate)
+}
+
+func migrate(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("migrate", flag.ContinueOnError)
+	to := flags.Int("to", 0, "up: stop after this version, latest when 0")
+	steps := flags.Int("steps", 1, "down: number of migrations to revert")
+	dryRun := flags.Bool("dry-run", false, "validators: only report documents that violate the schema")
+	verbose := flags.Bool("v", false, "validators: print the generated schemas")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "usage: migrate [up|down|status|validators] [flags]")
+		flags.PrintDefaults()
+	}
+	action := "up"
+	if len(args) > 0 && args[0] != "" && args[0][0] != '-' {
+		action, args = args[0], args[1:]
+	}
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	switch action {
+	case "up":
+		done, err := migrations.Up(ctx, *to)
+		printMigrations("applied", done)
+		return err
+	case "down":
+		done, err := migrations.Down(ctx, *steps)
+		printMigrations("reverted", done)
+		return err
+	case "validators":
+		reports, err := migrations.ApplyValidators(ctx, *dryRun)
+		for _, report := range reports {
+			if *verbose {
+				schema, _ := json.MarshalIndent(report.Schema, "", "  ")
+				fmt.Printf("%s:\n%s\n", report.Collection, schema)
+			}
+			fmt.Printf("%-15s %d invalid documents", report.Collection, report.Invalid)
+			if len(report.Samples) > 0 {
+				fmt.Printf(", e.g. %v", report.Samples)
+			}
+			fmt.Println()
+		}
+		if err == nil && !*dryRun {
+			fmt.Println("validators applied")
+		}
+		return err
+	case "status":
+		statuses, err := migrations.List(ctx)
+		if err != nil {
+			return err
+		}
+		for _, status := range statuses {
+			applied := "pending"
+			if status.AppliedAt != nil {
+				applied = "applied " + status.AppliedAt.Format("2006-01-02 15:04:05")
+			}
+			fmt.Printf("%4d  %-30s %s\n", status.Version, status.Name, applied)
+		}
+		return nil
+	}
+	flags.Usage()
+	return fmt.Errorf("unknown migrate action %q", action)
+}
+
+func printMigrations(verb string, done []migrations.Migration) {
+	if len(done) == 0 {
+		fmt.Println("nothing to do")
+	}
+	for _, migration := range done {
+		fmt.Printf("%s %d %s\n", verb, migration.Version, migration.Name)
+	}
+}
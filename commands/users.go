@@ -0,0 +1,260 @@
+package commands
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"mux-mongo-api/accounts"
+	"mux-mongo-api/configs"
+	"mux-mongo-api/helpers"
+	"mux-mongo-api/models"
+	"mux-mongo-api/responses"
+	"os"
+	"strconv"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+var userCollection *mongo.Collection = configs.GetCollection(configs.DB, "users")
+
+func init() {
+	register("create-superadmin", "create a superadmin, prompting for missing details", createSuperadmin)
+	register("reset-password", "set a new password for a user and revoke their sessions", resetPassword)
+	register("activate", "activate a user", func(ctx context.Context, args []string) error { return setActive(ctx, "activate", args, true) })
+	register("deactivate", "deactivate a user and revoke their sessions", func(ctx context.Context, args []string) error { return setActive(ctx, "deactivate", args, false) })
+	register("revoke-sessions", "log a user out of every device", revokeSessionsCommand)
+	register("export-users", "write all users as JSON lines or CSV", exportUsers)
+}
+
+func createSuperadmin(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("create-superadmin", flag.ContinueOnError)
+	name := flags.String("name", "", "full name")
+	email := flags.String("email", "", "email address")
+	company := flags.String("company", "", "company")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	count, err := userCollection.CountDocuments(ctx, bson.M{"role": models.RoleSuperAdmin})
+	if err != nil {
+		return err
+	}
+	if count > 0 {
+		return errors.New("a superadmin already exists")
+	}
+
+	if *name, err = prompt("Name", *name); err != nil {
+		return err
+	}
+	if *email, err = prompt("Email", *email); err != nil {
+		return err
+	}
+	*email = accounts.NormalizeEmail(*email)
+	if *name == "" || *email == "" {
+		return errors.New("name and email are required")
+	}
+	password, err := promptPassword("Password")
+	if err != nil {
+		return err
+	}
+	if err := helpers.CheckPassword(password, *email, *name); err != nil {
+		return err
+	}
+	hash, err := helpers.GenerateHash(password)
+	if err != nil {
+		return err
+	}
+
+	user := models.User{
+		Id:        primitive.NewObjectID(),
+		Name:      *name,
+		Email:     *email,
+		Company:   *company,
+		Password:  hash,
+		Role:      models.RoleSuperAdmin,
+		IsActive:  true,
+		TsCreated: time.Now(),
+		TsUpdated: time.Now(),
+	}
+	switch err := accounts.InsertUser(ctx, user, true); err {
+	case nil:
+	case responses.ErrEmailTaken:
+		return errors.New("a user with this email already exists")
+	case responses.ErrRoleTaken:
+		return errors.New("a superadmin already exists")
+	default:
+		return err
+	}
+	fmt.Println("created superadmin", user.Id.Hex())
+	return nil
+}
+
+func resetPassword(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("reset-password", flag.ContinueOnError)
+	email := flags.String("email", "", "email of the user")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	user, err := findUser(ctx, *email)
+	if err != nil {
+		return err
+	}
+	password, err := promptPassword("New password")
+	if err != nil {
+		return err
+	}
+	if err := helpers.CheckPassword(password, user.Email, user.Name); err != nil {
+		return err
+	}
+	hash, err := helpers.GenerateHash(password)
+	if err != nil {
+		return err
+	}
+
+	var revoked int
+	err = configs.WithTransaction(ctx, configs.DB, func(ctx context.Context) error {
+		revoked, err = accounts.SetPassword(ctx, user, hash, primitive.NilObjectID)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	fmt.Printf("password reset for %s, %d sessions revoked\n", user.Email, revoked)
+	return nil
+}
+
+func setActive(ctx context.Context, name string, args []string, active bool) error {
+	flags := flag.NewFlagSet(name, flag.ContinueOnError)
+	email := flags.String("email", "", "email of the user")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	user, err := findUser(ctx, *email)
+	if err != nil {
+		return err
+	}
+
+	var revoked int
+	err = configs.WithTransaction(ctx, configs.DB, func(ctx context.Context) error {
+		if err := accounts.SetActive(ctx, &user, active); err != nil {
+			return err
+		}
+		if !active {
+			revoked, err = accounts.RevokeUserSessions(ctx, user.Id, primitive.NilObjectID)
+		}
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%sd %s", name, user.Email)
+	if !active {
+		fmt.Printf(", %d sessions revoked", revoked)
+	}
+	fmt.Println()
+	return nil
+}
+
+func revokeSessionsCommand(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("revoke-sessions", flag.ContinueOnError)
+	email := flags.String("email", "", "email of the user")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	user, err := findUser(ctx, *email)
+	if err != nil {
+		return err
+	}
+	var revoked int
+	err = configs.WithTransaction(ctx, configs.DB, func(ctx context.Context) error {
+		revoked, err = accounts.RevokeUserSessions(ctx, user.Id, primitive.NilObjectID)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%d sessions revoked for %s\n", revoked, user.Email)
+	return nil
+}
+
+func exportUsers(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("export-users", flag.ContinueOnError)
+	format := flags.String("format", "json", "json (one user per line) or csv")
+	out := flags.String("out", "", "output file, standard output when empty")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *format != "json" && *format != "csv" {
+		return fmt.Errorf("unknown format %q", *format)
+	}
+
+	var w io.Writer = os.Stdout
+	if *out != "" {
+		file, err := os.OpenFile(*out, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o600)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		w = file
+	}
+
+	results, err := userCollection.Find(ctx, bson.M{})
+	if err != nil {
+		return err
+	}
+	defer results.Close(ctx)
+
+	encoder := json.NewEncoder(w)
+	writer := csv.NewWriter(w)
+	if *format == "csv" {
+		writer.Write([]string{"id", "name", "email", "company", "role", "isactive", "created_on", "updated_on"})
+	}
+	count := 0
+	for results.Next(ctx) {
+		var user models.User
+		if err := results.Decode(&user); err != nil {
+			return err
+		}
+		if *format == "json" {
+			err = encoder.Encode(user)
+		} else {
+			err = writer.Write([]string{
+				user.Id.Hex(), user.Name, user.Email, user.Company, user.Role,
+				strconv.FormatBool(user.IsActive), user.TsCreated.Format(time.RFC3339), user.TsUpdated.Format(time.RFC3339),
+			})
+		}
+		if err != nil {
+			return err
+		}
+		count++
+	}
+	writer.Flush()
+	if err := writer.Error(); err != nil {
+		return err
+	}
+	if err := results.Err(); err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "exported %d users\n", count)
+	return nil
+}
+
+func findUser(ctx context.Context, email string) (models.User, error) {
+	var user models.User
+	email = accounts.NormalizeEmail(email)
+	if email == "" {
+		return user, errors.New("-email is required")
+	}
+	err := userCollection.FindOne(ctx, bson.M{"email": email}).Decode(&user)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return user, fmt.Errorf("no user with email %s", email)
+	}
+	return user, err
+}
@@ -2,46 +2,244 @@ package configs
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"io/fs"
 	"log"
 	"os"
+	"strconv"
+	"sync"
 	"time"
 
 	"github.com/joho/godotenv"
+	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
 var DB *mongo.Client = ConnectDB()
 
+// EnvMongoURI is the MongoDB connection string. Unlike the other settings it
+// doesn't require a .env file, so packages that import configs can be loaded
+// by their unit tests without one.
 func EnvMongoURI() string {
+	err := godotenv.Load()
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		log.Fatal("Error loading Env File")
+	}
+	if uri := os.Getenv("MONGOURI"); uri != "" {
+		return uri
+	}
+	return "mongodb://localhost:27017"
+}
+
+// EnvMailTemplateDir is an optional directory of email template overrides.
+func EnvMailTemplateDir() string {
 	err := godotenv.Load()
 	if err != nil {
 		log.Fatal("Error loading Env File")
 	}
-	return os.Getenv("MONGOURI")
+	return os.Getenv("MAIL_TEMPLATE_DIR")
 }
 
+// EnvOutboxMaxAttempts is how often an email is tried before it is dead lettered.
+func EnvOutboxMaxAttempts() int {
+	err := godotenv.Load()
+	if err != nil {
+		log.Fatal("Error loading Env File")
+	}
+	attempts, err := strconv.Atoi(os.Getenv("OUTBOX_MAX_ATTEMPTS"))
+	if err != nil || attempts < 1 {
+		return 8
+	}
+	return attempts
+}
+
+// EnvOutboxPollInterval is how long the email worker sleeps when the outbox is empty.
+func EnvOutboxPollInterval() time.Duration {
+	err := godotenv.Load()
+	if err != nil {
+		log.Fatal("Error loading Env File")
+	}
+	interval, err := time.ParseDuration(os.Getenv("OUTBOX_POLL_INTERVAL"))
+	if err != nil || interval <= 0 {
+		return 5 * time.Second
+	}
+	return interval
+}
+
+// EnvSendGridWebhookKey is the base64 public key SendGrid signs webhook events with.
+func EnvSendGridWebhookKey() string {
+	err := godotenv.Load()
+	if err != nil {
+		log.Fatal("Error loading Env File")
+	}
+	return os.Getenv("SENDGRID_WEBHOOK_PUBLIC_KEY")
+}
+
+// EnvMigrateOnStart reports whether the server applies pending migrations
+// when it starts. Set MIGRATE_ON_START=false to run "migrate" by hand instead.
+func EnvMigrateOnStart() bool {
+	err := godotenv.Load()
+	if err != nil {
+		log.Fatal("Error loading Env File")
+	}
+	migrate, err := strconv.ParseBool(os.Getenv("MIGRATE_ON_START"))
+	return err != nil || migrate
+}
+
+// EnvSchemaValidationAction is "error" to reject writes that violate the
+// collection validators or "warn" to only log them on the server.
+func EnvSchemaValidationAction() string {
+	err := godotenv.Load()
+	if err != nil {
+		log.Fatal("Error loading Env File")
+	}
+	if os.Getenv("SCHEMA_VALIDATION_ACTION") == "warn" {
+		return "warn"
+	}
+	return "error"
+}
+
+// EnvEmailChangeTTL is how long the link confirming a new email address works.
+func EnvEmailChangeTTL() time.Duration {
+	err := godotenv.Load()
+	if err != nil {
+		log.Fatal("Error loading Env File")
+	}
+	ttl, err := time.ParseDuration(os.Getenv("EMAIL_CHANGE_TTL"))
+	if err != nil || ttl <= 0 {
+		return 24 * time.Hour
+	}
+	return ttl
+}
+
+// EnvEmailRecoveryPeriod is how long the previous address can be restored
+// after an email change.
+func EnvEmailRecoveryPeriod() time.Duration {
+	err := godotenv.Load()
+	if err != nil {
+		log.Fatal("Error loading Env File")
+	}
+	period, err := time.ParseDuration(os.Getenv("EMAIL_RECOVERY_PERIOD"))
+	if err != nil || period <= 0 {
+		return 7 * 24 * time.Hour
+	}
+	return period
+}
+
+// EnvInvitationTTL is how long an invitation link can be accepted.
+func EnvInvitationTTL() time.Duration {
+	err := godotenv.Load()
+	if err != nil {
+		log.Fatal("Error loading Env File")
+	}
+	ttl, err := time.ParseDuration(os.Getenv("INVITATION_TTL"))
+	if err != nil || ttl <= 0 {
+		return 72 * time.Hour
+	}
+	return ttl
+}
+
+// EnvExportTTL is how long a finished data export can be downloaded.
+func EnvExportTTL() time.Duration {
+	err := godotenv.Load()
+	if err != nil {
+		log.Fatal("Error loading Env File")
+	}
+	ttl, err := time.ParseDuration(os.Getenv("EXPORT_TTL"))
+	if err != nil || ttl <= 0 {
+		return 7 * 24 * time.Hour
+	}
+	return ttl
+}
+
+// EnvErasureDigestSecret is the key erasure records hash email addresses with.
+// It defaults to SECRET and must never change, or erased addresses can't be
+// matched to their records anymore.
+func EnvErasureDigestSecret() string {
+	err := godotenv.Load()
+	if err != nil {
+		log.Fatal("Error loading Env File")
+	}
+	if secret := os.Getenv("ERASURE_DIGEST_SECRET"); secret != "" {
+		return secret
+	}
+	return os.Getenv("SECRET")
+}
+
+// ConnectDB creates the client without waiting for the server, which is only
+// contacted by the first operation. Call PingDB to fail fast on startup.
 func ConnectDB() *mongo.Client {
 	client, err := mongo.NewClient(options.Client().ApplyURI(EnvMongoURI()))
 	if err != nil {
 		log.Fatal(err)
 	}
-	ctx, _ := context.WithTimeout(context.Background(), 10*time.Second)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
 	err = client.Connect(ctx)
 
 	if err != nil {
 		log.Fatal(err)
 	}
-	// ping database
-	err = client.Ping(ctx, nil)
+	return client
+
+}
+
+// PingDB checks that the server behind DB is reachable.
+func PingDB(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	err := DB.Ping(ctx, nil)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
-
 	fmt.Println("connected to mongodb")
-	return client
+	return nil
+}
+
+var (
+	transactionsSupported     bool
+	transactionsSupportedOnce sync.Once
+)
 
+// TransactionsSupported reports whether the server is a replica set member or
+// mongos. Standalone servers reject transactions and change streams.
+func TransactionsSupported(client *mongo.Client) bool {
+	transactionsSupportedOnce.Do(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		var hello bson.M
+		err := client.Database("admin").RunCommand(ctx, bson.D{{Key: "isMaster", Value: 1}}).Decode(&hello)
+		if err != nil {
+			log.Println("checking transaction support failed:", err)
+			return
+		}
+		_, replicaSet := hello["setName"]
+		transactionsSupported = replicaSet || hello["msg"] == "isdbgrid"
+		if !transactionsSupported {
+			log.Println("MongoDB is standalone, writes will run without transactions")
+		}
+	})
+	return transactionsSupported
+}
+
+// WithTransaction runs fn inside a transaction on client. fn must pass the
+// context it receives to every operation so they join the transaction. On a
+// standalone server fn runs without one.
+func WithTransaction(ctx context.Context, client *mongo.Client, fn func(ctx context.Context) error) error {
+	if !TransactionsSupported(client) {
+		return fn(ctx)
+	}
+	session, err := client.StartSession()
+	if err != nil {
+		return err
+	}
+	defer session.EndSession(ctx)
+	_, err = session.WithTransaction(ctx, func(sessCtx mongo.SessionContext) (interface{}, error) {
+		return nil, fn(sessCtx)
+	})
+	return err
 }
 
 func GetCollection(client *mongo.Client, collectionName string) *mongo.Collection {
@@ -0,0 +1,293 @@
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"mux-mongo-api/accounts"
+	"mux-mongo-api/configs"
+	"mux-mongo-api/events"
+	"mux-mongo-api/helpers"
+	"mux-mongo-api/models"
+	"mux-mongo-api/responses"
+	"mux-mongo-api/workers"
+	"net/http"
+	"net/mail"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// ChangePassword sets a new password after checking the current one and logs
+// out every other session of the user.
+func ChangePassword(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	w.Header().Set("Content-Type", "application/json")
+	var request models.ChangePasswordRequest
+	defer cancel()
+
+	user, err := currentUser(ctx, r)
+	if err != nil {
+		responses.WriteError(w, r, err)
+		return
+	}
+	if err := decodeJSON(w, r, &request); err != nil {
+		responses.WriteError(w, r, err)
+		return
+	}
+	if !helpers.ValidateHash(user.Password, request.CurrentPassword) {
+		responses.WriteError(w, r, responses.ErrInvalidCredentials)
+		return
+	}
+	if err := checkPassword("new_password", request.NewPassword, user.Email, user.Name); err != nil {
+		responses.WriteError(w, r, err)
+		return
+	}
+	hash, err := helpers.GenerateHash(request.NewPassword)
+	if err != nil {
+		responses.WriteError(w, r, err)
+		return
+	}
+
+	current, _ := r.Context().Value("session-id").(primitive.ObjectID)
+	device := helpers.ParseUserAgent(r.Header.Get("User-Agent"))
+	var revoked int
+	err = configs.WithTransaction(ctx, configs.DB, func(ctx context.Context) error {
+		var err error
+		if revoked, err = accounts.SetPassword(ctx, user, hash, current); err != nil {
+			return err
+		}
+		to := mail.Address{Name: user.Name, Address: user.Email}
+		_, err = workers.EnqueueEmail(ctx, "password-changed:"+primitive.NewObjectID().Hex(), user.Id, to, user.Locale, helpers.MailSecurityAlert, helpers.MailData{
+			"Event":  "password changed",
+			"Device": deviceName(device),
+			"IP":     helpers.ClientIP(r),
+		})
+		return err
+	})
+	if err != nil {
+		responses.WriteError(w, r, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	response := responses.UserResponse{Status: http.StatusOK, Message: "success", Data: map[string]interface{}{"data": "password changed", "sessions_revoked": revoked}}
+	json.NewEncoder(w).Encode(response)
+}
+
+// RequestEmailChange starts changing the caller's address. The new address
+// gets a confirmation link and the current one a notice with a link to undo
+// the change.
+func RequestEmailChange(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	w.Header().Set("Content-Type", "application/json")
+	var request models.ChangeEmailRequest
+	defer cancel()
+
+	user, err := currentUser(ctx, r)
+	if err != nil {
+		responses.WriteError(w, r, err)
+		return
+	}
+	if err := decodeJSON(w, r, &request); err != nil {
+		responses.WriteError(w, r, err)
+		return
+	}
+	if !helpers.ValidateHash(user.Password, request.Password) {
+		responses.WriteError(w, r, responses.ErrInvalidCredentials)
+		return
+	}
+	if request.Email == user.Email {
+		responses.WriteError(w, r, responses.ErrValidation([]responses.FieldError{{Field: "email", Rule: "ne", Message: "email is already the address of this account"}}))
+		return
+	}
+	now := time.Now()
+	if change := user.EmailChange; change != nil && change.ConfirmedAt != nil && change.RecoverUntil.After(now) {
+		// replacing it would take away the owner's way back after a hijack
+		responses.WriteError(w, r, responses.NewError(http.StatusConflict, responses.CodeConflict,
+			"the email address was changed recently, it can be changed again after "+change.RecoverUntil.UTC().Format(time.RFC3339)))
+		return
+	}
+	taken, err := accounts.EmailTaken(ctx, request.Email, user.Id)
+	if err != nil {
+		responses.WriteError(w, r, err)
+		return
+	}
+	if taken {
+		responses.WriteError(w, r, responses.ErrEmailTaken)
+		return
+	}
+
+	confirmToken, err := helpers.GenerateOpaqueToken()
+	if err != nil {
+		responses.WriteError(w, r, err)
+		return
+	}
+	recoverToken, err := helpers.GenerateOpaqueToken()
+	if err != nil {
+		responses.WriteError(w, r, err)
+		return
+	}
+	change := models.EmailChange{
+		OldEmail:     user.Email,
+		NewEmail:     request.Email,
+		ConfirmHash:  helpers.HashToken(confirmToken),
+		ConfirmUntil: now.Add(configs.EnvEmailChangeTTL()),
+		RecoverHash:  helpers.HashToken(recoverToken),
+		RecoverUntil: now.Add(configs.EnvEmailRecoveryPeriod()),
+	}
+
+	err = configs.WithTransaction(ctx, configs.DB, func(ctx context.Context) error {
+		_, err := userCollection.UpdateOne(ctx, bson.M{"_id": user.Id}, bson.M{"$set": bson.M{"emailchange": change, "tsupdated": now}})
+		if err != nil {
+			return err
+		}
+		key := "email-change:" + change.ConfirmHash
+		_, err = workers.EnqueueEmail(ctx, key, user.Id, mail.Address{Name: user.Name, Address: change.NewEmail}, user.Locale, helpers.MailEmailChange, helpers.MailData{
+			"Link":      helpers.AppLink("/email/confirm", confirmToken),
+			"ExpiresAt": change.ConfirmUntil.UTC().Format("2006-01-02 15:04 MST"),
+		})
+		if err != nil {
+			return err
+		}
+		_, err = workers.EnqueueEmail(ctx, key+":notice", user.Id, mail.Address{Name: user.Name, Address: change.OldEmail}, user.Locale, helpers.MailEmailChangeNotice, helpers.MailData{
+			"Link":      helpers.AppLink("/email/recover", recoverToken),
+			"NewEmail":  change.NewEmail,
+			"ExpiresAt": change.RecoverUntil.UTC().Format("2006-01-02 15:04 MST"),
+		})
+		return err
+	})
+	if err != nil {
+		responses.WriteError(w, r, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+	response := responses.UserResponse{Status: http.StatusAccepted, Message: "success", Data: map[string]interface{}{"data": change}}
+	json.NewEncoder(w).Encode(response)
+}
+
+// ConfirmEmailChange swaps in the new address using the token from the
+// confirmation link. Every session is revoked since tokens name the old
+// address.
+func ConfirmEmailChange(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	w.Header().Set("Content-Type", "application/json")
+	var request models.TokenRequest
+	var user models.User
+	defer cancel()
+
+	if err := decodeJSON(w, r, &request); err != nil {
+		responses.WriteError(w, r, err)
+		return
+	}
+
+	hash := helpers.HashToken(request.Token)
+	now := time.Now()
+	err := configs.WithTransaction(ctx, configs.DB, func(ctx context.Context) error {
+		err := userCollection.FindOne(ctx, bson.M{
+			"emailchange.confirmhash":  hash,
+			"emailchange.confirmuntil": bson.M{"$gt": now},
+			"emailchange.confirmedat":  bson.M{"$exists": false},
+		}).Decode(&user)
+		if err != nil {
+			return responses.NotFoundAs(err, responses.ErrLinkInvalid)
+		}
+		taken, err := accounts.EmailTaken(ctx, user.EmailChange.NewEmail, user.Id)
+		if err != nil {
+			return err
+		}
+		if taken {
+			return responses.ErrEmailTaken
+		}
+		previous := user.Email
+		user.Email = user.EmailChange.NewEmail
+		user.EmailChange.ConfirmedAt = &now
+		_, err = userCollection.UpdateOne(ctx, bson.M{"_id": user.Id, "emailchange.confirmhash": hash}, bson.M{
+			"$set":   bson.M{"email": user.Email, "emailchange.confirmedat": now, "tsupdated": now},
+			"$unset": bson.M{"emaildelivery": ""},
+		})
+		if err != nil {
+			return err
+		}
+		if _, err := accounts.RevokeUserSessions(ctx, user.Id, primitive.NilObjectID); err != nil {
+			return err
+		}
+		return events.Record(ctx, models.UserEmailChanged, user.Id, models.EmailChangeEventData{User: accounts.EventUser(user), PreviousEmail: previous})
+	})
+	if err != nil {
+		responses.WriteError(w, r, accounts.DuplicateUserError(err))
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	response := responses.UserResponse{Status: http.StatusOK, Message: "success", Data: map[string]interface{}{"data": user}}
+	json.NewEncoder(w).Encode(response)
+}
+
+// RecoverEmail undoes an email change using the token sent to the old
+// address. A pending change is cancelled, a confirmed one is reverted and
+// every session is revoked in case the account was taken over.
+func RecoverEmail(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	w.Header().Set("Content-Type", "application/json")
+	var request models.TokenRequest
+	var user models.User
+	defer cancel()
+
+	if err := decodeJSON(w, r, &request); err != nil {
+		responses.WriteError(w, r, err)
+		return
+	}
+
+	hash := helpers.HashToken(request.Token)
+	now := time.Now()
+	err := configs.WithTransaction(ctx, configs.DB, func(ctx context.Context) error {
+		err := userCollection.FindOne(ctx, bson.M{
+			"emailchange.recoverhash":  hash,
+			"emailchange.recoveruntil": bson.M{"$gt": now},
+		}).Decode(&user)
+		if err != nil {
+			return responses.NotFoundAs(err, responses.ErrLinkInvalid)
+		}
+		change := user.EmailChange
+		set := bson.M{"tsupdated": now}
+		if change.ConfirmedAt != nil {
+			set["email"] = change.OldEmail
+		}
+		_, err = userCollection.UpdateOne(ctx, bson.M{"_id": user.Id, "emailchange.recoverhash": hash},
+			bson.M{"$set": set, "$unset": bson.M{"emailchange": "", "emaildelivery": ""}})
+		if err != nil {
+			return err
+		}
+		user.EmailChange = nil
+		if change.ConfirmedAt == nil {
+			return nil
+		}
+		previous := user.Email
+		user.Email = change.OldEmail
+		if _, err := accounts.RevokeUserSessions(ctx, user.Id, primitive.NilObjectID); err != nil {
+			return err
+		}
+		return events.Record(ctx, models.UserEmailChanged, user.Id, models.EmailChangeEventData{User: accounts.EventUser(user), PreviousEmail: previous, Recovered: true})
+	})
+	if err != nil {
+		responses.WriteError(w, r, accounts.DuplicateUserError(err))
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	response := responses.UserResponse{Status: http.StatusOK, Message: "success", Data: map[string]interface{}{"data": user}}
+	json.NewEncoder(w).Encode(response)
+}
+
+// deviceName describes a device for humans, e.g. "Firefox on Linux".
+func deviceName(device models.DeviceInfo) string {
+	switch {
+	case device.Browser != "" && device.OS != "":
+		return device.Browser + " on " + device.OS
+	case device.Browser != "":
+		return device.Browser
+	}
+	return device.OS
+}
@@ -0,0 +1,192 @@
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"mux-mongo-api/helpers"
+	"mux-mongo-api/models"
+	"mux-mongo-api/responses"
+	"mux-mongo-api/workers"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// IsAdmin reports whether the user with the given email may use admin APIs
+// for the organization tenant, either as a global admin or as an admin of the
+// organization through their membership or one of their groups.
+func IsAdmin(ctx context.Context, email string, tenant primitive.ObjectID) (bool, error) {
+	var user models.User
+	err := userCollection.FindOne(ctx, bson.M{"email": email}).Decode(&user)
+	if err != nil {
+		return false, responses.NotFoundAs(err, responses.ErrUserNotFound)
+	}
+	if user.IsGlobalAdmin() {
+		return true, nil
+	}
+	access, err := resolveAccess(ctx, user, tenant)
+	return access.Role == models.OrgRoleAdmin, err
+}
+
+// IsGlobalAdmin reports whether the user with the given email may use the
+// admin APIs that are not scoped to an organization.
+func IsGlobalAdmin(ctx context.Context, email string) (bool, error) {
+	var user models.User
+	err := userCollection.FindOne(ctx, bson.M{"email": email}).Decode(&user)
+	if err != nil {
+		return false, responses.NotFoundAs(err, responses.ErrUserNotFound)
+	}
+	return user.IsGlobalAdmin(), nil
+}
+
+// PepperReport counts users per pepper version so operators know when an old
+// SECRET no longer protects any password and can be removed.
+func PepperReport(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	w.Header().Set("Content-Type", "application/json")
+	defer cancel()
+
+	results, err := userCollection.Find(ctx, bson.M{}, options.Find().SetProjection(bson.M{"password": 1}))
+	if err != nil {
+		responses.WriteError(w, r, err)
+		return
+	}
+	defer results.Close(ctx)
+
+	counts := map[int]int{}
+	for results.Next(ctx) {
+		var user models.User
+		if err = results.Decode(&user); err != nil {
+			responses.WriteError(w, r, err)
+			return
+		}
+		version, _ := helpers.SplitPepperVersion(user.Password)
+		counts[version]++
+	}
+	if err = results.Err(); err != nil {
+		responses.WriteError(w, r, err)
+		return
+	}
+
+	current, _ := helpers.CurrentPepper()
+	versions := make([]map[string]interface{}, 0, len(counts))
+	for version, users := range counts {
+		_, configured := helpers.PepperSecret(version)
+		versions = append(versions, map[string]interface{}{
+			"version":    version,
+			"users":      users,
+			"current":    version == current,
+			"configured": configured,
+		})
+	}
+	sort.Slice(versions, func(i, j int) bool { return versions[i]["version"].(int) < versions[j]["version"].(int) })
+
+	w.WriteHeader(http.StatusOK)
+	response := responses.UserResponse{Status: http.StatusOK, Message: "success", Data: map[string]interface{}{"current": current, "versions": versions}}
+	json.NewEncoder(w).Encode(response)
+}
+
+func ListEmailTemplates(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	templates := make([]map[string]interface{}, 0, len(helpers.MailKinds))
+	for _, kind := range helpers.MailKinds {
+		templates = append(templates, map[string]interface{}{"kind": kind, "locales": helpers.MailLocales(kind)})
+	}
+	w.WriteHeader(http.StatusOK)
+	response := responses.UserResponse{Status: http.StatusOK, Message: "success", Data: map[string]interface{}{"templates": templates}}
+	json.NewEncoder(w).Encode(response)
+}
+
+// PreviewEmailTemplate renders a template with sample data. The locale query
+// parameter selects the language and format=html or format=text returns the
+// rendered body as is, so it can be opened in a browser.
+func PreviewEmailTemplate(w http.ResponseWriter, r *http.Request) {
+	kind := mux.Vars(r)["kind"]
+	locale := r.URL.Query().Get("locale")
+
+	email, err := helpers.RenderEmail(kind, locale, helpers.SampleMailData(kind))
+	if errors.Is(err, helpers.ErrUnknownMailTemplate) {
+		responses.WriteError(w, r, responses.NewError(http.StatusNotFound, responses.CodeNotFound, "email template '"+kind+"' does not exist"))
+		return
+	}
+	if err != nil {
+		responses.WriteError(w, r, err)
+		return
+	}
+
+	switch strings.ToLower(r.URL.Query().Get("format")) {
+	case "html":
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(email.HTML))
+	case "text":
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(email.Text))
+	default:
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		response := responses.UserResponse{Status: http.StatusOK, Message: "success", Data: map[string]interface{}{"subject": email.Subject, "text": email.Text, "html": email.HTML}}
+		json.NewEncoder(w).Encode(response)
+	}
+}
+
+func ListOutboxEmails(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	w.Header().Set("Content-Type", "application/json")
+	defer cancel()
+
+	limit, err := strconv.ParseInt(r.URL.Query().Get("limit"), 10, 64)
+	if err != nil || limit < 1 || limit > 500 {
+		limit = 100
+	}
+	emails, err := workers.ListOutboxEmails(ctx, r.URL.Query().Get("status"), limit)
+	if err != nil {
+		responses.WriteError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	response := responses.UserResponse{Status: http.StatusOK, Message: "success", Data: map[string]interface{}{"emails": emails}}
+	json.NewEncoder(w).Encode(response)
+}
+
+func RetryOutboxEmail(w http.ResponseWriter, r *http.Request) {
+	changeOutboxEmail(w, r, workers.RetryOutboxEmail)
+}
+
+func CancelOutboxEmail(w http.ResponseWriter, r *http.Request) {
+	changeOutboxEmail(w, r, workers.CancelOutboxEmail)
+}
+
+func changeOutboxEmail(w http.ResponseWriter, r *http.Request, change func(context.Context, primitive.ObjectID) (models.OutboxEmail, error)) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	w.Header().Set("Content-Type", "application/json")
+	emailId := mux.Vars(r)["emailId"]
+	defer cancel()
+
+	objId, err := primitive.ObjectIDFromHex(emailId)
+	if err != nil {
+		responses.WriteError(w, r, responses.ErrInvalidID(emailId))
+		return
+	}
+	email, err := change(ctx, objId)
+	if errors.Is(err, workers.ErrOutboxStateConflict) {
+		responses.WriteError(w, r, responses.NewError(http.StatusConflict, responses.CodeConflict, err.Error()))
+		return
+	}
+	if err != nil {
+		responses.WriteError(w, r, responses.NotFoundAs(err, responses.NewError(http.StatusNotFound, responses.CodeNotFound, "email not found")))
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	response := responses.UserResponse{Status: http.StatusOK, Message: "success", Data: map[string]interface{}{"data": email}}
+	json.NewEncoder(w).Encode(response)
+}
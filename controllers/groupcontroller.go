@@ -0,0 +1,508 @@
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"mux-mongo-api/accounts"
+	"mux-mongo-api/configs"
+	"mux-mongo-api/models"
+	"mux-mongo-api/responses"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var groupCollection *mongo.Collection = configs.GetCollection(configs.DB, "groups")
+
+var (
+	errGroupNotFound  = responses.NewError(http.StatusNotFound, responses.CodeNotFound, "group not found")
+	errGroupNameTaken = responses.NewError(http.StatusConflict, responses.CodeConflict, "a group with this name already exists")
+	errGroupCycle     = responses.NewError(http.StatusConflict, responses.CodeConflict, "the group already contains this group, nesting it would create a cycle")
+	errNoTenant       = responses.NewError(http.StatusBadRequest, responses.CodeInvalidBody, "groups belong to an organization, log in to one to manage them")
+)
+
+func ListGroups(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	w.Header().Set("Content-Type", "application/json")
+	defer cancel()
+
+	tenant, err := groupTenant(r)
+	if err != nil {
+		responses.WriteError(w, r, err)
+		return
+	}
+	results, err := groupCollection.Find(ctx, bson.M{"organization": tenant}, options.Find().SetSort(bson.M{"name": 1}))
+	if err != nil {
+		responses.WriteError(w, r, err)
+		return
+	}
+	groups := []models.Group{}
+	if err := results.All(ctx, &groups); err != nil {
+		responses.WriteError(w, r, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	response := responses.UserResponse{Status: http.StatusOK, Message: "success", Data: map[string]interface{}{"groups": groups}}
+	json.NewEncoder(w).Encode(response)
+}
+
+func CreateGroup(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	w.Header().Set("Content-Type", "application/json")
+	var request models.CreateGroupRequest
+	defer cancel()
+
+	tenant, err := groupTenant(r)
+	if err != nil {
+		responses.WriteError(w, r, err)
+		return
+	}
+	if err := decodeJSON(w, r, &request); err != nil {
+		responses.WriteError(w, r, err)
+		return
+	}
+	now := time.Now()
+	group := models.Group{
+		Id:           primitive.NewObjectID(),
+		Organization: tenant,
+		Name:         request.Name,
+		Description:  request.Description,
+		Members:      []primitive.ObjectID{},
+		Subgroups:    []primitive.ObjectID{},
+		Roles:        request.Roles,
+		TsCreated:    now,
+		TsUpdated:    now,
+	}
+	if group.Roles == nil {
+		group.Roles = []string{}
+	}
+	_, err = groupCollection.InsertOne(ctx, group)
+	if mongo.IsDuplicateKeyError(err) {
+		err = errGroupNameTaken
+	}
+	if err != nil {
+		responses.WriteError(w, r, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+	response := responses.UserResponse{Status: http.StatusCreated, Message: "success", Data: map[string]interface{}{"data": group}}
+	json.NewEncoder(w).Encode(response)
+}
+
+func GetGroup(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	w.Header().Set("Content-Type", "application/json")
+	var group models.Group
+	defer cancel()
+
+	filter, err := groupFilter(r, "groupId")
+	if err != nil {
+		responses.WriteError(w, r, err)
+		return
+	}
+	if err := groupCollection.FindOne(ctx, filter).Decode(&group); err != nil {
+		responses.WriteError(w, r, responses.NotFoundAs(err, errGroupNotFound))
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	response := responses.UserResponse{Status: http.StatusOK, Message: "success", Data: map[string]interface{}{"data": group}}
+	json.NewEncoder(w).Encode(response)
+}
+
+func UpdateGroup(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	w.Header().Set("Content-Type", "application/json")
+	var request models.UpdateGroupRequest
+	var group models.Group
+	defer cancel()
+
+	filter, err := groupFilter(r, "groupId")
+	if err != nil {
+		responses.WriteError(w, r, err)
+		return
+	}
+	if err := decodeJSON(w, r, &request); err != nil {
+		responses.WriteError(w, r, err)
+		return
+	}
+	update := bson.M{"tsupdated": time.Now()}
+	if request.Name != nil {
+		update["name"] = *request.Name
+	}
+	if request.Description != nil {
+		update["description"] = *request.Description
+	}
+	if request.Roles != nil {
+		update["roles"] = *request.Roles
+	}
+	err = groupCollection.FindOneAndUpdate(ctx, filter, bson.M{"$set": update},
+		options.FindOneAndUpdate().SetReturnDocument(options.After)).Decode(&group)
+	if mongo.IsDuplicateKeyError(err) {
+		err = errGroupNameTaken
+	}
+	if err != nil {
+		responses.WriteError(w, r, responses.NotFoundAs(err, errGroupNotFound))
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	response := responses.UserResponse{Status: http.StatusOK, Message: "success", Data: map[string]interface{}{"data": group}}
+	json.NewEncoder(w).Encode(response)
+}
+
+// DeleteGroup deletes a group and takes it out of the groups it was nested in.
+func DeleteGroup(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	w.Header().Set("Content-Type", "application/json")
+	var group models.Group
+	defer cancel()
+
+	filter, err := groupFilter(r, "groupId")
+	if err != nil {
+		responses.WriteError(w, r, err)
+		return
+	}
+	err = configs.WithTransaction(ctx, configs.DB, func(ctx context.Context) error {
+		if err := groupCollection.FindOneAndDelete(ctx, filter).Decode(&group); err != nil {
+			return responses.NotFoundAs(err, errGroupNotFound)
+		}
+		_, err := groupCollection.UpdateMany(ctx, bson.M{"subgroups": group.Id},
+			bson.M{"$pull": bson.M{"subgroups": group.Id}, "$set": bson.M{"tsupdated": time.Now()}})
+		return err
+	})
+	if err != nil {
+		responses.WriteError(w, r, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	response := responses.UserResponse{Status: http.StatusOK, Message: "success", Data: map[string]interface{}{"data": "group deleted successfully"}}
+	json.NewEncoder(w).Encode(response)
+}
+
+// AddGroupMember adds a member of the organization to a group.
+func AddGroupMember(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	w.Header().Set("Content-Type", "application/json")
+	defer cancel()
+
+	filter, err := groupFilter(r, "groupId")
+	if err != nil {
+		responses.WriteError(w, r, err)
+		return
+	}
+	userId, err := userIdParam(ctx, r)
+	if err != nil {
+		responses.WriteError(w, r, err)
+		return
+	}
+	// global admins see users outside the organization too
+	err = userCollection.FindOne(ctx, bson.M{"_id": userId, "memberships.organization": filter["organization"]}).Err()
+	if err != nil {
+		responses.WriteError(w, r, responses.NotFoundAs(err, responses.NewError(http.StatusConflict, responses.CodeConflict, "user is not a member of the organization")))
+		return
+	}
+	writeGroupUpdate(ctx, w, r, filter, bson.M{"$addToSet": bson.M{"members": userId}})
+}
+
+func RemoveGroupMember(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	w.Header().Set("Content-Type", "application/json")
+	defer cancel()
+
+	filter, err := groupFilter(r, "groupId")
+	if err != nil {
+		responses.WriteError(w, r, err)
+		return
+	}
+	userId := mux.Vars(r)["userId"]
+	objId, err := primitive.ObjectIDFromHex(userId)
+	if err != nil {
+		responses.WriteError(w, r, responses.ErrInvalidID(userId))
+		return
+	}
+	writeGroupUpdate(ctx, w, r, filter, bson.M{"$pull": bson.M{"members": objId}})
+}
+
+// AddSubgroup nests one group in another, refusing to create a cycle.
+func AddSubgroup(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	w.Header().Set("Content-Type", "application/json")
+	var group models.Group
+	defer cancel()
+
+	filter, err := groupFilter(r, "groupId")
+	if err != nil {
+		responses.WriteError(w, r, err)
+		return
+	}
+	subFilter, err := groupFilter(r, "subgroupId")
+	if err != nil {
+		responses.WriteError(w, r, err)
+		return
+	}
+	parent, child := filter["_id"].(primitive.ObjectID), subFilter["_id"].(primitive.ObjectID)
+	tenant := filter["organization"].(primitive.ObjectID)
+
+	err = configs.WithTransaction(ctx, configs.DB, func(ctx context.Context) error {
+		// serializes nesting within the organization so two changes can't
+		// close a cycle together
+		if err := accounts.Guard(ctx, "groups:"+tenant.Hex()); err != nil {
+			return err
+		}
+		if err := groupCollection.FindOne(ctx, subFilter).Err(); err != nil {
+			return responses.NotFoundAs(err, errGroupNotFound)
+		}
+		cycle, err := groupContains(ctx, tenant, child, parent)
+		if err != nil {
+			return err
+		}
+		if cycle {
+			return errGroupCycle
+		}
+		return groupCollection.FindOneAndUpdate(ctx, filter,
+			bson.M{"$addToSet": bson.M{"subgroups": child}, "$set": bson.M{"tsupdated": time.Now()}},
+			options.FindOneAndUpdate().SetReturnDocument(options.After)).Decode(&group)
+	})
+	if err != nil {
+		responses.WriteError(w, r, responses.NotFoundAs(err, errGroupNotFound))
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	response := responses.UserResponse{Status: http.StatusOK, Message: "success", Data: map[string]interface{}{"data": group}}
+	json.NewEncoder(w).Encode(response)
+}
+
+func RemoveSubgroup(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	w.Header().Set("Content-Type", "application/json")
+	defer cancel()
+
+	filter, err := groupFilter(r, "groupId")
+	if err != nil {
+		responses.WriteError(w, r, err)
+		return
+	}
+	subgroupId := mux.Vars(r)["subgroupId"]
+	objId, err := primitive.ObjectIDFromHex(subgroupId)
+	if err != nil {
+		responses.WriteError(w, r, responses.ErrInvalidID(subgroupId))
+		return
+	}
+	writeGroupUpdate(ctx, w, r, filter, bson.M{"$pull": bson.M{"subgroups": objId}})
+}
+
+// GetMyAccess resolves the caller's groups and permissions in the
+// organization their session acts in.
+func GetMyAccess(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	w.Header().Set("Content-Type", "application/json")
+	defer cancel()
+
+	user, err := currentUser(ctx, r)
+	if err != nil {
+		responses.WriteError(w, r, err)
+		return
+	}
+	writeAccess(ctx, w, r, user)
+}
+
+// GetUserAccess resolves a user's groups and permissions in the
+// organization the admin's session acts in.
+func GetUserAccess(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	w.Header().Set("Content-Type", "application/json")
+	var user models.User
+	defer cancel()
+
+	userId, err := userIdParam(ctx, r)
+	if err != nil {
+		responses.WriteError(w, r, err)
+		return
+	}
+	if err := userCollection.FindOne(ctx, bson.M{"_id": userId}).Decode(&user); err != nil {
+		responses.WriteError(w, r, responses.NotFoundAs(err, responses.ErrUserNotFound))
+		return
+	}
+	writeAccess(ctx, w, r, user)
+}
+
+// resolveAccess works out what user may do in tenant. The effective role is
+// the highest of the membership role and the roles granted by the user's
+// groups, including groups that contain one of them as a subgroup. Groups
+// only count while the user is a member of the organization.
+func resolveAccess(ctx context.Context, user models.User, tenant primitive.ObjectID) (models.Access, error) {
+	access := models.Access{User: user.Id, Organization: tenant, Global: user.IsGlobalAdmin(), Groups: []models.Group{}}
+	membership, member := user.MembershipOf(tenant)
+	if !tenant.IsZero() && member {
+		access.Role = membership.Role
+		results, err := groupCollection.Aggregate(ctx, mongo.Pipeline{
+			{{Key: "$match", Value: bson.M{"organization": tenant, "members": user.Id}}},
+			{{Key: "$graphLookup", Value: bson.M{
+				"from":                    groupCollection.Name(),
+				"startWith":               "$_id",
+				"connectFromField":        "_id",
+				"connectToField":          "subgroups",
+				"as":                      "ancestors",
+				"restrictSearchWithMatch": bson.M{"organization": tenant},
+			}}},
+		})
+		if err != nil {
+			return access, err
+		}
+		var direct []struct {
+			models.Group `bson:",inline"`
+			Ancestors    []models.Group `bson:"ancestors"`
+		}
+		if err := results.All(ctx, &direct); err != nil {
+			return access, err
+		}
+		seen := map[primitive.ObjectID]bool{}
+		add := func(group models.Group) {
+			if seen[group.Id] {
+				return
+			}
+			seen[group.Id] = true
+			access.Groups = append(access.Groups, group)
+			for _, role := range group.Roles {
+				if role == models.OrgRoleAdmin || access.Role == "" {
+					access.Role = role
+				}
+			}
+		}
+		for _, group := range direct {
+			add(group.Group)
+			for _, ancestor := range group.Ancestors {
+				add(ancestor)
+			}
+		}
+		sort.Slice(access.Groups, func(i, j int) bool { return access.Groups[i].Name < access.Groups[j].Name })
+	}
+
+	role := access.Role
+	if access.Global {
+		role = models.OrgRoleAdmin
+	}
+	access.Permissions = append([]string{}, models.RolePermissions[role]...)
+	return access, nil
+}
+
+// groupContains reports whether group contains target, directly or through
+// nested subgroups, or is target itself.
+func groupContains(ctx context.Context, tenant, group, target primitive.ObjectID) (bool, error) {
+	if group == target {
+		return true, nil
+	}
+	results, err := groupCollection.Aggregate(ctx, groupDescendantsPipeline(tenant, group))
+	if err != nil {
+		return false, err
+	}
+	var found []struct {
+		Descendants []struct {
+			Id primitive.ObjectID `bson:"_id"`
+		} `bson:"descendants"`
+	}
+	if err := results.All(ctx, &found); err != nil {
+		return false, err
+	}
+	var descendants []primitive.ObjectID
+	for _, g := range found {
+		for _, descendant := range g.Descendants {
+			descendants = append(descendants, descendant.Id)
+		}
+	}
+	return containsGroup(group, target, descendants), nil
+}
+
+// groupDescendantsPipeline collects every group nested below group, following
+// subgroups only within tenant.
+func groupDescendantsPipeline(tenant, group primitive.ObjectID) mongo.Pipeline {
+	return mongo.Pipeline{
+		{{Key: "$match", Value: bson.M{"_id": group}}},
+		{{Key: "$graphLookup", Value: bson.M{
+			"from":                    groupCollection.Name(),
+			"startWith":               "$subgroups",
+			"connectFromField":        "subgroups",
+			"connectToField":          "_id",
+			"as":                      "descendants",
+			"restrictSearchWithMatch": bson.M{"organization": tenant},
+		}}},
+		{{Key: "$project", Value: bson.M{"descendants._id": 1}}},
+	}
+}
+
+// containsGroup reports whether target is group or one of its descendants.
+// Nesting group under target would then close a cycle.
+func containsGroup(group, target primitive.ObjectID, descendants []primitive.ObjectID) bool {
+	if group == target {
+		return true
+	}
+	for _, descendant := range descendants {
+		if descendant == target {
+			return true
+		}
+	}
+	return false
+}
+
+// groupTenant is the organization the request's groups belong to.
+func groupTenant(r *http.Request) (primitive.ObjectID, error) {
+	tenant, _ := r.Context().Value("tenant-id").(primitive.ObjectID)
+	if tenant.IsZero() {
+		return tenant, errNoTenant
+	}
+	return tenant, nil
+}
+
+// groupFilter matches the group named by the route variable within the
+// request's organization.
+func groupFilter(r *http.Request, param string) (bson.M, error) {
+	tenant, err := groupTenant(r)
+	if err != nil {
+		return nil, err
+	}
+	groupId := mux.Vars(r)[param]
+	objId, err := primitive.ObjectIDFromHex(groupId)
+	if err != nil {
+		return nil, responses.ErrInvalidID(groupId)
+	}
+	return bson.M{"_id": objId, "organization": tenant}, nil
+}
+
+func writeGroupUpdate(ctx context.Context, w http.ResponseWriter, r *http.Request, filter bson.M, update bson.M) {
+	var group models.Group
+	update["$set"] = bson.M{"tsupdated": time.Now()}
+	err := groupCollection.FindOneAndUpdate(ctx, filter, update,
+		options.FindOneAndUpdate().SetReturnDocument(options.After)).Decode(&group)
+	if err != nil {
+		responses.WriteError(w, r, responses.NotFoundAs(err, errGroupNotFound))
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	response := responses.UserResponse{Status: http.StatusOK, Message: "success", Data: map[string]interface{}{"data": group}}
+	json.NewEncoder(w).Encode(response)
+}
+
+func writeAccess(ctx context.Context, w http.ResponseWriter, r *http.Request, user models.User) {
+	tenant, _ := r.Context().Value("tenant-id").(primitive.ObjectID)
+	access, err := resolveAccess(ctx, user, tenant)
+	if err != nil {
+		responses.WriteError(w, r, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	response := responses.UserResponse{Status: http.StatusOK, Message: "success", Data: map[string]interface{}{"data": access}}
+	json.NewEncoder(w).Encode(response)
+}
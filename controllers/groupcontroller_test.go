@@ -0,0 +1,53 @@
+package controllers
+
+import (
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestContainsGroup(t *testing.T) {
+	parent, child, grandchild, other := primitive.NewObjectID(), primitive.NewObjectID(), primitive.NewObjectID(), primitive.NewObjectID()
+	tests := []struct {
+		name        string
+		group       primitive.ObjectID
+		target      primitive.ObjectID
+		descendants []primitive.ObjectID
+		want        bool
+	}{
+		{"itself", parent, parent, nil, true},
+		{"direct subgroup", parent, child, []primitive.ObjectID{child}, true},
+		{"nested subgroup", parent, grandchild, []primitive.ObjectID{child, grandchild}, true},
+		{"unrelated group", parent, other, []primitive.ObjectID{child, grandchild}, false},
+		{"no subgroups", child, parent, nil, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := containsGroup(test.group, test.target, test.descendants); got != test.want {
+				t.Errorf("containsGroup = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestGroupDescendantsPipeline(t *testing.T) {
+	tenant, group := primitive.NewObjectID(), primitive.NewObjectID()
+	pipeline := groupDescendantsPipeline(tenant, group)
+	if len(pipeline) != 3 {
+		t.Fatalf("pipeline has %d stages, want 3", len(pipeline))
+	}
+	if match := pipeline[0].Map()["$match"].(bson.M); match["_id"] != group {
+		t.Errorf("$match = %v, want the group", match)
+	}
+
+	lookup := pipeline[1].Map()["$graphLookup"].(bson.M)
+	if lookup["from"] != groupCollection.Name() || lookup["startWith"] != "$subgroups" || lookup["connectFromField"] != "subgroups" || lookup["connectToField"] != "_id" {
+		t.Errorf("$graphLookup = %v, want it to follow subgroups to group ids", lookup)
+	}
+	// without the tenant restriction a subgroup id of another organization
+	// could make an unrelated group look like a cycle
+	if restrict, _ := lookup["restrictSearchWithMatch"].(bson.M); restrict["organization"] != tenant {
+		t.Errorf("restrictSearchWithMatch = %v, want the tenant", lookup["restrictSearchWithMatch"])
+	}
+}
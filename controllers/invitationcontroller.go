@@ -0,0 +1,409 @@
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"mux-mongo-api/accounts"
+	"mux-mongo-api/configs"
+	"mux-mongo-api/helpers"
+	"mux-mongo-api/models"
+	"mux-mongo-api/responses"
+	"mux-mongo-api/workers"
+	"net/http"
+	"net/mail"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var invitationCollection *mongo.Collection = configs.GetCollection(configs.DB, "invitations")
+
+var (
+	errInvitationNotFound = responses.NewError(http.StatusNotFound, responses.CodeNotFound, "invitation not found")
+	errInvitationPending  = responses.NewError(http.StatusConflict, responses.CodeConflict, "an invitation for this address already exists, resend or revoke it")
+)
+
+// CreateInvitation invites someone by email. They choose their own password
+// when accepting, so no admin ever knows it. Organization admins invite
+// users into their own organization only.
+func CreateInvitation(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	w.Header().Set("Content-Type", "application/json")
+	var request models.CreateInvitationRequest
+	defer cancel()
+
+	if err := decodeJSON(w, r, &request); err != nil {
+		responses.WriteError(w, r, err)
+		return
+	}
+	users, err := usersFor(ctx, r)
+	if err != nil {
+		responses.WriteError(w, r, err)
+		return
+	}
+	organization := users.tenant
+	if request.Organization != "" {
+		organization, _ = primitive.ObjectIDFromHex(request.Organization)
+	}
+	if !users.Global() && (organization != users.tenant || request.Role != models.RoleUser) {
+		responses.WriteError(w, r, responses.ErrForbidden)
+		return
+	}
+	if !organization.IsZero() {
+		err := organizationCollection.FindOne(ctx, bson.M{"_id": organization}).Err()
+		if err != nil {
+			responses.WriteError(w, r, responses.NotFoundAs(err, errOrganizationNotFound))
+			return
+		}
+		if request.OrgRole == "" {
+			request.OrgRole = models.OrgRoleMember
+		}
+	} else {
+		request.OrgRole = ""
+	}
+	token, err := helpers.GenerateOpaqueToken()
+	if err != nil {
+		responses.WriteError(w, r, err)
+		return
+	}
+	now := time.Now()
+	invitedBy, _ := r.Context().Value("user-id").(string)
+	invitation := models.Invitation{
+		Id:           primitive.NewObjectID(),
+		Email:        request.Email,
+		Name:         request.Name,
+		Role:         request.Role,
+		Company:      request.Company,
+		Locale:       request.Locale,
+		Organization: organization,
+		OrgRole:      request.OrgRole,
+		Status:       models.InvitationPending,
+		TokenHash:    helpers.HashToken(token),
+		InvitedBy:    invitedBy,
+		ExpiresAt:    now.Add(configs.EnvInvitationTTL()),
+		TsCreated:    now,
+		TsUpdated:    now,
+	}
+
+	err = configs.WithTransaction(ctx, configs.DB, func(ctx context.Context) error {
+		if err := accounts.Guard(ctx, "invitation:"+strings.ToLower(invitation.Email)); err != nil {
+			return err
+		}
+		taken, err := accounts.EmailTaken(ctx, invitation.Email, primitive.NilObjectID)
+		if err != nil {
+			return err
+		}
+		if taken {
+			return responses.ErrEmailTaken
+		}
+		count, err := invitationCollection.CountDocuments(ctx, bson.M{"email": invitation.Email, "status": models.InvitationPending}, options.Count().SetLimit(1))
+		if err != nil {
+			return err
+		}
+		if count > 0 {
+			return errInvitationPending
+		}
+		if err := sendInvitation(ctx, &invitation, token); err != nil {
+			return err
+		}
+		_, err = invitationCollection.InsertOne(ctx, invitation)
+		return err
+	})
+	if mongo.IsDuplicateKeyError(err) {
+		err = errInvitationPending
+	}
+	if err != nil {
+		responses.WriteError(w, r, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+	response := responses.UserResponse{Status: http.StatusCreated, Message: "success", Data: map[string]interface{}{"data": invitation}}
+	json.NewEncoder(w).Encode(response)
+}
+
+// ListInvitations lists invitations, newest first, optionally filtered with
+// ?status=pending|accepted|expired|revoked.
+func ListInvitations(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	w.Header().Set("Content-Type", "application/json")
+	defer cancel()
+
+	now := time.Now()
+	filter := bson.M{}
+	switch status := r.URL.Query().Get("status"); status {
+	case "":
+	case models.InvitationPending:
+		filter = bson.M{"status": status, "expiresat": bson.M{"$gt": now}}
+	case models.InvitationExpired:
+		filter = bson.M{"status": models.InvitationPending, "expiresat": bson.M{"$lte": now}}
+	case models.InvitationAccepted, models.InvitationRevoked:
+		filter = bson.M{"status": status}
+	default:
+		responses.WriteError(w, r, responses.ErrValidation([]responses.FieldError{{Field: "status", Rule: "oneof", Message: "status must be one of [pending accepted expired revoked]"}}))
+		return
+	}
+	users, err := usersFor(ctx, r)
+	if err != nil {
+		responses.WriteError(w, r, err)
+		return
+	}
+	if !users.Global() {
+		filter["organization"] = users.tenant
+	}
+	limit, err := strconv.ParseInt(r.URL.Query().Get("limit"), 10, 64)
+	if err != nil || limit <= 0 || limit > 500 {
+		limit = 100
+	}
+
+	results, err := invitationCollection.Find(ctx, filter, options.Find().SetSort(bson.M{"tscreated": -1}).SetLimit(limit))
+	if err != nil {
+		responses.WriteError(w, r, err)
+		return
+	}
+	invitations := []models.Invitation{}
+	if err := results.All(ctx, &invitations); err != nil {
+		responses.WriteError(w, r, err)
+		return
+	}
+	for i := range invitations {
+		invitations[i].Status = invitations[i].CurrentStatus(now)
+	}
+
+	w.WriteHeader(http.StatusOK)
+	response := responses.UserResponse{Status: http.StatusOK, Message: "success", Data: map[string]interface{}{"invitations": invitations}}
+	json.NewEncoder(w).Encode(response)
+}
+
+// ResendInvitation mails a pending or expired invitation again with a new
+// token and expiry. Links from earlier emails stop working.
+func ResendInvitation(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	w.Header().Set("Content-Type", "application/json")
+	var invitation models.Invitation
+	defer cancel()
+
+	filter, err := invitationFilter(ctx, r)
+	if err != nil {
+		responses.WriteError(w, r, err)
+		return
+	}
+	token, err := helpers.GenerateOpaqueToken()
+	if err != nil {
+		responses.WriteError(w, r, err)
+		return
+	}
+
+	previous := primitive.NilObjectID
+	err = configs.WithTransaction(ctx, configs.DB, func(ctx context.Context) error {
+		if err := invitationCollection.FindOne(ctx, filter).Decode(&invitation); err != nil {
+			return responses.NotFoundAs(err, errInvitationNotFound)
+		}
+		if invitation.Status != models.InvitationPending {
+			return responses.NewError(http.StatusConflict, responses.CodeConflict, "invitation is "+invitation.Status)
+		}
+		taken, err := accounts.EmailTaken(ctx, invitation.Email, primitive.NilObjectID)
+		if err != nil {
+			return err
+		}
+		if taken {
+			return responses.ErrEmailTaken
+		}
+		previous = invitation.OutboxMail
+		now := time.Now()
+		invitation.TokenHash = helpers.HashToken(token)
+		invitation.ExpiresAt = now.Add(configs.EnvInvitationTTL())
+		invitation.TsUpdated = now
+		if err := sendInvitation(ctx, &invitation, token); err != nil {
+			return err
+		}
+		_, err = invitationCollection.UpdateOne(ctx, bson.M{"_id": invitation.Id, "status": models.InvitationPending}, bson.M{"$set": bson.M{
+			"tokenhash":   invitation.TokenHash,
+			"expiresat":   invitation.ExpiresAt,
+			"sends":       invitation.Sends,
+			"outboxemail": invitation.OutboxMail,
+			"tsupdated":   invitation.TsUpdated,
+		}})
+		return err
+	})
+	if err != nil {
+		responses.WriteError(w, r, err)
+		return
+	}
+	cancelInvitationEmail(ctx, previous)
+
+	w.WriteHeader(http.StatusOK)
+	response := responses.UserResponse{Status: http.StatusOK, Message: "success", Data: map[string]interface{}{"data": invitation}}
+	json.NewEncoder(w).Encode(response)
+}
+
+// RevokeInvitation withdraws an invitation that has not been accepted yet.
+func RevokeInvitation(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	w.Header().Set("Content-Type", "application/json")
+	var invitation models.Invitation
+	defer cancel()
+
+	filter, err := invitationFilter(ctx, r)
+	if err != nil {
+		responses.WriteError(w, r, err)
+		return
+	}
+	now := time.Now()
+	err = invitationCollection.FindOneAndUpdate(ctx,
+		bson.M{"$and": bson.A{filter, bson.M{"status": models.InvitationPending}}},
+		bson.M{"$set": bson.M{"status": models.InvitationRevoked, "revokedat": now, "tsupdated": now}},
+		options.FindOneAndUpdate().SetReturnDocument(options.After),
+	).Decode(&invitation)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		if err := invitationCollection.FindOne(ctx, filter).Decode(&invitation); err != nil {
+			responses.WriteError(w, r, responses.NotFoundAs(err, errInvitationNotFound))
+			return
+		}
+		responses.WriteError(w, r, responses.NewError(http.StatusConflict, responses.CodeConflict, "invitation is "+invitation.Status))
+		return
+	}
+	if err != nil {
+		responses.WriteError(w, r, err)
+		return
+	}
+	cancelInvitationEmail(ctx, invitation.OutboxMail)
+
+	w.WriteHeader(http.StatusOK)
+	response := responses.UserResponse{Status: http.StatusOK, Message: "success", Data: map[string]interface{}{"data": invitation}}
+	json.NewEncoder(w).Encode(response)
+}
+
+// AcceptInvitation creates the invited user with the password they chose.
+// The account is active right away since the token proves the address.
+func AcceptInvitation(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	w.Header().Set("Content-Type", "application/json")
+	var request models.AcceptInvitationRequest
+	var invitation models.Invitation
+	var user models.User
+	defer cancel()
+
+	if err := decodeJSON(w, r, &request); err != nil {
+		responses.WriteError(w, r, err)
+		return
+	}
+
+	hash := helpers.HashToken(request.Token)
+	now := time.Now()
+	err := invitationCollection.FindOne(ctx, bson.M{"tokenhash": hash, "status": models.InvitationPending, "expiresat": bson.M{"$gt": now}}).Decode(&invitation)
+	if err != nil {
+		responses.WriteError(w, r, responses.NotFoundAs(err, responses.ErrLinkInvalid))
+		return
+	}
+	name := request.Name
+	if name == "" {
+		name = invitation.Name
+	}
+	if name == "" {
+		responses.WriteError(w, r, responses.ErrValidation([]responses.FieldError{{Field: "name", Rule: "required", Message: "name is required"}}))
+		return
+	}
+	if err := checkPassword("password", request.Password, invitation.Email, name); err != nil {
+		responses.WriteError(w, r, err)
+		return
+	}
+	password, err := helpers.GenerateHash(request.Password)
+	if err != nil {
+		responses.WriteError(w, r, err)
+		return
+	}
+
+	user = models.User{
+		Id:        primitive.NewObjectID(),
+		Name:      name,
+		Email:     invitation.Email,
+		Company:   invitation.Company,
+		Locale:    invitation.Locale,
+		Password:  password,
+		Role:      invitation.Role,
+		IsActive:  true,
+		TsCreated: now,
+		TsUpdated: now,
+	}
+	if !invitation.Organization.IsZero() {
+		user.Memberships = []models.Membership{{Organization: invitation.Organization, Role: invitation.OrgRole, TsJoined: now}}
+	}
+	err = configs.WithTransaction(ctx, configs.DB, func(ctx context.Context) error {
+		// only one request can move the invitation out of pending
+		updated, err := invitationCollection.UpdateOne(ctx,
+			bson.M{"_id": invitation.Id, "tokenhash": hash, "status": models.InvitationPending},
+			bson.M{"$set": bson.M{"status": models.InvitationAccepted, "acceptedat": now, "user": user.Id, "tsupdated": now}})
+		if err != nil {
+			return err
+		}
+		if updated.ModifiedCount == 0 {
+			return responses.ErrLinkInvalid
+		}
+		return accounts.CreateUser(ctx, user, false)
+	})
+	if err != nil {
+		responses.WriteError(w, r, accounts.DuplicateUserError(err))
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+	response := responses.UserResponse{Status: http.StatusCreated, Message: "success", Data: map[string]interface{}{"data": user}}
+	json.NewEncoder(w).Encode(response)
+}
+
+// sendInvitation queues the invitation email carrying token and counts the
+// send on invitation.
+func sendInvitation(ctx context.Context, invitation *models.Invitation, token string) error {
+	invitation.Sends++
+	to := mail.Address{Name: invitation.Name, Address: invitation.Email}
+	key := "invitation:" + invitation.Id.Hex() + ":" + strconv.Itoa(invitation.Sends)
+	id, err := workers.EnqueueEmail(ctx, key, primitive.NilObjectID, to, invitation.Locale, helpers.MailAdminInvite, helpers.MailData{
+		"Link":      helpers.AppLink("/invitations/accept", token),
+		"InvitedBy": invitation.InvitedBy,
+		"Role":      invitation.Role,
+		"Company":   invitation.Company,
+		"ExpiresAt": invitation.ExpiresAt.UTC().Format("2006-01-02 15:04 MST"),
+	})
+	invitation.OutboxMail = id
+	return err
+}
+
+// cancelInvitationEmail stops an invitation email with a stale link that
+// hasn't gone out yet. Emails already sent or gone are fine to ignore.
+func cancelInvitationEmail(ctx context.Context, id primitive.ObjectID) {
+	if id.IsZero() {
+		return
+	}
+	_, err := workers.CancelOutboxEmail(ctx, id)
+	if err != nil && !errors.Is(err, mongo.ErrNoDocuments) && !errors.Is(err, workers.ErrOutboxStateConflict) {
+		log.Println("cancel invitation email:", err)
+	}
+}
+
+// invitationFilter matches the invitation named in the route among those the
+// caller's tenant includes.
+func invitationFilter(ctx context.Context, r *http.Request) (bson.M, error) {
+	invitationId := mux.Vars(r)["invitationId"]
+	objId, err := primitive.ObjectIDFromHex(invitationId)
+	if err != nil {
+		return nil, responses.ErrInvalidID(invitationId)
+	}
+	users, err := usersFor(ctx, r)
+	if err != nil {
+		return nil, err
+	}
+	filter := bson.M{"_id": objId}
+	if !users.Global() {
+		filter["organization"] = users.tenant
+	}
+	return filter, nil
+}
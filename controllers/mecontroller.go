@@ -0,0 +1,125 @@
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"mux-mongo-api/accounts"
+	"mux-mongo-api/configs"
+	"mux-mongo-api/helpers"
+	"mux-mongo-api/models"
+	"mux-mongo-api/responses"
+	"net/http"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// The /user/me handlers act on the user the access token was issued to.
+
+func GetMe(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	w.Header().Set("Content-Type", "application/json")
+	defer cancel()
+
+	user, err := currentUser(ctx, r)
+	if err != nil {
+		responses.WriteError(w, r, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	response := responses.UserResponse{Status: http.StatusOK, Message: "success", Data: map[string]interface{}{"data": user}}
+	json.NewEncoder(w).Encode(response)
+}
+
+func UpdateMe(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	w.Header().Set("Content-Type", "application/json")
+	var request models.UpdateProfileRequest
+	defer cancel()
+
+	user, err := currentUser(ctx, r)
+	if err != nil {
+		responses.WriteError(w, r, err)
+		return
+	}
+	if err := decodeJSON(w, r, &request); err != nil {
+		responses.WriteError(w, r, err)
+		return
+	}
+
+	update := bson.M{"tsupdated": time.Now()}
+	if request.Name != nil {
+		update["name"] = *request.Name
+	}
+	if request.Company != nil {
+		update["company"] = *request.Company
+	}
+	if request.Locale != nil {
+		update["locale"] = *request.Locale
+	}
+	if request.Timezone != nil {
+		update["timezone"] = *request.Timezone
+	}
+	if request.Avatar != nil {
+		update["avatar"] = *request.Avatar
+	}
+
+	err = userCollection.FindOneAndUpdate(
+		ctx,
+		bson.M{"_id": user.Id},
+		bson.M{"$set": update},
+		options.FindOneAndUpdate().SetReturnDocument(options.After),
+	).Decode(&user)
+	if err != nil {
+		responses.WriteError(w, r, responses.NotFoundAs(err, responses.ErrUserNotFound))
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	response := responses.UserResponse{Status: http.StatusOK, Message: "success", Data: map[string]interface{}{"data": user}}
+	json.NewEncoder(w).Encode(response)
+}
+
+// DeleteMe deactivates the caller's account after checking their password and
+// logs them out everywhere. The account is kept so an admin can reactivate it.
+func DeleteMe(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	w.Header().Set("Content-Type", "application/json")
+	var request models.PasswordConfirmRequest
+	defer cancel()
+
+	user, err := currentUser(ctx, r)
+	if err != nil {
+		responses.WriteError(w, r, err)
+		return
+	}
+	if err := decodeJSON(w, r, &request); err != nil {
+		responses.WriteError(w, r, err)
+		return
+	}
+	if !helpers.ValidateHash(user.Password, request.Password) {
+		responses.WriteError(w, r, responses.ErrInvalidCredentials)
+		return
+	}
+
+	var revoked int
+	err = configs.WithTransaction(ctx, configs.DB, func(ctx context.Context) error {
+		if err := accounts.SetActive(ctx, &user, false); err != nil {
+			return err
+		}
+		var err error
+		revoked, err = accounts.RevokeUserSessions(ctx, user.Id, primitive.NilObjectID)
+		return err
+	})
+	if err != nil {
+		responses.WriteError(w, r, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	response := responses.UserResponse{Status: http.StatusOK, Message: "success", Data: map[string]interface{}{"data": "account deactivated", "sessions_revoked": revoked}}
+	json.NewEncoder(w).Encode(response)
+}
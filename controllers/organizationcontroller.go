@@ -0,0 +1,335 @@
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"mux-mongo-api/accounts"
+	"mux-mongo-api/configs"
+	"mux-mongo-api/events"
+	"mux-mongo-api/models"
+	"mux-mongo-api/responses"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var organizationCollection *mongo.Collection = configs.GetCollection(configs.DB, "organizations")
+
+var errSlugTaken = responses.NewError(http.StatusConflict, responses.CodeConflict, "an organization with this slug already exists")
+
+func CreateOrganization(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	w.Header().Set("Content-Type", "application/json")
+	var request models.CreateOrganizationRequest
+	defer cancel()
+
+	if err := decodeJSON(w, r, &request); err != nil {
+		responses.WriteError(w, r, err)
+		return
+	}
+	now := time.Now()
+	organization := models.Organization{
+		Id:        primitive.NewObjectID(),
+		Name:      request.Name,
+		Slug:      request.Slug,
+		TsCreated: now,
+		TsUpdated: now,
+	}
+	_, err := organizationCollection.InsertOne(ctx, organization)
+	if mongo.IsDuplicateKeyError(err) {
+		err = errSlugTaken
+	}
+	if err != nil {
+		responses.WriteError(w, r, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+	response := responses.UserResponse{Status: http.StatusCreated, Message: "success", Data: map[string]interface{}{"data": organization}}
+	json.NewEncoder(w).Encode(response)
+}
+
+// ListOrganizations lists every organization for global admins and the
+// session's organization for organization admins.
+func ListOrganizations(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	w.Header().Set("Content-Type", "application/json")
+	defer cancel()
+
+	users, err := usersFor(ctx, r)
+	if err != nil {
+		responses.WriteError(w, r, err)
+		return
+	}
+	filter := bson.M{}
+	if !users.Global() {
+		filter["_id"] = users.tenant
+	}
+	writeOrganizations(ctx, w, r, filter)
+}
+
+// ListMyOrganizations lists the organizations the caller belongs to, which
+// are the ones they can log in to.
+func ListMyOrganizations(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	w.Header().Set("Content-Type", "application/json")
+	defer cancel()
+
+	user, err := currentUser(ctx, r)
+	if err != nil {
+		responses.WriteError(w, r, err)
+		return
+	}
+	ids := bson.A{}
+	for _, membership := range user.Memberships {
+		ids = append(ids, membership.Organization)
+	}
+	writeOrganizations(ctx, w, r, bson.M{"_id": bson.M{"$in": ids}})
+}
+
+func GetOrganization(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	w.Header().Set("Content-Type", "application/json")
+	var organization models.Organization
+	defer cancel()
+
+	orgId, _, err := organizationParam(ctx, r)
+	if err != nil {
+		responses.WriteError(w, r, err)
+		return
+	}
+	err = organizationCollection.FindOne(ctx, bson.M{"_id": orgId}).Decode(&organization)
+	if err != nil {
+		responses.WriteError(w, r, responses.NotFoundAs(err, errOrganizationNotFound))
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	response := responses.UserResponse{Status: http.StatusOK, Message: "success", Data: map[string]interface{}{"data": organization}}
+	json.NewEncoder(w).Encode(response)
+}
+
+func UpdateOrganization(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	w.Header().Set("Content-Type", "application/json")
+	var request models.UpdateOrganizationRequest
+	var organization models.Organization
+	defer cancel()
+
+	orgId, _, err := organizationParam(ctx, r)
+	if err != nil {
+		responses.WriteError(w, r, err)
+		return
+	}
+	if err := decodeJSON(w, r, &request); err != nil {
+		responses.WriteError(w, r, err)
+		return
+	}
+	update := bson.M{"tsupdated": time.Now()}
+	if request.Name != nil {
+		update["name"] = *request.Name
+	}
+	err = organizationCollection.FindOneAndUpdate(ctx, bson.M{"_id": orgId}, bson.M{"$set": update},
+		options.FindOneAndUpdate().SetReturnDocument(options.After)).Decode(&organization)
+	if err != nil {
+		responses.WriteError(w, r, responses.NotFoundAs(err, errOrganizationNotFound))
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	response := responses.UserResponse{Status: http.StatusOK, Message: "success", Data: map[string]interface{}{"data": organization}}
+	json.NewEncoder(w).Encode(response)
+}
+
+func ListMembers(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	w.Header().Set("Content-Type", "application/json")
+	defer cancel()
+
+	orgId, users, err := organizationParam(ctx, r)
+	if err != nil {
+		responses.WriteError(w, r, err)
+		return
+	}
+	results, err := users.Find(ctx, bson.M{"memberships.organization": orgId}, options.Find().SetSort(bson.M{"name": 1}))
+	if err != nil {
+		responses.WriteError(w, r, err)
+		return
+	}
+	members := []models.User{}
+	if err := results.All(ctx, &members); err != nil {
+		responses.WriteError(w, r, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	response := responses.UserResponse{Status: http.StatusOK, Message: "success", Data: map[string]interface{}{"members": members}}
+	json.NewEncoder(w).Encode(response)
+}
+
+// SetMember changes the role of a member. Global admins can also add users
+// to the organization, organization admins add people by inviting them.
+func SetMember(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	w.Header().Set("Content-Type", "application/json")
+	var request models.MembershipRequest
+	var user models.User
+	defer cancel()
+
+	orgId, users, err := organizationParam(ctx, r)
+	if err != nil {
+		responses.WriteError(w, r, err)
+		return
+	}
+	userId := mux.Vars(r)["userId"]
+	objId, err := primitive.ObjectIDFromHex(userId)
+	if err != nil {
+		responses.WriteError(w, r, responses.ErrInvalidID(userId))
+		return
+	}
+	if err := decodeJSON(w, r, &request); err != nil {
+		responses.WriteError(w, r, err)
+		return
+	}
+
+	err = configs.WithTransaction(ctx, configs.DB, func(ctx context.Context) error {
+		if err := users.FindOne(ctx, bson.M{"_id": objId}).Decode(&user); err != nil {
+			return responses.NotFoundAs(err, responses.ErrUserNotFound)
+		}
+		now := time.Now()
+		previous, ok := user.MembershipOf(orgId)
+		if ok && previous.Role == request.Role {
+			return nil
+		}
+		var update bson.M
+		filter := bson.M{"_id": objId}
+		if ok {
+			filter["memberships.organization"] = orgId
+			update = bson.M{"$set": bson.M{"memberships.$.role": request.Role, "tsupdated": now}}
+		} else {
+			filter["memberships.organization"] = bson.M{"$ne": orgId}
+			update = bson.M{
+				"$push": bson.M{"memberships": models.Membership{Organization: orgId, Role: request.Role, TsJoined: now}},
+				"$set":  bson.M{"tsupdated": now},
+			}
+		}
+		err := userCollection.FindOneAndUpdate(ctx, filter, update, options.FindOneAndUpdate().SetReturnDocument(options.After)).Decode(&user)
+		if err != nil {
+			return err
+		}
+		return events.Record(ctx, models.MembershipChanged, user.Id, models.MembershipEventData{User: user.Id, Organization: orgId, Role: request.Role, PreviousRole: previous.Role})
+	})
+	if err != nil {
+		responses.WriteError(w, r, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	response := responses.UserResponse{Status: http.StatusOK, Message: "success", Data: map[string]interface{}{"data": user}}
+	json.NewEncoder(w).Encode(response)
+}
+
+// RemoveMember takes a user out of an organization and ends their sessions
+// acting in it. The account itself stays.
+func RemoveMember(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	w.Header().Set("Content-Type", "application/json")
+	var user models.User
+	defer cancel()
+
+	orgId, users, err := organizationParam(ctx, r)
+	if err != nil {
+		responses.WriteError(w, r, err)
+		return
+	}
+	userId := mux.Vars(r)["userId"]
+	objId, err := primitive.ObjectIDFromHex(userId)
+	if err != nil {
+		responses.WriteError(w, r, responses.ErrInvalidID(userId))
+		return
+	}
+
+	var revoked int
+	err = configs.WithTransaction(ctx, configs.DB, func(ctx context.Context) error {
+		err := users.FindOneAndUpdate(ctx,
+			bson.M{"_id": objId, "memberships.organization": orgId},
+			bson.M{"$pull": bson.M{"memberships": bson.M{"organization": orgId}}, "$set": bson.M{"tsupdated": time.Now()}},
+		).Decode(&user)
+		if err != nil {
+			return responses.NotFoundAs(err, responses.ErrUserNotFound)
+		}
+		previous, _ := user.MembershipOf(orgId)
+		sessions, err := userSessionCollection.Find(ctx, bson.M{"user": objId, "tenant": orgId}, options.Find().SetProjection(bson.M{"_id": 1}))
+		if err != nil {
+			return err
+		}
+		var ended []models.UserSession
+		if err := sessions.All(ctx, &ended); err != nil {
+			return err
+		}
+		for _, session := range ended {
+			if _, err := accounts.RevokeSession(ctx, bson.M{"_id": session.Id}); err != nil {
+				return err
+			}
+		}
+		revoked = len(ended)
+		_, err = groupCollection.UpdateMany(ctx, bson.M{"organization": orgId, "members": objId}, bson.M{"$pull": bson.M{"members": objId}})
+		if err != nil {
+			return err
+		}
+		return events.Record(ctx, models.MembershipChanged, objId, models.MembershipEventData{User: objId, Organization: orgId, PreviousRole: previous.Role})
+	})
+	if err != nil {
+		responses.WriteError(w, r, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	response := responses.UserResponse{Status: http.StatusOK, Message: "success", Data: map[string]interface{}{"data": "member removed", "sessions_revoked": revoked}}
+	json.NewEncoder(w).Encode(response)
+}
+
+// organizationParam returns the existing organization named in the route if
+// the caller may manage it, with the caller's tenant scope.
+func organizationParam(ctx context.Context, r *http.Request) (primitive.ObjectID, tenantUsers, error) {
+	orgId := mux.Vars(r)["orgId"]
+	objId, err := primitive.ObjectIDFromHex(orgId)
+	if err != nil {
+		return objId, tenantUsers{}, responses.ErrInvalidID(orgId)
+	}
+	users, err := usersFor(ctx, r)
+	if err != nil {
+		return objId, users, err
+	}
+	if !users.Global() && objId != users.tenant {
+		return objId, users, errOrganizationNotFound
+	}
+	err = organizationCollection.FindOne(ctx, bson.M{"_id": objId}, options.FindOne().SetProjection(bson.M{"_id": 1})).Err()
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return objId, users, errOrganizationNotFound
+	}
+	return objId, users, err
+}
+
+func writeOrganizations(ctx context.Context, w http.ResponseWriter, r *http.Request, filter bson.M) {
+	results, err := organizationCollection.Find(ctx, filter, options.Find().SetSort(bson.M{"name": 1}))
+	if err != nil {
+		responses.WriteError(w, r, err)
+		return
+	}
+	organizations := []models.Organization{}
+	if err := results.All(ctx, &organizations); err != nil {
+		responses.WriteError(w, r, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	response := responses.UserResponse{Status: http.StatusOK, Message: "success", Data: map[string]interface{}{"organizations": organizations}}
+	json.NewEncoder(w).Encode(response)
+}
@@ -0,0 +1,245 @@
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"mux-mongo-api/helpers"
+	"mux-mongo-api/models"
+	"mux-mongo-api/privacy"
+	"mux-mongo-api/responses"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+func RequestMyExport(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	w.Header().Set("Content-Type", "application/json")
+	defer cancel()
+
+	user, err := currentUser(ctx, r)
+	if err != nil {
+		responses.WriteError(w, r, err)
+		return
+	}
+	writeExportRequest(ctx, w, r, user.Id, "self")
+}
+
+func ListMyExports(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	w.Header().Set("Content-Type", "application/json")
+	defer cancel()
+
+	user, err := currentUser(ctx, r)
+	if err != nil {
+		responses.WriteError(w, r, err)
+		return
+	}
+	writeExports(ctx, w, r, user.Id)
+}
+
+func DownloadMyExport(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+
+	user, err := currentUser(ctx, r)
+	if err != nil {
+		responses.WriteError(w, r, err)
+		return
+	}
+	writeExportDownload(ctx, w, r, user.Id)
+}
+
+// EraseMe erases the caller's personal data after checking their password.
+func EraseMe(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	w.Header().Set("Content-Type", "application/json")
+	var request models.PasswordConfirmRequest
+	defer cancel()
+
+	user, err := currentUser(ctx, r)
+	if err != nil {
+		responses.WriteError(w, r, err)
+		return
+	}
+	if err := decodeJSON(w, r, &request); err != nil {
+		responses.WriteError(w, r, err)
+		return
+	}
+	if !helpers.ValidateHash(user.Password, request.Password) {
+		responses.WriteError(w, r, responses.ErrInvalidCredentials)
+		return
+	}
+	writeErasure(ctx, w, r, user.Id, "self")
+}
+
+func RequestUserExport(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	w.Header().Set("Content-Type", "application/json")
+	defer cancel()
+
+	userId, err := userIdParam(ctx, r)
+	if err != nil {
+		responses.WriteError(w, r, err)
+		return
+	}
+	email, _ := r.Context().Value("user-id").(string)
+	writeExportRequest(ctx, w, r, userId, email)
+}
+
+func ListUserExports(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	w.Header().Set("Content-Type", "application/json")
+	defer cancel()
+
+	userId, err := userIdParam(ctx, r)
+	if err != nil {
+		responses.WriteError(w, r, err)
+		return
+	}
+	writeExports(ctx, w, r, userId)
+}
+
+func DownloadUserExport(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+
+	userId, err := userIdParam(ctx, r)
+	if err != nil {
+		responses.WriteError(w, r, err)
+		return
+	}
+	writeExportDownload(ctx, w, r, userId)
+}
+
+func EraseUser(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	w.Header().Set("Content-Type", "application/json")
+	defer cancel()
+
+	userId, err := userIdParam(ctx, r)
+	if err != nil {
+		responses.WriteError(w, r, err)
+		return
+	}
+	email, _ := r.Context().Value("user-id").(string)
+	writeErasure(ctx, w, r, userId, email)
+}
+
+// ListErasures lists proofs of erasure, or with ?email= the proof for one
+// address.
+func ListErasures(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	w.Header().Set("Content-Type", "application/json")
+	defer cancel()
+
+	if email := r.URL.Query().Get("email"); email != "" {
+		record, err := privacy.FindErasure(ctx, email)
+		if err != nil {
+			responses.WriteError(w, r, responses.NotFoundAs(err, responses.NewError(http.StatusNotFound, responses.CodeNotFound, "no erasure recorded for this address")))
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		response := responses.UserResponse{Status: http.StatusOK, Message: "success", Data: map[string]interface{}{"data": record}}
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	limit, err := strconv.ParseInt(r.URL.Query().Get("limit"), 10, 64)
+	if err != nil || limit <= 0 || limit > 500 {
+		limit = 100
+	}
+	records, err := privacy.ListErasures(ctx, limit)
+	if err != nil {
+		responses.WriteError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	response := responses.UserResponse{Status: http.StatusOK, Message: "success", Data: map[string]interface{}{"erasures": records}}
+	json.NewEncoder(w).Encode(response)
+}
+
+func writeExportRequest(ctx context.Context, w http.ResponseWriter, r *http.Request, userId primitive.ObjectID, requestedBy string) {
+	format := r.URL.Query().Get("format")
+	switch format {
+	case "":
+		format = models.ExportJSON
+	case models.ExportJSON, models.ExportZip:
+	default:
+		responses.WriteError(w, r, responses.ErrValidation([]responses.FieldError{{Field: "format", Rule: "oneof", Message: "format must be one of [json zip]"}}))
+		return
+	}
+	export, err := privacy.RequestExport(ctx, userId, format, requestedBy)
+	if err != nil {
+		responses.WriteError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+	response := responses.UserResponse{Status: http.StatusAccepted, Message: "success", Data: map[string]interface{}{"data": export}}
+	json.NewEncoder(w).Encode(response)
+}
+
+func writeExports(ctx context.Context, w http.ResponseWriter, r *http.Request, userId primitive.ObjectID) {
+	exports, err := privacy.ListExports(ctx, userId)
+	if err != nil {
+		responses.WriteError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	response := responses.UserResponse{Status: http.StatusOK, Message: "success", Data: map[string]interface{}{"exports": exports}}
+	json.NewEncoder(w).Encode(response)
+}
+
+func writeExportDownload(ctx context.Context, w http.ResponseWriter, r *http.Request, userId primitive.ObjectID) {
+	exportId := mux.Vars(r)["exportId"]
+	objId, err := primitive.ObjectIDFromHex(exportId)
+	if err != nil {
+		responses.WriteError(w, r, responses.ErrInvalidID(exportId))
+		return
+	}
+	export, archive, err := privacy.OpenExport(ctx, userId, objId)
+	if errors.Is(err, privacy.ErrExportNotReady) {
+		responses.WriteError(w, r, responses.NewError(http.StatusConflict, responses.CodeConflict, "export is "+export.Status))
+		return
+	}
+	if err != nil {
+		responses.WriteError(w, r, responses.NotFoundAs(err, responses.NewError(http.StatusNotFound, responses.CodeNotFound, "export not found")))
+		return
+	}
+	defer archive.Close()
+
+	contentType := "application/json"
+	if export.Format == models.ExportZip {
+		contentType = "application/zip"
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", `attachment; filename="`+export.FileName+`"`)
+	w.Header().Set("Content-Length", strconv.FormatInt(export.Size, 10))
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+	io.Copy(w, archive)
+}
+
+func writeErasure(ctx context.Context, w http.ResponseWriter, r *http.Request, userId primitive.ObjectID, requestedBy string) {
+	record, err := privacy.Erase(ctx, userId, requestedBy)
+	switch {
+	case errors.Is(err, privacy.ErrAlreadyErased):
+		responses.WriteError(w, r, responses.NewError(http.StatusConflict, responses.CodeConflict, err.Error()))
+		return
+	case errors.Is(err, mongo.ErrNoDocuments):
+		responses.WriteError(w, r, responses.ErrUserNotFound)
+		return
+	case err != nil:
+		responses.WriteError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	response := responses.UserResponse{Status: http.StatusOK, Message: "success", Data: map[string]interface{}{"data": record}}
+	json.NewEncoder(w).Encode(response)
+}
@@ -0,0 +1,281 @@
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"mux-mongo-api/accounts"
+	"mux-mongo-api/configs"
+	"mux-mongo-api/helpers"
+	"mux-mongo-api/models"
+	"mux-mongo-api/responses"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// lastUsedResolution limits how often a session's last used time is written.
+const lastUsedResolution = time.Minute
+
+// AuthenticateSession returns the session an access token belongs to and
+// records that it was used. Tokens of revoked sessions, and tokens replaced by
+// a refresh, are rejected even if they have not expired yet.
+func AuthenticateSession(ctx context.Context, claims helpers.TokenClaims, accessToken string) (models.UserSession, error) {
+	session, err := findSession(ctx, claims, "accesstokenhash", accessToken)
+	if err != nil || !helpers.TokenHashMatches(session.AccessHash, accessToken) {
+		return session, responses.NotFoundAs(err, responses.ErrSessionRevoked)
+	}
+	if sessionExpired(session, time.Now()) {
+		return session, responses.ErrSessionExpired
+	}
+	if err := checkSessionUser(ctx, session, claims); err != nil {
+		return session, err
+	}
+	touchSession(ctx, session)
+	return session, nil
+}
+
+// AuthenticateRefresh returns the session a refresh token belongs to.
+func AuthenticateRefresh(ctx context.Context, claims helpers.TokenClaims, refreshToken string) (models.UserSession, error) {
+	session, err := findSession(ctx, claims, "refreshtokenhash", refreshToken)
+	if err != nil || !helpers.TokenHashMatches(session.RefreshHash, refreshToken) {
+		return session, responses.NotFoundAs(err, responses.ErrSessionRevoked)
+	}
+	if sessionExpired(session, time.Now()) {
+		return session, responses.ErrSessionExpired
+	}
+	return session, checkSessionUser(ctx, session, claims)
+}
+
+// checkSessionUser makes sure the email a token claims is the address of the
+// session's user. Handlers identify the caller by that email, which may have
+// been registered again by someone else after the user was deleted or changed
+// their address.
+func checkSessionUser(ctx context.Context, session models.UserSession, claims helpers.TokenClaims) error {
+	count, err := userCollection.CountDocuments(ctx, bson.M{"_id": session.User, "email": claims.UserId}, options.Count().SetLimit(1))
+	if err != nil {
+		return err
+	}
+	if count == 0 {
+		return responses.ErrSessionRevoked
+	}
+	return nil
+}
+
+// findSession loads a session by the id embedded in the token. Tokens issued
+// before the id was embedded are looked up by their hash instead. The tenant
+// of the token must be the session's.
+func findSession(ctx context.Context, claims helpers.TokenClaims, hashField, token string) (models.UserSession, error) {
+	var session models.UserSession
+	filter := bson.M{hashField: helpers.HashToken(token)}
+	if claims.SessionId != "" {
+		id, err := primitive.ObjectIDFromHex(claims.SessionId)
+		if err != nil {
+			return session, responses.ErrTokenInvalid
+		}
+		filter = bson.M{"_id": id}
+	}
+	err := userSessionCollection.FindOne(ctx, filter).Decode(&session)
+	if err == nil && claims.TenantId != tenantClaim(session.Tenant) {
+		return session, responses.ErrTokenInvalid
+	}
+	return session, err
+}
+
+// sessionExpired checks the expiry times itself because the TTL monitor only
+// removes expired sessions about once a minute.
+func sessionExpired(session models.UserSession, now time.Time) bool {
+	return (!session.ExpiresAt.IsZero() && now.After(session.ExpiresAt)) ||
+		(!session.IdleExpires.IsZero() && now.After(session.IdleExpires))
+}
+
+// idleExpiry is when session times out if it is not used again after now.
+func idleExpiry(session models.UserSession, now time.Time) time.Time {
+	idle := time.Duration(session.IdleTimeout) * time.Second
+	if idle <= 0 {
+		idle = helpers.DefaultSessionPolicy().IdleTimeout
+	}
+	expiry := now.Add(idle)
+	if !session.ExpiresAt.IsZero() && expiry.After(session.ExpiresAt) {
+		return session.ExpiresAt
+	}
+	return expiry
+}
+
+// touchSession bumps the last used time of a session, sliding its idle expiry
+// forward, unless it was bumped recently so busy clients don't cause a write
+// per request.
+func touchSession(ctx context.Context, session models.UserSession) {
+	now := time.Now()
+	_, err := userSessionCollection.UpdateOne(ctx,
+		bson.M{"_id": session.Id, "$or": bson.A{
+			bson.M{"tslastused": bson.M{"$exists": false}},
+			bson.M{"tslastused": bson.M{"$lt": now.Add(-lastUsedResolution)}},
+		}},
+		bson.M{"$set": bson.M{"tslastused": now, "idleexpiresat": idleExpiry(session, now)}})
+	if err != nil {
+		log.Println("updating session last used time failed:", err)
+	}
+}
+
+// enforceSessionLimit makes room for a new session of user according to the
+// policy's limit, either by refusing the login or by revoking the oldest
+// sessions. Call it inside configs.WithTransaction.
+func enforceSessionLimit(ctx context.Context, user models.User, policy helpers.SessionPolicy) error {
+	if policy.MaxSessions == 0 {
+		return nil
+	}
+	if err := accounts.Guard(ctx, "sessions:"+user.Id.Hex()); err != nil {
+		return err
+	}
+	now := time.Now()
+	results, err := userSessionCollection.Find(ctx, bson.M{
+		"user":          user.Id,
+		"expiresat":     bson.M{"$not": bson.M{"$lte": now}},
+		"idleexpiresat": bson.M{"$not": bson.M{"$lte": now}},
+	}, options.Find().SetSort(bson.D{{Key: "tscreated", Value: 1}, {Key: "_id", Value: 1}}))
+	if err != nil {
+		return err
+	}
+	sessions := []models.UserSession{}
+	if err := results.All(ctx, &sessions); err != nil {
+		return err
+	}
+	excess := len(sessions) - policy.MaxSessions + 1
+	if excess <= 0 {
+		return nil
+	}
+	if policy.LimitStrategy != helpers.SessionLimitEvictOldest {
+		return responses.ErrSessionLimit(policy.MaxSessions, sessions)
+	}
+	for _, session := range sessions[:excess] {
+		if _, err := accounts.RevokeSession(ctx, bson.M{"_id": session.Id}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// currentUser loads the user the access token of r was issued to.
+func currentUser(ctx context.Context, r *http.Request) (models.User, error) {
+	var user models.User
+	email, _ := r.Context().Value("user-id").(string)
+	err := userCollection.FindOne(ctx, bson.M{"email": email}).Decode(&user)
+	return user, responses.NotFoundAs(err, responses.ErrUserNotFound)
+}
+
+func ListMySessions(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	w.Header().Set("Content-Type", "application/json")
+	defer cancel()
+
+	user, err := currentUser(ctx, r)
+	if err != nil {
+		responses.WriteError(w, r, err)
+		return
+	}
+	writeSessions(ctx, w, r, user.Id)
+}
+
+func RevokeMySession(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	w.Header().Set("Content-Type", "application/json")
+	defer cancel()
+
+	user, err := currentUser(ctx, r)
+	if err != nil {
+		responses.WriteError(w, r, err)
+		return
+	}
+	writeRevokedSession(ctx, w, r, user.Id)
+}
+
+func ListUserSessions(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	w.Header().Set("Content-Type", "application/json")
+	defer cancel()
+
+	userId, err := userIdParam(ctx, r)
+	if err != nil {
+		responses.WriteError(w, r, err)
+		return
+	}
+	writeSessions(ctx, w, r, userId)
+}
+
+func RevokeUserSession(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	w.Header().Set("Content-Type", "application/json")
+	defer cancel()
+
+	userId, err := userIdParam(ctx, r)
+	if err != nil {
+		responses.WriteError(w, r, err)
+		return
+	}
+	writeRevokedSession(ctx, w, r, userId)
+}
+
+// userIdParam returns the id of the user named in the route if the caller's
+// tenant includes them.
+func userIdParam(ctx context.Context, r *http.Request) (primitive.ObjectID, error) {
+	userId := mux.Vars(r)["userId"]
+	objId, err := primitive.ObjectIDFromHex(userId)
+	if err != nil {
+		return objId, responses.ErrInvalidID(userId)
+	}
+	users, err := usersFor(ctx, r)
+	if err != nil {
+		return objId, err
+	}
+	err = users.FindOne(ctx, bson.M{"_id": objId}, options.FindOne().SetProjection(bson.M{"_id": 1})).Err()
+	return objId, responses.NotFoundAs(err, responses.ErrUserNotFound)
+}
+
+func writeSessions(ctx context.Context, w http.ResponseWriter, r *http.Request, userId primitive.ObjectID) {
+	results, err := userSessionCollection.Find(ctx, bson.M{"user": userId}, options.Find().SetSort(bson.M{"tscreated": -1}))
+	if err != nil {
+		responses.WriteError(w, r, err)
+		return
+	}
+	sessions := []models.UserSession{}
+	if err = results.All(ctx, &sessions); err != nil {
+		responses.WriteError(w, r, err)
+		return
+	}
+	current, _ := r.Context().Value("session-id").(primitive.ObjectID)
+	for i := range sessions {
+		sessions[i].Current = sessions[i].Id == current
+	}
+
+	w.WriteHeader(http.StatusOK)
+	response := responses.UserResponse{Status: http.StatusOK, Message: "success", Data: map[string]interface{}{"sessions": sessions}}
+	json.NewEncoder(w).Encode(response)
+}
+
+func writeRevokedSession(ctx context.Context, w http.ResponseWriter, r *http.Request, userId primitive.ObjectID) {
+	sessionId := mux.Vars(r)["sessionId"]
+	objId, err := primitive.ObjectIDFromHex(sessionId)
+	if err != nil {
+		responses.WriteError(w, r, responses.ErrInvalidID(sessionId))
+		return
+	}
+	var session models.UserSession
+	err = configs.WithTransaction(ctx, configs.DB, func(ctx context.Context) error {
+		var err error
+		session, err = accounts.RevokeSession(ctx, bson.M{"_id": objId, "user": userId})
+		return err
+	})
+	if err != nil {
+		responses.WriteError(w, r, responses.NotFoundAs(err, responses.ErrSessionNotFound))
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	response := responses.UserResponse{Status: http.StatusOK, Message: "success", Data: map[string]interface{}{"data": session}}
+	json.NewEncoder(w).Encode(response)
+}
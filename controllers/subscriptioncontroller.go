@@ -0,0 +1,213 @@
+package controllers
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"mux-mongo-api/configs"
+	"mux-mongo-api/models"
+	"mux-mongo-api/responses"
+	"mux-mongo-api/workers"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var webhookSubscriptionCollection *mongo.Collection = configs.GetCollection(configs.DB, "webhook_subscriptions")
+
+var errWebhookNotFound = responses.NewError(http.StatusNotFound, responses.CodeNotFound, "webhook subscription not found")
+
+func ListWebhooks(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	w.Header().Set("Content-Type", "application/json")
+	defer cancel()
+
+	results, err := webhookSubscriptionCollection.Find(ctx, bson.M{}, options.Find().SetSort(bson.M{"tscreated": 1}))
+	if err != nil {
+		responses.WriteError(w, r, err)
+		return
+	}
+	subscriptions := []models.WebhookSubscription{}
+	if err = results.All(ctx, &subscriptions); err != nil {
+		responses.WriteError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	response := responses.UserResponse{Status: http.StatusOK, Message: "success", Data: map[string]interface{}{"webhooks": subscriptions}}
+	json.NewEncoder(w).Encode(response)
+}
+
+// CreateWebhook registers a subscription. The signing secret is generated
+// unless one is supplied and is only ever returned in this response.
+func CreateWebhook(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	w.Header().Set("Content-Type", "application/json")
+	var request models.CreateWebhookRequest
+	defer cancel()
+
+	if err := decodeJSON(w, r, &request); err != nil {
+		responses.WriteError(w, r, err)
+		return
+	}
+	secret := request.Secret
+	if secret == "" {
+		b := make([]byte, 32)
+		if _, err := rand.Read(b); err != nil {
+			responses.WriteError(w, r, err)
+			return
+		}
+		secret = hex.EncodeToString(b)
+	}
+
+	subscription := models.WebhookSubscription{
+		Id:          primitive.NewObjectID(),
+		URL:         request.URL,
+		Events:      request.Events,
+		Secret:      secret,
+		Description: request.Description,
+		Active:      true,
+		TsCreated:   time.Now(),
+		TsUpdated:   time.Now(),
+	}
+	if _, err := webhookSubscriptionCollection.InsertOne(ctx, subscription); err != nil {
+		responses.WriteError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusCreated)
+	response := responses.UserResponse{Status: http.StatusCreated, Message: "success", Data: map[string]interface{}{"data": subscription, "secret": secret}}
+	json.NewEncoder(w).Encode(response)
+}
+
+func UpdateWebhook(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	w.Header().Set("Content-Type", "application/json")
+	webhookId := mux.Vars(r)["webhookId"]
+	var request models.UpdateWebhookRequest
+	var subscription models.WebhookSubscription
+	defer cancel()
+
+	objId, err := primitive.ObjectIDFromHex(webhookId)
+	if err != nil {
+		responses.WriteError(w, r, responses.ErrInvalidID(webhookId))
+		return
+	}
+	if err := decodeJSON(w, r, &request); err != nil {
+		responses.WriteError(w, r, err)
+		return
+	}
+
+	update := bson.M{"tsupdated": time.Now()}
+	if request.URL != nil {
+		update["url"] = *request.URL
+	}
+	if request.Events != nil {
+		update["events"] = *request.Events
+	}
+	if request.Description != nil {
+		update["description"] = *request.Description
+	}
+	if request.Active != nil {
+		update["active"] = *request.Active
+	}
+	err = webhookSubscriptionCollection.FindOneAndUpdate(
+		ctx,
+		bson.M{"_id": objId},
+		bson.M{"$set": update},
+		options.FindOneAndUpdate().SetReturnDocument(options.After),
+	).Decode(&subscription)
+	if err != nil {
+		responses.WriteError(w, r, responses.NotFoundAs(err, errWebhookNotFound))
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	response := responses.UserResponse{Status: http.StatusOK, Message: "success", Data: map[string]interface{}{"data": subscription}}
+	json.NewEncoder(w).Encode(response)
+}
+
+func DeleteWebhook(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	w.Header().Set("Content-Type", "application/json")
+	webhookId := mux.Vars(r)["webhookId"]
+	defer cancel()
+
+	objId, err := primitive.ObjectIDFromHex(webhookId)
+	if err != nil {
+		responses.WriteError(w, r, responses.ErrInvalidID(webhookId))
+		return
+	}
+	result, err := webhookSubscriptionCollection.DeleteOne(ctx, bson.M{"_id": objId})
+	if err != nil {
+		responses.WriteError(w, r, err)
+		return
+	}
+	if result.DeletedCount < 1 {
+		responses.WriteError(w, r, errWebhookNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	response := responses.UserResponse{Status: http.StatusOK, Message: "success", Data: map[string]interface{}{"data": "webhook deleted successfully"}}
+	json.NewEncoder(w).Encode(response)
+}
+
+// TestWebhook sends a webhook.test event to the subscription immediately and
+// reports how the subscriber answered.
+func TestWebhook(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	w.Header().Set("Content-Type", "application/json")
+	webhookId := mux.Vars(r)["webhookId"]
+	var subscription models.WebhookSubscription
+	defer cancel()
+
+	objId, err := primitive.ObjectIDFromHex(webhookId)
+	if err != nil {
+		responses.WriteError(w, r, responses.ErrInvalidID(webhookId))
+		return
+	}
+	err = webhookSubscriptionCollection.FindOne(ctx, bson.M{"_id": objId}).Decode(&subscription)
+	if err != nil {
+		responses.WriteError(w, r, responses.NotFoundAs(err, errWebhookNotFound))
+		return
+	}
+	// a paused subscription can still be tested
+	subscription.Active = true
+	delivery, err := workers.SendTestWebhook(ctx, subscription)
+	if err != nil {
+		responses.WriteError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	response := responses.UserResponse{Status: http.StatusOK, Message: "success", Data: map[string]interface{}{"data": delivery}}
+	json.NewEncoder(w).Encode(response)
+}
+
+func ListWebhookDeliveries(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	w.Header().Set("Content-Type", "application/json")
+	webhookId := mux.Vars(r)["webhookId"]
+	defer cancel()
+
+	objId, err := primitive.ObjectIDFromHex(webhookId)
+	if err != nil {
+		responses.WriteError(w, r, responses.ErrInvalidID(webhookId))
+		return
+	}
+	limit, err := strconv.ParseInt(r.URL.Query().Get("limit"), 10, 64)
+	if err != nil || limit < 1 || limit > 500 {
+		limit = 100
+	}
+	deliveries, err := workers.ListWebhookDeliveries(ctx, objId, limit)
+	if err != nil {
+		responses.WriteError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	response := responses.UserResponse{Status: http.StatusOK, Message: "success", Data: map[string]interface{}{"deliveries": deliveries}}
+	json.NewEncoder(w).Encode(response)
+}
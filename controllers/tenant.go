@@ -0,0 +1,124 @@
+package controllers
+
+import (
+	"context"
+	"mux-mongo-api/models"
+	"mux-mongo-api/responses"
+	"net/http"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// tenantUsers is the users collection as one request may see it. Global
+// admins see every user, a session acting in an organization sees its
+// members, and a session acting in none sees only its own user. Controllers
+// read and write users of other requests through it so no query can forget
+// the tenant filter.
+type tenantUsers struct {
+	caller models.User
+	tenant primitive.ObjectID
+	scope  bson.M
+	admin  bool
+}
+
+// usersFor returns the tenant scope of r, which must have passed
+// middlewareAccess.
+func usersFor(ctx context.Context, r *http.Request) (tenantUsers, error) {
+	caller, err := currentUser(ctx, r)
+	if err != nil {
+		return tenantUsers{}, err
+	}
+	tenant, _ := r.Context().Value("tenant-id").(primitive.ObjectID)
+	users := tenantUsers{caller: caller, tenant: tenant}
+	switch {
+	case caller.IsGlobalAdmin():
+		users.admin = true
+	case !tenant.IsZero():
+		users.scope = bson.M{"memberships.organization": tenant}
+		access, err := resolveAccess(ctx, caller, tenant)
+		if err != nil {
+			return users, err
+		}
+		users.admin = access.Role == models.OrgRoleAdmin
+	default:
+		users.scope = bson.M{"_id": caller.Id}
+	}
+	return users, nil
+}
+
+// Global reports whether the scope is unrestricted.
+func (t tenantUsers) Global() bool {
+	return t.scope == nil
+}
+
+// IsAdmin reports whether the caller may manage the users in scope.
+func (t tenantUsers) IsAdmin() bool {
+	return t.admin
+}
+
+func (t tenantUsers) filter(filter bson.M) bson.M {
+	if t.scope == nil {
+		return filter
+	}
+	return bson.M{"$and": bson.A{filter, t.scope}}
+}
+
+func (t tenantUsers) FindOne(ctx context.Context, filter bson.M, opts ...*options.FindOneOptions) *mongo.SingleResult {
+	return userCollection.FindOne(ctx, t.filter(filter), opts...)
+}
+
+func (t tenantUsers) Find(ctx context.Context, filter bson.M, opts ...*options.FindOptions) (*mongo.Cursor, error) {
+	return userCollection.Find(ctx, t.filter(filter), opts...)
+}
+
+func (t tenantUsers) FindOneAndUpdate(ctx context.Context, filter bson.M, update interface{}, opts ...*options.FindOneAndUpdateOptions) *mongo.SingleResult {
+	return userCollection.FindOneAndUpdate(ctx, t.filter(filter), update, opts...)
+}
+
+func (t tenantUsers) FindOneAndDelete(ctx context.Context, filter bson.M, opts ...*options.FindOneAndDeleteOptions) *mongo.SingleResult {
+	return userCollection.FindOneAndDelete(ctx, t.filter(filter), opts...)
+}
+
+func (t tenantUsers) UpdateOne(ctx context.Context, filter bson.M, update interface{}, opts ...*options.UpdateOptions) (*mongo.UpdateResult, error) {
+	return userCollection.UpdateOne(ctx, t.filter(filter), update, opts...)
+}
+
+var (
+	errOrganizationNotFound = responses.NewError(http.StatusNotFound, responses.CodeNotFound, "organization not found")
+	errNotMember            = responses.NewError(http.StatusForbidden, responses.CodeForbidden, "you are not a member of this organization")
+)
+
+// loginTenant picks the organization a new session of user acts in. Users
+// must be members of the requested organization, global admins may act in any.
+// Without a request it is the user's only organization, or none.
+func loginTenant(ctx context.Context, user models.User, requested string) (primitive.ObjectID, error) {
+	if requested == "" {
+		if len(user.Memberships) == 1 {
+			return user.Memberships[0].Organization, nil
+		}
+		return primitive.NilObjectID, nil
+	}
+	org, err := primitive.ObjectIDFromHex(requested)
+	if err != nil {
+		return org, responses.ErrInvalidID(requested)
+	}
+	if _, ok := user.MembershipOf(org); ok {
+		return org, nil
+	}
+	if !user.IsGlobalAdmin() {
+		return org, errNotMember
+	}
+	err = organizationCollection.FindOne(ctx, bson.M{"_id": org}, options.FindOne().SetProjection(bson.M{"_id": 1})).Err()
+	return org, responses.NotFoundAs(err, errOrganizationNotFound)
+}
+
+// tenantClaim is the token claim naming tenant.
+func tenantClaim(tenant primitive.ObjectID) string {
+	if tenant.IsZero() {
+		return ""
+	}
+	return tenant.Hex()
+}
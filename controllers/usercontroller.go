@@ -3,124 +3,118 @@ package controllers
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"log"
+	"mux-mongo-api/accounts"
 	"mux-mongo-api/configs"
+	"mux-mongo-api/events"
 	"mux-mongo-api/helpers"
 	"mux-mongo-api/models"
 	"mux-mongo-api/responses"
+	"mux-mongo-api/workers"
 	"net/http"
+	"net/mail"
 	"strings"
+	"sync"
 	"time"
 
-	"github.com/go-playground/validator/v10"
 	"github.com/gorilla/mux"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
 var userCollection *mongo.Collection = configs.GetCollection(configs.DB, "users")
 var userSessionCollection *mongo.Collection = configs.GetCollection(configs.DB, "usersession")
 
-var validate = validator.New()
-
 func Register(w http.ResponseWriter, r *http.Request) {
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	w.Header().Set("Content-Type", "application/json")
-	var user models.User
+	var request models.RegisterRequest
 	defer cancel()
 
-	if err := json.NewDecoder(r.Body).Decode(&user); err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		response := responses.UserResponse{Status: http.StatusBadRequest, Message: "error", Data: map[string]interface{}{"data": err.Error()}}
-		json.NewEncoder(w).Encode(response)
+	if err := decodeJSON(w, r, &request); err != nil {
+		responses.WriteError(w, r, err)
+		return
+	}
+	if err := checkPassword("password", request.Password, request.Email, request.Name); err != nil {
+		responses.WriteError(w, r, err)
 		return
 	}
 
-	err := userCollection.FindOne(ctx, bson.M{"email": user.Email}).Decode(&user)
+	hash, err := helpers.GenerateHash(request.Password)
 	if err != nil {
-		newUser := models.User{
-			Id:        primitive.NewObjectID(),
-			Name:      user.Name,
-			Email:     user.Email,
-			Company:   user.Company,
-			Password:  helpers.GenerateHash(user.Password),
-			Role:      user.Role,
-			IsActive:  false,
-			TsCreated: time.Now(),
-			TsUpdated: time.Now(),
-		}
-		err := userCollection.FindOne(ctx, bson.M{"role": user.Role}).Decode(&user)
-		if err != nil {
-			result, err := userCollection.InsertOne(ctx, newUser)
-			if err != nil {
-				w.WriteHeader(http.StatusInternalServerError)
-				response := responses.UserResponse{Status: http.StatusInternalServerError, Message: "error", Data: map[string]interface{}{"data": err.Error()}}
-				json.NewEncoder(w).Encode(response)
-				return
-			}
-			w.WriteHeader(http.StatusCreated)
-			response := responses.UserResponse{Status: http.StatusCreated, Message: "success", Data: map[string]interface{}{"data": result}}
-			json.NewEncoder(w).Encode(response)
-			return
-		}
-		w.WriteHeader(http.StatusConflict)
-		response := responses.UserResponse{Status: http.StatusConflict, Message: "error", Data: map[string]interface{}{"data": "Cannot create more superadmins."}}
-		json.NewEncoder(w).Encode(response)
+		responses.WriteError(w, r, err)
+		return
+	}
+	newUser := models.User{
+		Id:        primitive.NewObjectID(),
+		Name:      request.Name,
+		Email:     request.Email,
+		Company:   request.Company,
+		Locale:    request.Locale,
+		Password:  hash,
+		Role:      models.RoleUser,
+		IsActive:  false,
+		TsCreated: time.Now(),
+		TsUpdated: time.Now(),
+	}
+	if err := accounts.InsertUser(ctx, newUser, false); err != nil {
+		responses.WriteError(w, r, err)
 		return
 	}
-	w.WriteHeader(http.StatusConflict)
-	response := responses.UserResponse{Status: http.StatusConflict, Message: "fail", Data: map[string]interface{}{"data": "email already exists"}}
+	result := &mongo.InsertOneResult{InsertedID: newUser.Id}
+	w.WriteHeader(http.StatusCreated)
+	response := responses.UserResponse{Status: http.StatusCreated, Message: "success", Data: map[string]interface{}{"data": result}}
 	json.NewEncoder(w).Encode(response)
 }
 
+// CreateAdmin creates an admin with a password chosen by the caller.
+//
+// Deprecated: invite admins with CreateInvitation so only they know their
+// password.
 func CreateAdmin(w http.ResponseWriter, r *http.Request) {
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	w.Header().Set("Content-Type", "application/json")
-	var user models.User
+	w.Header().Set("Deprecation", "true")
+	w.Header().Set("Link", `</admin/invitations>; rel="successor-version"`)
+	var request models.CreateAdminRequest
 	defer cancel()
 
-	if err := json.NewDecoder(r.Body).Decode(&user); err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		response := responses.UserResponse{Status: http.StatusBadRequest, Message: "error", Data: map[string]interface{}{"data": err.Error()}}
-		json.NewEncoder(w).Encode(response)
+	if err := decodeJSON(w, r, &request); err != nil {
+		responses.WriteError(w, r, err)
+		return
+	}
+	if err := checkPassword("password", request.Password, request.Email, request.Name); err != nil {
+		responses.WriteError(w, r, err)
 		return
 	}
 
-	err := userCollection.FindOne(ctx, bson.M{"email": user.Email}).Decode(&user)
+	hash, err := helpers.GenerateHash(request.Password)
 	if err != nil {
-		newUser := models.User{
-			Id:        primitive.NewObjectID(),
-			Name:      user.Name,
-			Email:     user.Email,
-			Company:   user.Company,
-			Password:  helpers.GenerateHash(user.Password),
-			Role:      "admin",
-			IsActive:  false,
-			TsCreated: time.Now(),
-			TsUpdated: time.Now(),
-		}
-		err := userCollection.FindOne(ctx, bson.M{"role": user.Role}).Decode(&user)
-		if err != nil {
-			result, err := userCollection.InsertOne(ctx, newUser)
-			if err != nil {
-				w.WriteHeader(http.StatusInternalServerError)
-				response := responses.UserResponse{Status: http.StatusInternalServerError, Message: "error", Data: map[string]interface{}{"data": err.Error()}}
-				json.NewEncoder(w).Encode(response)
-				return
-			}
-			w.WriteHeader(http.StatusCreated)
-			response := responses.UserResponse{Status: http.StatusCreated, Message: "success", Data: map[string]interface{}{"data": result}}
-			json.NewEncoder(w).Encode(response)
-			return
-		}
-		w.WriteHeader(http.StatusConflict)
-		response := responses.UserResponse{Status: http.StatusConflict, Message: "error", Data: map[string]interface{}{"data": "Cannot create more superadmins."}}
-		json.NewEncoder(w).Encode(response)
+		responses.WriteError(w, r, err)
+		return
+	}
+	newUser := models.User{
+		Id:        primitive.NewObjectID(),
+		Name:      request.Name,
+		Email:     request.Email,
+		Company:   request.Company,
+		Locale:    request.Locale,
+		Password:  hash,
+		Role:      models.RoleAdmin,
+		IsActive:  false,
+		TsCreated: time.Now(),
+		TsUpdated: time.Now(),
+	}
+	if err := accounts.InsertUser(ctx, newUser, false); err != nil {
+		responses.WriteError(w, r, err)
 		return
 	}
-	w.WriteHeader(http.StatusConflict)
-	response := responses.UserResponse{Status: http.StatusConflict, Message: "fail", Data: map[string]interface{}{"data": "email already exists"}}
+	result := &mongo.InsertOneResult{InsertedID: newUser.Id}
+	w.WriteHeader(http.StatusCreated)
+	response := responses.UserResponse{Status: http.StatusCreated, Message: "success", Data: map[string]interface{}{"data": result}}
 	json.NewEncoder(w).Encode(response)
 }
 
@@ -133,12 +127,19 @@ func GetUser(w http.ResponseWriter, r *http.Request) {
 	var user models.User
 	defer cancel()
 
-	objId, _ := primitive.ObjectIDFromHex(userId)
-	err := userCollection.FindOne(ctx, bson.M{"_id": objId}).Decode(&user)
+	objId, err := primitive.ObjectIDFromHex(userId)
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		response := responses.UserResponse{Status: http.StatusInternalServerError, Message: "error", Data: map[string]interface{}{"data": err.Error()}}
-		json.NewEncoder(w).Encode(response)
+		responses.WriteError(w, r, responses.ErrInvalidID(userId))
+		return
+	}
+	users, err := usersFor(ctx, r)
+	if err != nil {
+		responses.WriteError(w, r, err)
+		return
+	}
+	err = users.FindOne(ctx, bson.M{"_id": objId}).Decode(&user)
+	if err != nil {
+		responses.WriteError(w, r, responses.NotFoundAs(err, responses.ErrUserNotFound))
 		return
 	}
 
@@ -148,17 +149,95 @@ func GetUser(w http.ResponseWriter, r *http.Request) {
 
 }
 
+func UpdateUser(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	w.Header().Set("Content-Type", "application/json")
+	params := mux.Vars(r)
+	userId := params["userId"]
+
+	var request models.UpdateUserRequest
+	var previous, user models.User
+	defer cancel()
+
+	objId, err := primitive.ObjectIDFromHex(userId)
+	if err != nil {
+		responses.WriteError(w, r, responses.ErrInvalidID(userId))
+		return
+	}
+	if err := decodeJSON(w, r, &request); err != nil {
+		responses.WriteError(w, r, err)
+		return
+	}
+	users, err := usersFor(ctx, r)
+	if err != nil {
+		responses.WriteError(w, r, err)
+		return
+	}
+	// users edit themselves, admins the users in their scope
+	if objId != users.caller.Id && !users.IsAdmin() {
+		responses.WriteError(w, r, responses.ErrForbidden)
+		return
+	}
+	// only the superadmin hands out roles, and can't give up their own
+	if request.Role != nil && (users.caller.Role != models.RoleSuperAdmin || objId == users.caller.Id) {
+		responses.WriteError(w, r, responses.ErrForbidden)
+		return
+	}
+
+	update := bson.M{"tsupdated": time.Now()}
+	if request.Name != nil {
+		update["name"] = *request.Name
+	}
+	if request.Company != nil {
+		update["company"] = *request.Company
+	}
+	if request.Locale != nil {
+		update["locale"] = *request.Locale
+	}
+	if request.Role != nil {
+		update["role"] = *request.Role
+	}
+
+	err = configs.WithTransaction(ctx, configs.DB, func(ctx context.Context) error {
+		err := users.FindOneAndUpdate(
+			ctx,
+			bson.M{"_id": objId},
+			bson.M{"$set": update},
+			options.FindOneAndUpdate().SetReturnDocument(options.Before),
+		).Decode(&previous)
+		if err != nil {
+			return err
+		}
+		err = userCollection.FindOne(ctx, bson.M{"_id": objId}).Decode(&user)
+		if err != nil || previous.Role == user.Role {
+			return err
+		}
+		return events.Record(ctx, models.UserRoleChanged, user.Id, models.RoleChangeEventData{User: accounts.EventUser(user), PreviousRole: previous.Role})
+	})
+	if err != nil {
+		responses.WriteError(w, r, responses.NotFoundAs(accounts.DuplicateUserError(err), responses.ErrUserNotFound))
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	response := responses.UserResponse{Status: http.StatusOK, Message: "success", Data: map[string]interface{}{"data": user}}
+	json.NewEncoder(w).Encode(response)
+}
+
 func GetAllUser(w http.ResponseWriter, r *http.Request) {
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	w.Header().Set("Content-Type", "application/json")
 	var users []models.User
 	defer cancel()
 
-	results, err := userCollection.Find(ctx, bson.M{})
+	scope, err := usersFor(ctx, r)
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		response := responses.UserResponse{Status: http.StatusInternalServerError, Message: "error", Data: map[string]interface{}{"data": err.Error()}}
-		json.NewEncoder(w).Encode(response)
+		responses.WriteError(w, r, err)
+		return
+	}
+	results, err := scope.Find(ctx, bson.M{})
+	if err != nil {
+		responses.WriteError(w, r, err)
 		return
 	}
 
@@ -166,9 +245,8 @@ func GetAllUser(w http.ResponseWriter, r *http.Request) {
 	for results.Next(ctx) {
 		var singleUser models.User
 		if err = results.Decode(&singleUser); err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			response := responses.UserResponse{Status: http.StatusInternalServerError, Message: "error", Data: map[string]interface{}{"data": err.Error()}}
-			json.NewEncoder(w).Encode(response)
+			responses.WriteError(w, r, err)
+			return
 		}
 		users = append(users, singleUser)
 
@@ -182,27 +260,55 @@ func GetAllUser(w http.ResponseWriter, r *http.Request) {
 func DeleteUser(w http.ResponseWriter, r *http.Request) {
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	w.Header().Set("Content-Type", "application/json")
-	requestEmail := r.Context().Value("user-id")
-	log.Println(requestEmail)
-
 	params := mux.Vars(r)
 	userId := params["userId"]
 
 	defer cancel()
-	objId, _ := primitive.ObjectIDFromHex(userId)
+	objId, err := primitive.ObjectIDFromHex(userId)
+	if err != nil {
+		responses.WriteError(w, r, responses.ErrInvalidID(userId))
+		return
+	}
 
-	result, err := userCollection.DeleteOne(ctx, bson.M{"_id": objId})
-	log.Println(result.DeletedCount)
+	users, err := usersFor(ctx, r)
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		response := responses.UserResponse{Status: http.StatusInternalServerError, Message: "error", Data: map[string]interface{}{"data": err.Error()}}
-		json.NewEncoder(w).Encode(response)
+		responses.WriteError(w, r, err)
 		return
 	}
-	if result.DeletedCount < 1 {
-		w.WriteHeader(http.StatusNotFound)
-		response := responses.UserResponse{Status: http.StatusNotFound, Message: "error", Data: map[string]interface{}{"data": "user with given id not found"}}
-		json.NewEncoder(w).Encode(response)
+	// users close their own account with DELETE /user/me, which asks for
+	// their password
+	if objId == users.caller.Id || !users.IsAdmin() {
+		responses.WriteError(w, r, responses.ErrForbidden)
+		return
+	}
+	filter := bson.M{"_id": objId}
+	if !users.Global() {
+		// the account is shared with organizations this admin can't manage
+		filter["memberships"] = bson.M{"$not": bson.M{"$elemMatch": bson.M{"organization": bson.M{"$ne": users.tenant}}}}
+	}
+
+	var user models.User
+	err = configs.WithTransaction(ctx, configs.DB, func(ctx context.Context) error {
+		err := users.FindOneAndDelete(ctx, filter).Decode(&user)
+		if errors.Is(err, mongo.ErrNoDocuments) && filter["memberships"] != nil {
+			if users.FindOne(ctx, bson.M{"_id": objId}).Err() == nil {
+				return responses.NewError(http.StatusConflict, responses.CodeConflict, "user belongs to other organizations, remove them from this one instead")
+			}
+		}
+		if err != nil {
+			return err
+		}
+		_, err = groupCollection.UpdateMany(ctx, bson.M{"members": user.Id}, bson.M{"$pull": bson.M{"members": user.Id}})
+		if err != nil {
+			return err
+		}
+		if _, err := accounts.RevokeUserSessions(ctx, user.Id, primitive.NilObjectID); err != nil {
+			return err
+		}
+		return events.Record(ctx, models.UserDeleted, user.Id, accounts.EventUser(user))
+	})
+	if err != nil {
+		responses.WriteError(w, r, responses.NotFoundAs(err, responses.ErrUserNotFound))
 		return
 	}
 	w.WriteHeader(http.StatusOK)
@@ -217,58 +323,133 @@ func ActivateUser(w http.ResponseWriter, r *http.Request) {
 	params := mux.Vars(r)
 	userId := params["userId"]
 	defer cancel()
-	objId, _ := primitive.ObjectIDFromHex(userId)
-	log.Println(objId)
-	err := userCollection.FindOne(ctx, bson.M{"_id": objId}).Decode(&user)
+	objId, err := primitive.ObjectIDFromHex(userId)
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		response := responses.UserResponse{Status: http.StatusInternalServerError, Message: "error", Data: map[string]interface{}{"data": err.Error()}}
-		json.NewEncoder(w).Encode(response)
+		responses.WriteError(w, r, responses.ErrInvalidID(userId))
 		return
 	}
-	status := helpers.CheckEmail(user.Email, user.Name)
-	if status {
-		w.WriteHeader(http.StatusOK)
-		response := responses.UserResponse{Status: http.StatusOK, Message: "success", Data: map[string]interface{}{"data": user}}
-		json.NewEncoder(w).Encode(response)
+	users, err := usersFor(ctx, r)
+	if err != nil {
+		responses.WriteError(w, r, err)
 		return
 	}
-	w.WriteHeader(http.StatusBadRequest)
-	response := responses.UserResponse{Status: http.StatusBadRequest, Message: "failed", Data: map[string]interface{}{"data": "email id is invalid"}}
+	err = users.FindOne(ctx, bson.M{"_id": objId}).Decode(&user)
+	if err != nil {
+		responses.WriteError(w, r, responses.NotFoundAs(err, responses.ErrUserNotFound))
+		return
+	}
+	if user.Delivery != nil && user.Delivery.Undeliverable {
+		responses.WriteError(w, r, responses.ErrEmailUndeliverable)
+		return
+	}
+	var emailId primitive.ObjectID
+	err = configs.WithTransaction(ctx, configs.DB, func(ctx context.Context) error {
+		if err := accounts.SetActive(ctx, &user, true); err != nil {
+			return err
+		}
+		to := mail.Address{Name: user.Name, Address: user.Email}
+		var err error
+		emailId, err = workers.EnqueueEmail(ctx, "welcome:"+user.Id.Hex(), user.Id, to, user.Locale, helpers.MailWelcome, nil)
+		return err
+	})
+	if err != nil {
+		responses.WriteError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	response := responses.UserResponse{Status: http.StatusOK, Message: "success", Data: map[string]interface{}{"data": user, "email": emailId}}
 	json.NewEncoder(w).Encode(response)
 }
 
 func LoginUser(w http.ResponseWriter, r *http.Request) {
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	w.Header().Set("Content-Type", "application/json")
+	var request models.LoginRequest
 	var user models.User
 	var session models.UserSession
-	email := r.Header.Get("email")
-	password := r.Header.Get("password")
-
 	defer cancel()
-	err := userCollection.FindOne(ctx, bson.M{"email": email}).Decode(&user)
+
+	// credentials were historically sent as headers; keep accepting them
+	// while also supporting a JSON body
+	if r.Header.Get("email") != "" {
+		request.Email = r.Header.Get("email")
+		request.Password = r.Header.Get("password")
+		request.RevokeSession = r.Header.Get("revoke-session")
+		request.Organization = r.Header.Get("organization")
+		if err := validateStruct(&request); err != nil {
+			responses.WriteError(w, r, err)
+			return
+		}
+	} else if err := decodeJSON(w, r, &request); err != nil {
+		responses.WriteError(w, r, err)
+		return
+	}
+
+	err := userCollection.FindOne(ctx, bson.M{"email": request.Email}).Decode(&user)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		// verify against a throwaway hash so unknown emails take as long as
+		// wrong passwords and can't be told apart
+		helpers.ValidateHash(dummyHash(), request.Password)
+		responses.WriteError(w, r, responses.ErrInvalidCredentials)
+		return
+	}
 	if err != nil {
-		w.WriteHeader(http.StatusNotFound)
-		response := responses.UserResponse{Status: http.StatusNotFound, Message: "error", Data: map[string]interface{}{"data": err.Error()}}
-		json.NewEncoder(w).Encode(response)
+		responses.WriteError(w, r, err)
 		return
 	}
 
-	status := helpers.ValidateHash(user.Password, password)
+	status := helpers.ValidateHash(user.Password, request.Password)
 	if status {
-		token := helpers.GenerateToken(user.Email)
-		refresh := helpers.GenerateRefreshToken(user.Email)
-		session.AccessToken = token
-		session.RefreshToken = refresh
+		// checked after the password so the status of an account doesn't leak
+		if !user.IsActive {
+			responses.WriteError(w, r, responses.ErrAccountInactive)
+			return
+		}
+		rehashPassword(ctx, user, request.Password)
+		tenant, err := loginTenant(ctx, user, request.Organization)
+		if err != nil {
+			responses.WriteError(w, r, err)
+			return
+		}
+		session.Id = primitive.NewObjectID()
+		session.User = user.Id
+		session.Tenant = tenant
+		policy := helpers.GetSessionPolicy(user.Role)
+		now := time.Now()
+		session.ExpiresAt = now.Add(policy.Lifetime)
+		session.IdleExpires = now.Add(policy.IdleTimeout)
+		session.IdleTimeout = int64(policy.IdleTimeout / time.Second)
+		token := helpers.GenerateToken(user.Email, session.Id.Hex(), tenantClaim(tenant))
+		refresh := helpers.GenerateRefreshToken(user.Email, session.Id.Hex(), tenantClaim(tenant), session.ExpiresAt)
+		session.AccessHash = helpers.HashToken(token)
+		session.RefreshHash = helpers.HashToken(refresh)
 		session.UserAgent = r.Header.Get("User-Agent")
-		session.TsCreated = time.Now()
-
-		_, err = userSessionCollection.InsertOne(ctx, session)
+		device := helpers.ParseUserAgent(session.UserAgent)
+		session.Device = &device
+		session.IP = helpers.ClientIP(r)
+		session.TsCreated = now
+		session.TsUpdated = session.TsCreated
+		session.TsLastUsed = session.TsCreated
+
+		err = configs.WithTransaction(ctx, configs.DB, func(ctx context.Context) error {
+			if request.RevokeSession != "" {
+				revokeId, _ := primitive.ObjectIDFromHex(request.RevokeSession)
+				_, err := accounts.RevokeSession(ctx, bson.M{"_id": revokeId, "user": user.Id})
+				if err != nil {
+					return responses.NotFoundAs(err, responses.ErrSessionNotFound)
+				}
+			}
+			if err := enforceSessionLimit(ctx, user, policy); err != nil {
+				return err
+			}
+			_, err := userSessionCollection.InsertOne(ctx, session)
+			if err != nil {
+				return err
+			}
+			return events.Record(ctx, models.SessionStarted, user.Id, models.SessionEventData{Session: session.Id, User: user.Id, UserAgent: session.UserAgent})
+		})
 		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			response := responses.UserResponse{Status: http.StatusInternalServerError, Message: "error", Data: map[string]interface{}{"data": err.Error()}}
-			json.NewEncoder(w).Encode(response)
+			responses.WriteError(w, r, err)
 			return
 		}
 
@@ -277,10 +458,44 @@ func LoginUser(w http.ResponseWriter, r *http.Request) {
 		json.NewEncoder(w).Encode(response)
 		return
 	}
-	w.WriteHeader(http.StatusUnauthorized)
-	response := responses.UserResponse{Status: http.StatusUnauthorized, Message: "failed", Data: map[string]interface{}{"data": "invalid credentials"}}
-	json.NewEncoder(w).Encode(response)
+	responses.WriteError(w, r, responses.ErrInvalidCredentials)
+
+}
+
+var (
+	dummyPasswordHash     string
+	dummyPasswordHashOnce sync.Once
+)
 
+// dummyHash is a hash of a random password made with the current hasher, for
+// logins of unknown users.
+func dummyHash() string {
+	dummyPasswordHashOnce.Do(func() {
+		var err error
+		dummyPasswordHash, err = helpers.GenerateHash(primitive.NewObjectID().Hex())
+		if err != nil {
+			log.Println("generating dummy password hash failed:", err)
+		}
+	})
+	return dummyPasswordHash
+}
+
+// rehashPassword upgrades a user's stored hash after a successful login when it
+// was made with an outdated algorithm or cost. Failures only get logged since
+// the old hash keeps working.
+func rehashPassword(ctx context.Context, user models.User, password string) {
+	if !helpers.NeedsRehash(user.Password) {
+		return
+	}
+	hash, err := helpers.GenerateHash(password)
+	if err != nil {
+		log.Println("rehash failed:", err)
+		return
+	}
+	_, err = userCollection.UpdateOne(ctx, bson.M{"_id": user.Id, "password": user.Password}, bson.M{"$set": bson.M{"password": hash}})
+	if err != nil {
+		log.Println("rehash failed:", err)
+	}
 }
 
 func RefreshToken(w http.ResponseWriter, r *http.Request) {
@@ -294,38 +509,35 @@ func RefreshToken(w http.ResponseWriter, r *http.Request) {
 	defer cancel()
 	err := userCollection.FindOne(ctx, bson.M{"email": requestEmail}).Decode(&user)
 	if err != nil {
-		w.WriteHeader(http.StatusNotFound)
-		response := responses.UserResponse{Status: http.StatusNotFound, Message: "error", Data: map[string]interface{}{"data": err.Error()}}
-		json.NewEncoder(w).Encode(response)
+		responses.WriteError(w, r, responses.NotFoundAs(err, responses.ErrUserNotFound))
 		return
 	}
-	log.Println(authHeader[1])
-	err = userSessionCollection.FindOne(ctx, bson.M{"refreshtoken": authHeader[1]}).Decode(&session)
+	sessionId, _ := r.Context().Value("session-id").(primitive.ObjectID)
+	err = userSessionCollection.FindOne(ctx, bson.M{"_id": sessionId}).Decode(&session)
 
 	if err != nil {
-		w.WriteHeader(http.StatusNotFound)
-		response := responses.UserResponse{Status: http.StatusNotFound, Message: "error", Data: map[string]interface{}{"data": err.Error()}}
-		json.NewEncoder(w).Encode(response)
+		responses.WriteError(w, r, responses.NotFoundAs(err, responses.ErrSessionNotFound))
 		return
 	}
-	var token = helpers.GenerateToken(user.Email)
+	var token = helpers.GenerateToken(user.Email, session.Id.Hex(), tenantClaim(session.Tenant))
 
-	result, err := userSessionCollection.UpdateOne(
+	_, err = userSessionCollection.UpdateOne(
 		ctx,
 		bson.M{"_id": session.Id},
-		bson.D{
-			{"$set", bson.D{{"accesstoken", token}}},
-		},
+		bson.M{"$set": bson.M{
+			"accesstokenhash": helpers.HashToken(token),
+			"tsupdated":       time.Now(),
+			"tslastused":      time.Now(),
+			"idleexpiresat":   idleExpiry(session, time.Now()),
+			"ip":              helpers.ClientIP(r),
+		}},
 	)
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		response := responses.UserResponse{Status: http.StatusInternalServerError, Message: "error", Data: map[string]interface{}{"data": err.Error()}}
-		json.NewEncoder(w).Encode(response)
+		responses.WriteError(w, r, err)
 		return
 	}
-	log.Println(result)
 
 	w.WriteHeader(http.StatusOK)
-	response := responses.UserResponse{Status: http.StatusOK, Message: "success", Data: map[string]interface{}{"details": user, "access-token": token, "refresh-token": session.RefreshToken}}
+	response := responses.UserResponse{Status: http.StatusOK, Message: "success", Data: map[string]interface{}{"details": user, "access-token": token, "refresh-token": authHeader[1]}}
 	json.NewEncoder(w).Encode(response)
 }
@@ -0,0 +1,127 @@
+//go:build integration
+
+// These tests register users against a real MongoDB replica set, since the
+// registration checks only hold up under concurrency inside transactions.
+// Run them from the repository root with
+//
+//	cp .env controllers/.env
+//	MONGOURI='mongodb://localhost:27017/?replicaSet=rs0' go test -tags integration ./controllers
+//
+// They create users in the configured database and delete them again.
+package controllers_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"mux-mongo-api/configs"
+	"mux-mongo-api/models"
+	"mux-mongo-api/routes"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const concurrentRegistrations = 8
+
+var userCollection = configs.GetCollection(configs.DB, "users")
+
+func TestRegisterSameEmailConcurrently(t *testing.T) {
+	server := newServer(t)
+	email := fmt.Sprintf("race-%s@example.com", primitive.NewObjectID().Hex())
+	cleanup(t, email)
+
+	requests := make([]models.RegisterRequest, concurrentRegistrations)
+	for i := range requests {
+		requests[i] = registerRequest(email)
+	}
+	assertOneCreated(t, registerConcurrently(t, server, requests))
+}
+
+// newServer serves the user routes, skipping the test unless MONGOURI names a
+// replica set.
+func newServer(t *testing.T) *httptest.Server {
+	t.Helper()
+	if !strings.Contains(os.Getenv("MONGOURI"), "replicaSet=") {
+		t.Skip("MONGOURI does not name a replica set")
+	}
+	router := mux.NewRouter()
+	routes.UserRoute(router)
+	server := httptest.NewServer(router)
+	t.Cleanup(server.Close)
+	return server
+}
+
+// cleanup deletes the users registered with emails once the test is done.
+func cleanup(t *testing.T, emails ...string) {
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		if _, err := userCollection.DeleteMany(ctx, bson.M{"email": bson.M{"$in": emails}}); err != nil {
+			t.Error(err)
+		}
+	})
+}
+
+func registerRequest(email string) models.RegisterRequest {
+	return models.RegisterRequest{
+		Name:     "Race Test",
+		Email:    email,
+		Password: "Race-" + primitive.NewObjectID().Hex() + "!",
+	}
+}
+
+// registerConcurrently posts every request at once and returns the status
+// codes of the responses.
+func registerConcurrently(t *testing.T, server *httptest.Server, requests []models.RegisterRequest) []int {
+	t.Helper()
+	statuses := make([]int, len(requests))
+	start := make(chan struct{})
+	var wg sync.WaitGroup
+	for i, request := range requests {
+		body, err := json.Marshal(request)
+		if err != nil {
+			t.Fatal(err)
+		}
+		wg.Add(1)
+		go func(i int, body []byte) {
+			defer wg.Done()
+			<-start
+			response, err := http.Post(server.URL+"/user/register", "application/json", bytes.NewReader(body))
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			response.Body.Close()
+			statuses[i] = response.StatusCode
+		}(i, body)
+	}
+	close(start)
+	wg.Wait()
+	return statuses
+}
+
+func assertOneCreated(t *testing.T, statuses []int) {
+	t.Helper()
+	created, conflicts := 0, 0
+	for _, status := range statuses {
+		switch status {
+		case http.StatusCreated:
+			created++
+		case http.StatusConflict:
+			conflicts++
+		}
+	}
+	if created != 1 || conflicts != len(statuses)-1 {
+		t.Errorf("got statuses %v, want one %d and %d times %d", statuses, http.StatusCreated, len(statuses)-1, http.StatusConflict)
+	}
+}
@@ -0,0 +1,142 @@
+package controllers
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"mux-mongo-api/accounts"
+	"mux-mongo-api/helpers"
+	"mux-mongo-api/responses"
+	"net/http"
+	"reflect"
+	"strings"
+
+	"github.com/go-playground/locales/en"
+	ut "github.com/go-playground/universal-translator"
+	"github.com/go-playground/validator/v10"
+	en_translations "github.com/go-playground/validator/v10/translations/en"
+)
+
+// maxBodyBytes caps every JSON request body decoded by the controllers.
+const maxBodyBytes = 1 << 20
+
+var validate = newValidator()
+
+var translator ut.Translator
+
+func newValidator() *validator.Validate {
+	v := validator.New()
+	// report fields by their JSON name so errors match what the client sent
+	v.RegisterTagNameFunc(func(field reflect.StructField) string {
+		name := strings.SplitN(field.Tag.Get("json"), ",", 2)[0]
+		if name == "-" {
+			return ""
+		}
+		if name == "" {
+			return field.Name
+		}
+		return name
+	})
+
+	english := en.New()
+	translator, _ = ut.New(english, english).GetTranslator("en")
+	if err := en_translations.RegisterDefaultTranslations(v, translator); err != nil {
+		panic(err)
+	}
+	return v
+}
+
+// decodeJSON decodes a size limited body into dst, rejecting unknown fields,
+// and then validates dst. The returned error is ready for responses.WriteError.
+func decodeJSON(w http.ResponseWriter, r *http.Request, dst interface{}) error {
+	r.Body = http.MaxBytesReader(w, r.Body, maxBodyBytes)
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+
+	if err := decoder.Decode(dst); err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			return responses.ErrBodyTooLarge(maxBodyBytes)
+		}
+		return responses.Wrap(err, http.StatusBadRequest, responses.CodeInvalidBody, bodyErrorDetail(err))
+	}
+	if decoder.Decode(&struct{}{}) != io.EOF {
+		return responses.NewError(http.StatusBadRequest, responses.CodeInvalidBody, "request body must contain a single JSON object")
+	}
+	return validateStruct(dst)
+}
+
+// validateStruct normalizes and then validates s, a pointer to a request DTO.
+func validateStruct(s interface{}) error {
+	normalizeEmails(s)
+	err := validate.Struct(s)
+	if err == nil {
+		return nil
+	}
+	var validationErrors validator.ValidationErrors
+	if !errors.As(err, &validationErrors) {
+		return err
+	}
+	fields := make([]responses.FieldError, 0, len(validationErrors))
+	for _, fe := range validationErrors {
+		fields = append(fields, responses.FieldError{
+			Field:   fe.Field(),
+			Rule:    fe.Tag(),
+			Message: fe.Translate(translator),
+		})
+	}
+	return responses.ErrValidation(fields)
+}
+
+// normalizeEmails trims and lowercases the fields of s validated as email
+// addresses, so addresses differing only in case are the same account.
+func normalizeEmails(s interface{}) {
+	v := reflect.ValueOf(s)
+	if v.Kind() != reflect.Ptr || v.Elem().Kind() != reflect.Struct {
+		return
+	}
+	v = v.Elem()
+	for i := 0; i < v.NumField(); i++ {
+		field := v.Type().Field(i)
+		if field.Type.Kind() != reflect.String || !v.Field(i).CanSet() {
+			continue
+		}
+		for _, rule := range strings.Split(field.Tag.Get("validate"), ",") {
+			if rule == "email" {
+				v.Field(i).SetString(accounts.NormalizeEmail(v.Field(i).String()))
+				break
+			}
+		}
+	}
+}
+
+// checkPassword applies the deployment's password policy and reports any
+// violations as field errors on the given field.
+func checkPassword(field, password, email, name string) error {
+	err := helpers.CheckPassword(password, email, name)
+	var policyErr *helpers.PasswordPolicyError
+	if !errors.As(err, &policyErr) {
+		return err
+	}
+	fields := make([]responses.FieldError, 0, len(policyErr.Violations))
+	for _, v := range policyErr.Violations {
+		fields = append(fields, responses.FieldError{Field: field, Rule: v.Rule, Message: v.Message})
+	}
+	return responses.ErrValidation(fields)
+}
+
+func bodyErrorDetail(err error) string {
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	switch {
+	case errors.Is(err, io.EOF):
+		return "request body must not be empty"
+	case errors.As(err, &syntaxErr):
+		return "request body contains malformed JSON"
+	case errors.As(err, &typeErr):
+		return "field '" + typeErr.Field + "' has the wrong type"
+	case strings.HasPrefix(err.Error(), "json: unknown field "):
+		return "request body contains unknown field " + strings.TrimPrefix(err.Error(), "json: unknown field ")
+	}
+	return "request body is invalid"
+}
@@ -0,0 +1,211 @@
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"mux-mongo-api/accounts"
+	"mux-mongo-api/configs"
+	"mux-mongo-api/models"
+	"mux-mongo-api/responses"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/sendgrid/sendgrid-go/helpers/eventwebhook"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var emailEventCollection *mongo.Collection = configs.GetCollection(configs.DB, "email_events")
+var emailSuppressionCollection *mongo.Collection = configs.GetCollection(configs.DB, "email_suppressions")
+
+const maxWebhookBytes = 5 << 20
+
+// sendGridEvent is one entry of the JSON array SendGrid posts to the webhook.
+type sendGridEvent struct {
+	Email     string `json:"email"`
+	Timestamp int64  `json:"timestamp"`
+	Event     string `json:"event"`
+	EventId   string `json:"sg_event_id"`
+	MessageId string `json:"sg_message_id"`
+	Type      string `json:"type"`
+	Reason    string `json:"reason"`
+}
+
+// suppresses reports whether the event means the address must not be emailed
+// again. Blocked bounces are temporary, so only hard bounces count.
+func (e sendGridEvent) suppresses() bool {
+	switch e.Event {
+	case "bounce":
+		return e.Type != "blocked"
+	case "dropped", "spamreport":
+		return true
+	}
+	return false
+}
+
+// SendGridWebhook ingests SendGrid's signed event webhook.
+func SendGridWebhook(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	w.Header().Set("Content-Type", "application/json")
+	defer cancel()
+
+	payload, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxWebhookBytes))
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			responses.WriteError(w, r, responses.ErrBodyTooLarge(maxWebhookBytes))
+			return
+		}
+		responses.WriteError(w, r, responses.ErrInvalidBody(err))
+		return
+	}
+	if err := verifySendGridSignature(r, payload); err != nil {
+		responses.WriteError(w, r, err)
+		return
+	}
+
+	var events []sendGridEvent
+	if err := json.Unmarshal(payload, &events); err != nil {
+		responses.WriteError(w, r, responses.ErrInvalidBody(err))
+		return
+	}
+	for _, event := range events {
+		if err := recordEmailEvent(ctx, event); err != nil {
+			// SendGrid retries the whole batch on a non 2xx response and events
+			// are deduplicated by id, so failing here is safe
+			responses.WriteError(w, r, err)
+			return
+		}
+	}
+
+	w.WriteHeader(http.StatusOK)
+	response := responses.UserResponse{Status: http.StatusOK, Message: "success", Data: map[string]interface{}{"events": len(events)}}
+	json.NewEncoder(w).Encode(response)
+}
+
+func verifySendGridSignature(r *http.Request, payload []byte) error {
+	invalid := responses.NewError(http.StatusUnauthorized, responses.CodeSignatureInvalid, "webhook signature is invalid")
+	key := configs.EnvSendGridWebhookKey()
+	if key == "" {
+		log.Println("SENDGRID_WEBHOOK_PUBLIC_KEY is not set, rejecting webhook")
+		return invalid
+	}
+	publicKey, err := eventwebhook.ConvertPublicKeyBase64ToECDSA(key)
+	if err != nil {
+		return responses.Wrap(err, http.StatusInternalServerError, responses.CodeInternal, "webhook verification key is invalid")
+	}
+	signature := r.Header.Get(eventwebhook.VerificationHTTPHeader)
+	timestamp := r.Header.Get(eventwebhook.TimestampHTTPHeader)
+	if signature == "" || timestamp == "" {
+		return invalid
+	}
+	ok, err := eventwebhook.VerifySignature(publicKey, payload, signature, timestamp)
+	if err != nil || !ok {
+		return invalid
+	}
+	return nil
+}
+
+func recordEmailEvent(ctx context.Context, event sendGridEvent) error {
+	address := accounts.NormalizeEmail(event.Email)
+	if address == "" || event.Event == "" {
+		return nil
+	}
+	var user models.User
+	err := userCollection.FindOne(ctx, bson.M{"email": address}, options.FindOne().SetCollation(&options.Collation{Locale: "en", Strength: 2})).Decode(&user)
+	if err != nil && !errors.Is(err, mongo.ErrNoDocuments) {
+		return err
+	}
+
+	eventTime := time.Unix(event.Timestamp, 0)
+	record := models.EmailEvent{
+		EventId:   event.EventId,
+		MessageId: event.MessageId,
+		User:      user.Id,
+		Email:     address,
+		Event:     event.Event,
+		Type:      event.Type,
+		Reason:    event.Reason,
+		Timestamp: eventTime,
+		TsCreated: time.Now(),
+	}
+	filter := bson.M{"eventid": event.EventId}
+	if event.EventId == "" {
+		filter = bson.M{"email": address, "event": event.Event, "timestamp": eventTime}
+	}
+	count, err := emailEventCollection.CountDocuments(ctx, filter, options.Count().SetLimit(1))
+	if err != nil {
+		return err
+	}
+	if count > 0 {
+		// already processed in an earlier delivery of this batch
+		return nil
+	}
+	// the event is only stored once its effects are, so a failure here is
+	// retried with SendGrid's next delivery. Both effects are idempotent.
+	if err := applyEmailEvent(ctx, event, user, address, eventTime); err != nil {
+		return err
+	}
+	_, err = emailEventCollection.InsertOne(ctx, record)
+	if mongo.IsDuplicateKeyError(err) {
+		// a concurrent delivery of the same event won
+		return nil
+	}
+	return err
+}
+
+// applyEmailEvent suppresses the address and updates the user's delivery
+// state for event.
+func applyEmailEvent(ctx context.Context, event sendGridEvent, user models.User, address string, eventTime time.Time) error {
+	var err error
+	if event.suppresses() {
+		_, err = emailSuppressionCollection.UpdateOne(
+			ctx,
+			bson.M{"_id": address},
+			bson.M{"$setOnInsert": models.EmailSuppression{Email: address, Reason: event.Event + ": " + event.Reason, TsCreated: time.Now()}},
+			options.Update().SetUpsert(true),
+		)
+		if err != nil {
+			return err
+		}
+	}
+
+	if user.Id.IsZero() {
+		return nil
+	}
+	delivery := models.EmailDelivery{
+		LastEvent:     event.Event,
+		Reason:        event.Reason,
+		Undeliverable: event.suppresses() || (user.Delivery != nil && user.Delivery.Undeliverable),
+		TsUpdated:     eventTime,
+	}
+	// events can arrive out of order, never let an older one win
+	_, err = userCollection.UpdateOne(
+		ctx,
+		bson.M{"_id": user.Id, "$or": bson.A{
+			bson.M{"emaildelivery.tsupdated": bson.M{"$lte": eventTime}},
+			bson.M{"emaildelivery": bson.M{"$exists": false}},
+		}},
+		bson.M{"$set": bson.M{"emaildelivery": delivery}},
+	)
+	if err == nil && delivery.Undeliverable {
+		_, err = userCollection.UpdateOne(ctx, bson.M{"_id": user.Id}, bson.M{"$set": bson.M{"emaildelivery.undeliverable": true}})
+	}
+	return err
+}
+
+// SuppressionList blocks email to addresses recorded as suppressed by the
+// webhook. It is installed with helpers.SetSuppressionList.
+var SuppressionList suppressionList
+
+type suppressionList struct{}
+
+func (suppressionList) IsSuppressed(ctx context.Context, address string) (bool, error) {
+	count, err := emailSuppressionCollection.CountDocuments(ctx, bson.M{"_id": strings.ToLower(strings.TrimSpace(address))}, options.Count().SetLimit(1))
+	return count > 0, err
+}
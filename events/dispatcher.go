@@ -0,0 +1,238 @@
+package events
+
+import (
+	"context"
+	"errors"
+	"log"
+	"mux-mongo-api/configs"
+	"mux-mongo-api/models"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Subscriber receives domain events. Name must be stable across restarts since
+// it records which events the subscriber has already handled. Returning an
+// error makes the dispatcher hand the event over again later.
+type Subscriber interface {
+	Name() string
+	Handle(ctx context.Context, event models.DomainEvent) error
+}
+
+var (
+	subscribers   []Subscriber
+	subscribersMu sync.RWMutex
+)
+
+// Subscribe registers a subscriber. It should be called before Run.
+func Subscribe(subscriber Subscriber) {
+	subscribersMu.Lock()
+	subscribers = append(subscribers, subscriber)
+	subscribersMu.Unlock()
+}
+
+func getSubscribers() []Subscriber {
+	subscribersMu.RLock()
+	defer subscribersMu.RUnlock()
+	return append([]Subscriber(nil), subscribers...)
+}
+
+const (
+	checkpointId   = "domain_events"
+	claimLease     = time.Minute
+	sweepInterval  = 30 * time.Second
+	sweepMinAge    = 30 * time.Second
+	handlerTimeout = 30 * time.Second
+)
+
+// Run dispatches outbox events to subscribers until ctx is cancelled. New
+// events arrive through a change stream whose resume token is persisted after
+// every event, so a restart continues where the previous process stopped. A
+// periodic sweep redelivers events a subscriber failed on and stands in for
+// the change stream on standalone servers.
+func Run(ctx context.Context) {
+	_, err := domainEventCollection.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{{Key: "dispatchedat", Value: 1}, {Key: "_id", Value: 1}},
+	})
+	if err != nil {
+		log.Println("events: creating indexes failed:", err)
+	}
+
+	go sweep(ctx)
+	if !configs.TransactionsSupported(configs.DB) {
+		return
+	}
+	for ctx.Err() == nil {
+		err := watch(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		log.Println("events: change stream stopped:", err)
+		time.Sleep(5 * time.Second)
+	}
+}
+
+func watch(ctx context.Context) error {
+	opts := options.ChangeStream()
+	var checkpoint struct {
+		ResumeToken bson.Raw `bson:"resumetoken"`
+	}
+	err := checkpointCollection.FindOne(ctx, bson.M{"_id": checkpointId}).Decode(&checkpoint)
+	if err != nil && !errors.Is(err, mongo.ErrNoDocuments) {
+		return err
+	}
+	if checkpoint.ResumeToken != nil {
+		opts.SetResumeAfter(checkpoint.ResumeToken)
+	}
+
+	pipeline := mongo.Pipeline{{{Key: "$match", Value: bson.M{"operationType": "insert"}}}}
+	stream, err := domainEventCollection.Watch(ctx, pipeline, opts)
+	if isHistoryLost(err) {
+		// the token fell off the oplog, the sweep picks up what was missed
+		log.Println("events: resume token is no longer valid, starting from now")
+		_, err = checkpointCollection.DeleteOne(ctx, bson.M{"_id": checkpointId})
+		if err == nil {
+			stream, err = domainEventCollection.Watch(ctx, pipeline)
+		}
+	}
+	if err != nil {
+		return err
+	}
+	defer stream.Close(ctx)
+
+	for stream.Next(ctx) {
+		var change struct {
+			FullDocument models.DomainEvent `bson:"fullDocument"`
+		}
+		if err := stream.Decode(&change); err != nil {
+			return err
+		}
+		dispatch(ctx, change.FullDocument)
+		_, err := checkpointCollection.UpdateOne(
+			ctx,
+			bson.M{"_id": checkpointId},
+			bson.M{"$set": bson.M{"resumetoken": stream.ResumeToken(), "tsupdated": time.Now()}},
+			options.Update().SetUpsert(true),
+		)
+		if err != nil {
+			log.Println("events: saving resume token failed:", err)
+		}
+	}
+	return stream.Err()
+}
+
+func isHistoryLost(err error) bool {
+	var cmdErr mongo.CommandError
+	// ChangeStreamHistoryLost and ChangeStreamFatalError
+	return errors.As(err, &cmdErr) && (cmdErr.Code == 286 || cmdErr.Code == 280)
+}
+
+func sweep(ctx context.Context) {
+	ticker := time.NewTicker(sweepInterval)
+	defer ticker.Stop()
+	for {
+		sweepOnce(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// sweepOnce dispatches events that are still undispatched after sweepMinAge.
+func sweepOnce(ctx context.Context) {
+	results, err := domainEventCollection.Find(
+		ctx,
+		bson.M{"dispatchedat": bson.M{"$exists": false}, "tscreated": bson.M{"$lte": time.Now().Add(-sweepMinAge)}},
+		options.Find().SetSort(bson.M{"_id": 1}).SetLimit(500),
+	)
+	if err != nil {
+		if ctx.Err() == nil {
+			log.Println("events: sweep failed:", err)
+		}
+		return
+	}
+	defer results.Close(ctx)
+	for results.Next(ctx) {
+		var event models.DomainEvent
+		if err := results.Decode(&event); err != nil {
+			log.Println("events: decoding event failed:", err)
+			continue
+		}
+		dispatch(ctx, event)
+	}
+}
+
+// dispatch hands event to every subscriber that has not handled it yet. Each
+// subscriber first claims the event, so concurrent dispatchers in other
+// replicas skip it, and is recorded as handled once it returns without error.
+// The event is marked dispatched when all subscribers have handled it.
+func dispatch(ctx context.Context, event models.DomainEvent) {
+	complete := true
+	for _, subscriber := range getSubscribers() {
+		name := subscriber.Name()
+		if contains(event.Handled, name) {
+			continue
+		}
+		now := time.Now()
+		claim, err := domainEventCollection.UpdateOne(
+			ctx,
+			bson.M{
+				"_id":     event.Id,
+				"handled": bson.M{"$ne": name},
+				"$or": bson.A{
+					bson.M{"claims." + name: bson.M{"$exists": false}},
+					bson.M{"claims." + name: bson.M{"$lt": now}},
+				},
+			},
+			bson.M{"$set": bson.M{"claims." + name: now.Add(claimLease)}},
+		)
+		if err != nil || claim.ModifiedCount == 0 {
+			// someone else is handling it, or already did
+			complete = complete && err == nil && alreadyHandled(ctx, event, name)
+			continue
+		}
+
+		handlerCtx, cancel := context.WithTimeout(ctx, handlerTimeout)
+		err = subscriber.Handle(handlerCtx, event)
+		cancel()
+		if err != nil {
+			log.Println("events:", name, "failed on", event.Type, event.Id.Hex(), err)
+			domainEventCollection.UpdateOne(ctx, bson.M{"_id": event.Id}, bson.M{"$unset": bson.M{"claims." + name: ""}})
+			complete = false
+			continue
+		}
+		_, err = domainEventCollection.UpdateOne(
+			ctx,
+			bson.M{"_id": event.Id},
+			bson.M{"$addToSet": bson.M{"handled": name}, "$unset": bson.M{"claims." + name: ""}},
+		)
+		if err != nil {
+			log.Println("events: recording", name, "handled", event.Id.Hex(), "failed:", err)
+			complete = false
+		}
+	}
+	if complete {
+		domainEventCollection.UpdateOne(ctx, bson.M{"_id": event.Id}, bson.M{"$set": bson.M{"dispatchedat": time.Now()}})
+	}
+}
+
+// alreadyHandled reports whether name already handled the event, in which case
+// it does not hold back marking the event as dispatched.
+func alreadyHandled(ctx context.Context, event models.DomainEvent, name string) bool {
+	count, err := domainEventCollection.CountDocuments(ctx, bson.M{"_id": event.Id, "handled": name})
+	return err == nil && count > 0
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
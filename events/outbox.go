@@ -0,0 +1,34 @@
+package events
+
+import (
+	"context"
+	"mux-mongo-api/configs"
+	"mux-mongo-api/models"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+var domainEventCollection *mongo.Collection = configs.GetCollection(configs.DB, "domain_events")
+var checkpointCollection *mongo.Collection = configs.GetCollection(configs.DB, "event_checkpoints")
+
+// Record writes an event to the outbox. Call it with the context handed out by
+// configs.WithTransaction so the event commits or rolls back together with the
+// write it describes.
+func Record(ctx context.Context, eventType string, aggregate primitive.ObjectID, data interface{}) error {
+	raw, err := bson.Marshal(data)
+	if err != nil {
+		return err
+	}
+	_, err = domainEventCollection.InsertOne(ctx, models.DomainEvent{
+		Id:        primitive.NewObjectID(),
+		Type:      eventType,
+		Aggregate: aggregate,
+		Data:      raw,
+		Handled:   []string{},
+		TsCreated: time.Now(),
+	})
+	return err
+}
@@ -1,14 +1,18 @@
 package helpers
 
 import (
-	"fmt"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
 	"log"
 	"os"
+	"strings"
+	"sync"
 	"time"
 
 	"aidanwoods.dev/go-paseto"
-
-	password "github.com/dwin/goSecretBoxPassword"
 	"github.com/joho/godotenv"
 )
 
@@ -28,23 +32,167 @@ func GetSecretKey() string {
 	return os.Getenv("TOKENSECRET")
 }
 
-func GenerateHash(pass string) string {
-	pwHash, err := password.Hash(pass, GetSecret(), 0, password.ScryptParams{N: 32768, R: 16, P: 1}, password.DefaultParams)
+// GetPreviousSecretKeys returns retired token keys listed in
+// TOKENSECRET_PREVIOUS. Tokens they encrypted keep working until they expire,
+// so TOKENSECRET can be rotated without logging everybody out.
+func GetPreviousSecretKeys() []string {
+	err := godotenv.Load()
+	if err != nil {
+		log.Fatal("Error loading Env File")
+	}
+	var keys []string
+	for _, key := range strings.Split(os.Getenv("TOKENSECRET_PREVIOUS"), ",") {
+		if key = strings.TrimSpace(key); key != "" {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// parseToken decrypts token with the current key or, failing that, one of the
+// previous keys and then checks it against rules.
+func parseToken(token string, rules ...paseto.Rule) (*paseto.Token, error) {
+	parser := paseto.NewParserWithoutExpiryCheck()
+	var parsed *paseto.Token
+	var err error
+	for _, hex := range append([]string{GetSecretKey()}, GetPreviousSecretKeys()...) {
+		key, keyErr := paseto.V4SymmetricKeyFromHex(hex)
+		if keyErr != nil {
+			return nil, keyErr
+		}
+		parsed, err = parser.ParseV4Local(key, token, nil)
+		if err == nil {
+			break
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	for _, rule := range rules {
+		if err := rule(*parsed); err != nil {
+			return nil, err
+		}
+	}
+	return parsed, nil
+}
+
+// sealImplicit binds sealed values to their purpose, so they can't be passed
+// off as tokens and tokens can't be opened as sealed values.
+var sealImplicit = []byte("sealed-value")
+
+// Seal encrypts value with the token key for storage, e.g. links in queued
+// emails that carry live tokens. Open reverses it.
+func Seal(value string) (string, error) {
+	key, err := paseto.V4SymmetricKeyFromHex(GetSecretKey())
+	if err != nil {
+		return "", err
+	}
+	token := paseto.NewToken()
+	token.SetString("value", value)
+	return token.V4Encrypt(key, sealImplicit), nil
+}
+
+// Open decrypts a value made by Seal with the current or a previous token key.
+func Open(sealed string) (string, error) {
+	parser := paseto.NewParserWithoutExpiryCheck()
+	var err error
+	for _, hex := range append([]string{GetSecretKey()}, GetPreviousSecretKeys()...) {
+		key, keyErr := paseto.V4SymmetricKeyFromHex(hex)
+		if keyErr != nil {
+			return "", keyErr
+		}
+		var parsed *paseto.Token
+		if parsed, err = parser.ParseV4Local(key, sealed, sealImplicit); err == nil {
+			return parsed.GetString("value")
+		}
+	}
+	return "", err
+}
+
+// ErrTokenExpired is returned by the token validators when the token was
+// well formed but its expiration time has passed.
+var ErrTokenExpired = errors.New("token expired")
+
+func notExpired() paseto.Rule {
+	return func(token paseto.Token) error {
+		exp, err := token.GetExpiration()
+		if err != nil {
+			return err
+		}
+		if time.Now().After(exp) {
+			return ErrTokenExpired
+		}
+		return nil
+	}
+}
+
+// TokenClaims are the claims the API reads from its tokens. SessionId is
+// empty for tokens issued before sessions were embedded in them. TenantId is
+// the organization the session acts in, empty when it acts in none.
+type TokenClaims struct {
+	UserId    string
+	SessionId string
+	TenantId  string
+}
+
+func tokenClaims(token *paseto.Token) (TokenClaims, error) {
+	var claims TokenClaims
+	var err error
+	claims.UserId, err = token.GetString("user-id")
 	if err != nil {
-		fmt.Println("Hash fail. ", err)
+		return claims, err
 	}
-	return pwHash
+	claims.SessionId, _ = token.GetString("session-id")
+	claims.TenantId, _ = token.GetString("tenant-id")
+	return claims, nil
+}
+
+var (
+	tokenHashKey     string
+	tokenHashKeyOnce sync.Once
+)
+
+// GetTokenHashKey returns the key session token hashes are made with. It
+// defaults to SECRET. Changing it invalidates every stored session.
+func GetTokenHashKey() string {
+	tokenHashKeyOnce.Do(func() {
+		err := godotenv.Load()
+		if err != nil {
+			log.Fatal("Error loading Env File")
+		}
+		tokenHashKey = os.Getenv("TOKEN_HASH_SECRET")
+		if tokenHashKey == "" {
+			tokenHashKey = os.Getenv("SECRET")
+		}
+	})
+	return tokenHashKey
+}
+
+// HashToken returns the keyed hash of a token that is stored in place of the
+// token itself, so reading the sessions collection does not yield usable
+// tokens.
+func HashToken(token string) string {
+	mac := hmac.New(sha256.New, []byte(GetTokenHashKey()))
+	mac.Write([]byte(token))
+	return hex.EncodeToString(mac.Sum(nil))
 }
 
-func ValidateHash(hash, pass string) bool {
-	err := password.Verify(pass, GetSecret(), hash)
+// GenerateOpaqueToken returns a random URL safe token for emailed links.
+// Store it with HashToken.
+func GenerateOpaqueToken() (string, error) {
+	b, err := randomBytes(32)
 	if err != nil {
-		return false
+		return "", err
 	}
-	return true
+	return base64.RawURLEncoding.EncodeToString(b), nil
 }
 
-func GenerateToken(data string) string {
+// TokenHashMatches compares token against a stored hash in constant time.
+func TokenHashMatches(hash, token string) bool {
+	return hash != "" && hmac.Equal([]byte(hash), []byte(HashToken(token)))
+}
+
+func GenerateToken(data, sessionId, tenantId string) string {
 	key, err := paseto.V4SymmetricKeyFromHex(GetSecretKey())
 	if err != nil {
 		return ""
@@ -56,12 +204,18 @@ func GenerateToken(data string) string {
 	token.SetExpiration(time.Now().Add(2 * time.Hour))
 
 	token.SetString("user-id", data)
+	token.SetString("session-id", sessionId)
+	if tenantId != "" {
+		token.SetString("tenant-id", tenantId)
+	}
 
 	encrypted := token.V4Encrypt(key, nil)
 	return encrypted
 }
 
-func GenerateRefreshToken(data string) string {
+// GenerateRefreshToken issues a refresh token that expires together with
+// its session.
+func GenerateRefreshToken(data, sessionId, tenantId string, expires time.Time) string {
 	key, err := paseto.V4SymmetricKeyFromHex(GetSecretKey())
 	if err != nil {
 		return ""
@@ -69,63 +223,38 @@ func GenerateRefreshToken(data string) string {
 	token := paseto.NewToken()
 	token.SetIssuedAt(time.Now())
 	token.SetNotBefore(time.Now())
-	token.SetExpiration(time.Now().Add(24 * time.Hour))
+	token.SetExpiration(expires)
 	token.SetString("user-id", data)
+	token.SetString("session-id", sessionId)
+	if tenantId != "" {
+		token.SetString("tenant-id", tenantId)
+	}
 
 	encrypted := token.V4Encrypt(key, nil)
 	return encrypted
 }
 
-func ValidateAccessToken(token string) (string, error) {
-	parser := paseto.NewParser()
-	parser.AddRule(paseto.NotExpired())
-	parser.AddRule(paseto.ValidAt(time.Now()))
-	log.Println("Token at Validation")
-	key, err := paseto.V4SymmetricKeyFromHex(GetSecretKey())
-	if err != nil {
-		log.Println("error fetching key")
-		return "", err
-	}
-
-	parsedToken, err := parser.ParseV4Local(key, token, nil)
+func ValidateAccessToken(token string) (TokenClaims, error) {
+	parsedToken, err := parseToken(token, notExpired(), paseto.ValidAt(time.Now()))
 	if err != nil {
-		log.Println(err.Error())
-		return "", err
+		return TokenClaims{}, err
 	}
-	return parsedToken.GetString("user-id")
+	return tokenClaims(parsedToken)
 
 }
 
-func ValidateRefreshToken(token string) (string, error) {
-	parser := paseto.NewParser()
-	parser.AddRule(paseto.NotExpired())
-	parser.AddRule(paseto.ValidAt(time.Now()))
-	log.Println("Token at Validation")
-	key, err := paseto.V4SymmetricKeyFromHex(GetSecretKey())
+func ValidateRefreshToken(token string) (TokenClaims, error) {
+	parsedToken, err := parseToken(token, notExpired(), paseto.ValidAt(time.Now()))
 	if err != nil {
-		log.Println("error fetching key")
-		return "", err
+		return TokenClaims{}, err
 	}
-
-	parsedToken, err := parser.ParseV4Local(key, token, nil)
-	if err != nil {
-		log.Println(err.Error())
-		return "", err
-	}
-	return parsedToken.GetString("user-id")
+	return tokenClaims(parsedToken)
 
 }
 
 func TokenParser(token string) (string, error) {
-	parser := paseto.NewParser()
-	key, err := paseto.V4SymmetricKeyFromHex(GetSecretKey())
-	if err != nil {
-		log.Println("error fetching key")
-		return "", err
-	}
-	parsedToken, err := parser.ParseV4Local(key, token, nil)
+	parsedToken, err := parseToken(token, notExpired())
 	if err != nil {
-		log.Println(err.Error())
 		return "", err
 	}
 	return parsedToken.GetString("user-id")
@@ -0,0 +1,323 @@
+package helpers
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"math/bits"
+	"os"
+	"strings"
+	"sync"
+
+	password "github.com/dwin/goSecretBoxPassword"
+	"github.com/joho/godotenv"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/crypto/scrypt"
+)
+
+// PasswordHasher hashes and verifies passwords for one algorithm. Hashes are
+// self-describing strings carrying the algorithm and its parameters, so a
+// hash stays verifiable after the configured algorithm or cost changes.
+type PasswordHasher interface {
+	// Name identifies the algorithm and is the first field of its hashes.
+	Name() string
+	Hash(pass []byte) (string, error)
+	Verify(pass []byte, encoded string) (bool, error)
+	// NeedsRehash reports whether encoded was made with parameters that differ
+	// from the ones this hasher currently uses.
+	NeedsRehash(encoded string) bool
+}
+
+var ErrUnknownHash = errors.New("unrecognised password hash format")
+
+var b64 = base64.RawStdEncoding
+
+// Argon2idHasher produces $argon2id$v=19$m=<KiB>,t=<iterations>,p=<threads>$<salt>$<key>.
+type Argon2idHasher struct {
+	Memory  uint32
+	Time    uint32
+	Threads uint8
+	KeyLen  uint32
+}
+
+func (h Argon2idHasher) Name() string { return "argon2id" }
+
+func (h Argon2idHasher) Hash(pass []byte) (string, error) {
+	salt, err := randomBytes(16)
+	if err != nil {
+		return "", err
+	}
+	key := argon2.IDKey(pass, salt, h.Time, h.Memory, h.Threads, h.KeyLen)
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2.Version, h.Memory, h.Time, h.Threads, b64.EncodeToString(salt), b64.EncodeToString(key)), nil
+}
+
+func (h Argon2idHasher) parse(encoded string) (Argon2idHasher, []byte, []byte, error) {
+	var params Argon2idHasher
+	var version int
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 6 || parts[1] != h.Name() {
+		return params, nil, nil, ErrUnknownHash
+	}
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return params, nil, nil, ErrUnknownHash
+	}
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &params.Memory, &params.Time, &params.Threads); err != nil {
+		return params, nil, nil, ErrUnknownHash
+	}
+	salt, err := b64.DecodeString(parts[4])
+	if err != nil {
+		return params, nil, nil, ErrUnknownHash
+	}
+	key, err := b64.DecodeString(parts[5])
+	if err != nil {
+		return params, nil, nil, ErrUnknownHash
+	}
+	params.KeyLen = uint32(len(key))
+	return params, salt, key, nil
+}
+
+func (h Argon2idHasher) Verify(pass []byte, encoded string) (bool, error) {
+	params, salt, key, err := h.parse(encoded)
+	if err != nil {
+		return false, err
+	}
+	other := argon2.IDKey(pass, salt, params.Time, params.Memory, params.Threads, params.KeyLen)
+	return subtle.ConstantTimeCompare(key, other) == 1, nil
+}
+
+func (h Argon2idHasher) NeedsRehash(encoded string) bool {
+	params, _, _, err := h.parse(encoded)
+	return err != nil || params != h
+}
+
+// ScryptHasher produces $scrypt$ln=<log2 N>,r=<r>,p=<p>$<salt>$<key>.
+type ScryptHasher struct {
+	LogN   uint8
+	R      int
+	P      int
+	KeyLen int
+}
+
+func (h ScryptHasher) Name() string { return "scrypt" }
+
+func (h ScryptHasher) Hash(pass []byte) (string, error) {
+	salt, err := randomBytes(16)
+	if err != nil {
+		return "", err
+	}
+	key, err := scrypt.Key(pass, salt, 1<<h.LogN, h.R, h.P, h.KeyLen)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("$scrypt$ln=%d,r=%d,p=%d$%s$%s", h.LogN, h.R, h.P, b64.EncodeToString(salt), b64.EncodeToString(key)), nil
+}
+
+func (h ScryptHasher) parse(encoded string) (ScryptHasher, []byte, []byte, error) {
+	var params ScryptHasher
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 5 || parts[1] != h.Name() {
+		return params, nil, nil, ErrUnknownHash
+	}
+	if _, err := fmt.Sscanf(parts[2], "ln=%d,r=%d,p=%d", &params.LogN, &params.R, &params.P); err != nil {
+		return params, nil, nil, ErrUnknownHash
+	}
+	salt, err := b64.DecodeString(parts[3])
+	if err != nil {
+		return params, nil, nil, ErrUnknownHash
+	}
+	key, err := b64.DecodeString(parts[4])
+	if err != nil {
+		return params, nil, nil, ErrUnknownHash
+	}
+	params.KeyLen = len(key)
+	return params, salt, key, nil
+}
+
+func (h ScryptHasher) Verify(pass []byte, encoded string) (bool, error) {
+	params, salt, key, err := h.parse(encoded)
+	if err != nil {
+		return false, err
+	}
+	other, err := scrypt.Key(pass, salt, 1<<params.LogN, params.R, params.P, params.KeyLen)
+	if err != nil {
+		return false, err
+	}
+	return subtle.ConstantTimeCompare(key, other) == 1, nil
+}
+
+func (h ScryptHasher) NeedsRehash(encoded string) bool {
+	params, _, _, err := h.parse(encoded)
+	return err != nil || params != h
+}
+
+// BcryptHasher produces the standard modular crypt format $2a$<cost>$....
+type BcryptHasher struct {
+	Cost int
+}
+
+func (h BcryptHasher) Name() string { return "bcrypt" }
+
+func (h BcryptHasher) Hash(pass []byte) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword(pass, h.Cost)
+	return string(hash), err
+}
+
+func (h BcryptHasher) Verify(pass []byte, encoded string) (bool, error) {
+	err := bcrypt.CompareHashAndPassword([]byte(encoded), pass)
+	if errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (h BcryptHasher) NeedsRehash(encoded string) bool {
+	cost, err := bcrypt.Cost([]byte(encoded))
+	return err != nil || cost != h.Cost
+}
+
+// legacyHasher verifies hashes written by goSecretBoxPassword before hashing
+// became pluggable. It never produces new hashes and always asks for a rehash.
+// The pepper is its secretbox master passphrase rather than an HMAC key.
+type legacyHasher struct {
+	Secret string
+}
+
+func (legacyHasher) Name() string { return "secBoxv1" }
+
+func (legacyHasher) Hash(pass []byte) (string, error) {
+	return "", errors.New("secBoxv1 hashes can no longer be created")
+}
+
+func (h legacyHasher) Verify(pass []byte, encoded string) (bool, error) {
+	err := password.Verify(string(pass), h.Secret, encoded)
+	if errors.Is(err, password.ErrPassphraseHashMismatch) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (legacyHasher) NeedsRehash(encoded string) bool { return true }
+
+var (
+	passwordHasher     PasswordHasher
+	passwordHasherOnce sync.Once
+)
+
+// GetPasswordHasher returns the hasher new passwords are hashed with, chosen by
+// PASSWORD_HASHER (argon2id, scrypt or bcrypt) and its *_ cost variables.
+func GetPasswordHasher() PasswordHasher {
+	passwordHasherOnce.Do(func() {
+		err := godotenv.Load()
+		if err != nil {
+			log.Fatal("Error loading Env File")
+		}
+		switch os.Getenv("PASSWORD_HASHER") {
+		case "scrypt":
+			n := envInt("SCRYPT_N", 32768)
+			passwordHasher = ScryptHasher{LogN: uint8(bits.Len(uint(n)) - 1), R: envInt("SCRYPT_R", 8), P: envInt("SCRYPT_P", 1), KeyLen: 32}
+		case "bcrypt":
+			passwordHasher = BcryptHasher{Cost: envInt("BCRYPT_COST", 12)}
+		case "", "argon2id":
+			passwordHasher = Argon2idHasher{
+				Memory:  uint32(envInt("ARGON2_MEMORY_KIB", 64*1024)),
+				Time:    uint32(envInt("ARGON2_ITERATIONS", 3)),
+				Threads: uint8(envInt("ARGON2_PARALLELISM", 2)),
+				KeyLen:  32,
+			}
+		default:
+			log.Fatal("Unknown PASSWORD_HASHER ", os.Getenv("PASSWORD_HASHER"))
+		}
+	})
+	return passwordHasher
+}
+
+// hasherFor picks the hasher that understands encoded from its prefix.
+func hasherFor(encoded string) (PasswordHasher, error) {
+	current := GetPasswordHasher()
+	var hasher PasswordHasher
+	switch {
+	case strings.HasPrefix(encoded, "secBoxv1$"):
+		return legacyHasher{}, nil
+	case strings.HasPrefix(encoded, "$2a$"), strings.HasPrefix(encoded, "$2b$"), strings.HasPrefix(encoded, "$2y$"):
+		hasher = BcryptHasher{}
+	case strings.HasPrefix(encoded, "$argon2id$"):
+		hasher = Argon2idHasher{}
+	case strings.HasPrefix(encoded, "$scrypt$"):
+		hasher = ScryptHasher{}
+	default:
+		return nil, ErrUnknownHash
+	}
+	if hasher.Name() == current.Name() {
+		return current, nil
+	}
+	return hasher, nil
+}
+
+// pepper mixes a deployment secret into the password before it is hashed,
+// so a leaked database alone is not enough to brute force hashes.
+func pepper(pass, secret string) []byte {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(pass))
+	return []byte(b64.EncodeToString(mac.Sum(nil)))
+}
+
+// GenerateHash hashes pass with the configured hasher and the newest pepper,
+// recording the pepper version in front of the hash.
+func GenerateHash(pass string) (string, error) {
+	version, secret := CurrentPepper()
+	hash, err := GetPasswordHasher().Hash(pepper(pass, secret))
+	if err != nil {
+		return "", err
+	}
+	return pepperPrefix(version) + hash, nil
+}
+
+func ValidateHash(hash, pass string) bool {
+	version, inner := SplitPepperVersion(hash)
+	secret, ok := PepperSecret(version)
+	if !ok {
+		log.Println("Hash verify fail. pepper version", version, "is not configured")
+		return false
+	}
+	hasher, err := hasherFor(inner)
+	if err != nil {
+		log.Println("Hash verify fail. ", err)
+		return false
+	}
+	input := pepper(pass, secret)
+	if _, legacy := hasher.(legacyHasher); legacy {
+		hasher, input = legacyHasher{Secret: secret}, []byte(pass)
+	}
+	ok, err = hasher.Verify(input, inner)
+	if err != nil {
+		log.Println("Hash verify fail. ", err)
+		return false
+	}
+	return ok
+}
+
+// NeedsRehash reports whether hash should be replaced after a successful login
+// because it uses an outdated algorithm, parameters or pepper.
+func NeedsRehash(hash string) bool {
+	version, inner := SplitPepperVersion(hash)
+	if current, _ := CurrentPepper(); version != current {
+		return true
+	}
+	hasher, err := hasherFor(inner)
+	if err != nil {
+		return true
+	}
+	return hasher.Name() != GetPasswordHasher().Name() || hasher.NeedsRehash(inner)
+}
+
+func randomBytes(n int) ([]byte, error) {
+	b := make([]byte, n)
+	_, err := rand.Read(b)
+	return b, err
+}
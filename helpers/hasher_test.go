@@ -0,0 +1,142 @@
+package helpers
+
+import (
+	"strings"
+	"testing"
+
+	password "github.com/dwin/goSecretBoxPassword"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// cheap hasher parameters keep the tests fast
+var testHashers = []PasswordHasher{
+	Argon2idHasher{Memory: 64, Time: 1, Threads: 1, KeyLen: 16},
+	ScryptHasher{LogN: 4, R: 8, P: 1, KeyLen: 16},
+	BcryptHasher{Cost: bcrypt.MinCost},
+}
+
+// usePasswordConfig replaces the configured hasher and peppers for the
+// duration of a test.
+func usePasswordConfig(t *testing.T, hasher PasswordHasher, secrets map[int]string) {
+	t.Helper()
+	passwordHasherOnce.Do(func() {})
+	peppersOnce.Do(func() {})
+	previousHasher, previousPeppers := passwordHasher, peppers
+	passwordHasher, peppers = hasher, secrets
+	t.Cleanup(func() { passwordHasher, peppers = previousHasher, previousPeppers })
+}
+
+func TestHasherRoundTrip(t *testing.T) {
+	for _, hasher := range testHashers {
+		t.Run(hasher.Name(), func(t *testing.T) {
+			hash, err := hasher.Hash([]byte("correct horse"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			other, err := hasher.Hash([]byte("correct horse"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if hash == other {
+				t.Error("two hashes of the same password are equal, the salt is missing")
+			}
+			if ok, err := hasher.Verify([]byte("correct horse"), hash); !ok || err != nil {
+				t.Errorf("Verify(right password) = %v, %v, want true", ok, err)
+			}
+			if ok, err := hasher.Verify([]byte("wrong horse"), hash); ok || err != nil {
+				t.Errorf("Verify(wrong password) = %v, %v, want false", ok, err)
+			}
+			if hasher.NeedsRehash(hash) {
+				t.Error("NeedsRehash of a fresh hash = true")
+			}
+		})
+	}
+}
+
+func TestHasherNeedsRehashOnParameterChange(t *testing.T) {
+	tests := []struct {
+		old, current PasswordHasher
+	}{
+		{Argon2idHasher{Memory: 64, Time: 1, Threads: 1, KeyLen: 16}, Argon2idHasher{Memory: 64, Time: 2, Threads: 1, KeyLen: 16}},
+		{ScryptHasher{LogN: 4, R: 8, P: 1, KeyLen: 16}, ScryptHasher{LogN: 5, R: 8, P: 1, KeyLen: 16}},
+		{BcryptHasher{Cost: bcrypt.MinCost}, BcryptHasher{Cost: bcrypt.MinCost + 1}},
+	}
+	for _, test := range tests {
+		hash, err := test.old.Hash([]byte("correct horse"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !test.current.NeedsRehash(hash) {
+			t.Errorf("%s: NeedsRehash after a parameter change = false", test.current.Name())
+		}
+		// the old parameters are read from the hash, so it still verifies
+		if ok, err := test.current.Verify([]byte("correct horse"), hash); !ok || err != nil {
+			t.Errorf("%s: Verify with changed parameters = %v, %v, want true", test.current.Name(), ok, err)
+		}
+	}
+}
+
+func TestHasherRejectsOtherFormats(t *testing.T) {
+	for _, hasher := range testHashers[:2] {
+		if _, err := hasher.Verify([]byte("x"), "$2a$04$notthisformat"); err != ErrUnknownHash {
+			t.Errorf("%s: Verify of a foreign hash = %v, want ErrUnknownHash", hasher.Name(), err)
+		}
+	}
+}
+
+func TestGenerateAndValidateHash(t *testing.T) {
+	for _, hasher := range testHashers {
+		t.Run(hasher.Name(), func(t *testing.T) {
+			usePasswordConfig(t, hasher, map[int]string{0: "pepper-0"})
+			hash, err := GenerateHash("correct horse")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !strings.HasPrefix(hash, "$pv=0$") {
+				t.Errorf("hash %q lacks the pepper version", hash)
+			}
+			if !ValidateHash(hash, "correct horse") {
+				t.Error("ValidateHash(right password) = false")
+			}
+			if ValidateHash(hash, "wrong horse") {
+				t.Error("ValidateHash(wrong password) = true")
+			}
+			if NeedsRehash(hash) {
+				t.Error("NeedsRehash of a fresh hash = true")
+			}
+		})
+	}
+}
+
+func TestNeedsRehashOnAlgorithmChange(t *testing.T) {
+	usePasswordConfig(t, testHashers[2], map[int]string{0: "pepper-0"})
+	hash, err := GenerateHash("correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	usePasswordConfig(t, testHashers[0], map[int]string{0: "pepper-0"})
+	if !NeedsRehash(hash) {
+		t.Error("NeedsRehash of a bcrypt hash with argon2id configured = false")
+	}
+	if !ValidateHash(hash, "correct horse") {
+		t.Error("ValidateHash of a bcrypt hash with argon2id configured = false")
+	}
+}
+
+func TestValidateLegacyHash(t *testing.T) {
+	usePasswordConfig(t, testHashers[0], map[int]string{0: "legacy-master-secret"})
+	params := password.ScryptParams{N: 4096, R: 8, P: 1}
+	hash, err := password.Hash("correct horse", "legacy-master-secret", 0, params, params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ValidateHash(hash, "correct horse") {
+		t.Error("ValidateHash(right password) of a legacy hash = false")
+	}
+	if ValidateHash(hash, "wrong horse") {
+		t.Error("ValidateHash(wrong password) of a legacy hash = true")
+	}
+	if !NeedsRehash(hash) {
+		t.Error("NeedsRehash of a legacy hash = false")
+	}
+}
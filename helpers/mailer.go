@@ -0,0 +1,125 @@
+package helpers
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"mime"
+	"mime/quotedprintable"
+	"net/mail"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/joho/godotenv"
+)
+
+// Email is a single outgoing message. Either Text or HTML may be empty, but not
+// both.
+type Email struct {
+	From    mail.Address
+	To      mail.Address
+	Subject string
+	Text    string
+	HTML    string
+}
+
+// Bytes renders the email as an RFC 5322 message with a multipart/alternative
+// body, as written to SMTP servers and mail files.
+func (e Email) Bytes() []byte {
+	var buf bytes.Buffer
+	boundary := randomBoundary()
+	fmt.Fprintf(&buf, "From: %s\r\n", e.From.String())
+	fmt.Fprintf(&buf, "To: %s\r\n", e.To.String())
+	fmt.Fprintf(&buf, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", e.Subject))
+	fmt.Fprintf(&buf, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	buf.WriteString("MIME-Version: 1.0\r\n")
+	fmt.Fprintf(&buf, "Content-Type: multipart/alternative; boundary=%q\r\n\r\n", boundary)
+	for _, part := range []struct{ contentType, body string }{{"text/plain", e.Text}, {"text/html", e.HTML}} {
+		if part.body == "" {
+			continue
+		}
+		fmt.Fprintf(&buf, "--%s\r\n", boundary)
+		fmt.Fprintf(&buf, "Content-Type: %s; charset=utf-8\r\n", part.contentType)
+		buf.WriteString("Content-Transfer-Encoding: quoted-printable\r\n\r\n")
+		qp := quotedprintable.NewWriter(&buf)
+		qp.Write([]byte(part.body))
+		qp.Close()
+		buf.WriteString("\r\n")
+	}
+	fmt.Fprintf(&buf, "--%s--\r\n", boundary)
+	return buf.Bytes()
+}
+
+func randomBoundary() string {
+	b, err := randomBytes(12)
+	if err != nil {
+		return "mux-mongo-api-boundary"
+	}
+	return hex.EncodeToString(b)
+}
+
+// Mailer delivers emails through one backend.
+type Mailer interface {
+	Send(ctx context.Context, email Email) error
+}
+
+var (
+	mailer     Mailer
+	mailerOnce sync.Once
+)
+
+// GetMailer returns the backend chosen by MAILER: sendgrid (default), smtp,
+// file or memory.
+func GetMailer() Mailer {
+	mailerOnce.Do(func() {
+		err := godotenv.Load()
+		if err != nil {
+			log.Fatal("Error loading Env File")
+		}
+		switch os.Getenv("MAILER") {
+		case "", "sendgrid":
+			mailer = &SendGridMailer{APIKey: GetCreds()}
+		case "smtp":
+			mailer = &SMTPMailer{
+				Host:     os.Getenv("SMTP_HOST"),
+				Port:     envInt("SMTP_PORT", 25),
+				Username: os.Getenv("SMTP_USERNAME"),
+				Password: os.Getenv("SMTP_PASSWORD"),
+			}
+		case "file":
+			mailer = &FileMailer{Dir: os.Getenv("MAIL_DIR")}
+		case "memory":
+			mailer = &MemoryMailer{}
+		default:
+			log.Fatal("Unknown MAILER ", os.Getenv("MAILER"))
+		}
+	})
+	return mailer
+}
+
+// SetMailer replaces the configured backend, e.g. with a MemoryMailer.
+func SetMailer(m Mailer) {
+	mailerOnce.Do(func() {})
+	mailer = m
+}
+
+// MailFrom is the sender used for every outgoing email, configured with
+// MAIL_FROM_NAME and MAIL_FROM_ADDRESS.
+func MailFrom() mail.Address {
+	err := godotenv.Load()
+	if err != nil {
+		log.Fatal("Error loading Env File")
+	}
+	address := os.Getenv("MAIL_FROM_ADDRESS")
+	if address == "" {
+		address = "nk@diycam.co.in"
+	}
+	name := os.Getenv("MAIL_FROM_NAME")
+	if name == "" {
+		name = "goapptest"
+	}
+	return mail.Address{Name: name, Address: address}
+}
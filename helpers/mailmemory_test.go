@@ -0,0 +1,69 @@
+package helpers
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+)
+
+func TestMemoryMailer(t *testing.T) {
+	m := &MemoryMailer{}
+	first, second := testEmail(), testEmail()
+	second.Subject = "Goodbye"
+	for _, email := range []Email{first, second} {
+		if err := m.Send(context.Background(), email); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	sent := m.Sent()
+	if len(sent) != 2 || sent[0].Subject != "Welcome" || sent[1].Subject != "Goodbye" {
+		t.Fatalf("Sent() = %+v, want both emails in order", sent)
+	}
+	// the returned slice is a copy
+	sent[0].Subject = "changed"
+	if m.Sent()[0].Subject != "Welcome" {
+		t.Error("changing the result of Sent() changed the captured email")
+	}
+
+	m.Reset()
+	if sent := m.Sent(); len(sent) != 0 {
+		t.Errorf("Sent() after Reset() = %+v, want none", sent)
+	}
+}
+
+func TestMemoryMailerConcurrentSends(t *testing.T) {
+	m := &MemoryMailer{}
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			email := testEmail()
+			email.Subject = fmt.Sprint(i)
+			m.Send(context.Background(), email)
+		}(i)
+	}
+	wg.Wait()
+	if sent := m.Sent(); len(sent) != 20 {
+		t.Errorf("captured %d emails, want 20", len(sent))
+	}
+}
+
+func TestSetMailer(t *testing.T) {
+	previous := mailer
+	t.Cleanup(func() { mailer = previous })
+
+	m := &MemoryMailer{}
+	SetMailer(m)
+	if GetMailer() != Mailer(m) {
+		t.Fatal("GetMailer() does not return the mailer given to SetMailer")
+	}
+	if err := GetMailer().Send(context.Background(), testEmail()); err != nil {
+		t.Fatal(err)
+	}
+	if sent := m.Sent(); len(sent) != 1 || sent[0].To.Address != "jane@example.com" {
+		t.Errorf("Sent() = %+v, want the email to jane@example.com", sent)
+	}
+}
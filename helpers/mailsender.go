@@ -1,12 +1,14 @@
 package helpers
 
 import (
+	"context"
+	"fmt"
 	"log"
 	"os"
 
 	"github.com/joho/godotenv"
 	"github.com/sendgrid/sendgrid-go"
-	"github.com/sendgrid/sendgrid-go/helpers/mail"
+	sgmail "github.com/sendgrid/sendgrid-go/helpers/mail"
 )
 
 func GetCreds() string {
@@ -17,26 +19,22 @@ func GetCreds() string {
 	return os.Getenv("EMAILKEY")
 }
 
-func CheckEmail(usermail, username string) bool {
-	log.Println(usermail, username)
-	from := mail.NewEmail("goapptest", "nk@diycam.co.in")
-	subject := "User Checking User Email"
-	to := mail.NewEmail(username, usermail)
-	plainTextContent := "and easy to do anywhere, even with Go"
-	htmlContent := "<strong>You can now use your account</strong>"
-	message := mail.NewSingleEmail(from, subject, to, plainTextContent, htmlContent)
-	client := sendgrid.NewSendClient(GetCreds())
-	response, err := client.Send(message)
+// SendGridMailer delivers emails through the SendGrid v3 API.
+type SendGridMailer struct {
+	APIKey string
+}
+
+func (m *SendGridMailer) Send(ctx context.Context, email Email) error {
+	from := sgmail.NewEmail(email.From.Name, email.From.Address)
+	to := sgmail.NewEmail(email.To.Name, email.To.Address)
+	message := sgmail.NewSingleEmail(from, email.Subject, to, email.Text, email.HTML)
+	client := sendgrid.NewSendClient(m.APIKey)
+	response, err := client.SendWithContext(ctx, message)
 	if err != nil {
-		log.Println(err)
-		return false
-	} else {
-		log.Println(response.StatusCode)
-		log.Println(response.Body)
-		log.Println(response.Headers)
-		if response.StatusCode == 202 {
-			return true
-		}
-		return false
+		return err
+	}
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return fmt.Errorf("sendgrid responded %d: %s", response.StatusCode, response.Body)
 	}
+	return nil
 }
@@ -0,0 +1,164 @@
+package helpers
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"net"
+	"net/mail"
+	"net/textproto"
+	"strings"
+	"testing"
+	"time"
+)
+
+// smtpMessage is what the fake server received in one transaction.
+type smtpMessage struct {
+	from, to string
+	data     string
+}
+
+// fakeSMTPServer accepts one connection on a local port and speaks just enough
+// SMTP for net/smtp to deliver a message, without STARTTLS or AUTH.
+func fakeSMTPServer(t *testing.T) (host string, port int, received <-chan smtpMessage) {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	messages := make(chan smtpMessage, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		text := textproto.NewConn(conn)
+		var message smtpMessage
+		text.PrintfLine("220 localhost ready")
+		for {
+			line, err := text.ReadLine()
+			if err != nil {
+				return
+			}
+			verb, arg, _ := strings.Cut(line, " ")
+			switch strings.ToUpper(verb) {
+			case "EHLO", "HELO":
+				text.PrintfLine("250 localhost")
+			case "MAIL":
+				message.from = strings.TrimPrefix(arg, "FROM:")
+				text.PrintfLine("250 OK")
+			case "RCPT":
+				message.to = strings.TrimPrefix(arg, "TO:")
+				text.PrintfLine("250 OK")
+			case "DATA":
+				text.PrintfLine("354 end with <CRLF>.<CRLF>")
+				data, err := text.ReadDotBytes()
+				if err != nil {
+					return
+				}
+				message.data = string(data)
+				text.PrintfLine("250 OK")
+				messages <- message
+			case "QUIT":
+				text.PrintfLine("221 bye")
+				return
+			default:
+				text.PrintfLine("502 not implemented")
+			}
+		}
+	}()
+	addr := listener.Addr().(*net.TCPAddr)
+	return addr.IP.String(), addr.Port, messages
+}
+
+func testEmail() Email {
+	return Email{
+		From:    mail.Address{Name: "Sender", Address: "sender@example.com"},
+		To:      mail.Address{Name: "Jane", Address: "jane@example.com"},
+		Subject: "Welcome",
+		Text:    "Hello Jane",
+		HTML:    "<p>Hello Jane</p>",
+	}
+}
+
+func TestSMTPMailerSend(t *testing.T) {
+	host, port, received := fakeSMTPServer(t)
+	m := &SMTPMailer{Host: host, Port: port}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := m.Send(ctx, testEmail()); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case message := <-received:
+		if message.from != "<sender@example.com>" || message.to != "<jane@example.com>" {
+			t.Errorf("envelope from %s to %s, want <sender@example.com> to <jane@example.com>", message.from, message.to)
+		}
+		parsed, err := mail.ReadMessage(bufio.NewReader(strings.NewReader(message.data)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if subject := parsed.Header.Get("Subject"); subject != "Welcome" {
+			t.Errorf("Subject = %q, want %q", subject, "Welcome")
+		}
+		if to := parsed.Header.Get("To"); to != `"Jane" <jane@example.com>` {
+			t.Errorf("To = %q", to)
+		}
+		for _, part := range []string{"text/plain", "text/html", "Hello Jane", "<p>Hello Jane</p>"} {
+			if !strings.Contains(message.data, part) {
+				t.Errorf("message lacks %q", part)
+			}
+		}
+	case <-ctx.Done():
+		t.Fatal("the server received no message")
+	}
+}
+
+func TestSMTPMailerSendHonoursContext(t *testing.T) {
+	// a server that accepts the connection but never greets
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		if conn, err := listener.Accept(); err == nil {
+			accepted <- conn
+		}
+	}()
+	t.Cleanup(func() {
+		listener.Close()
+		select {
+		case conn := <-accepted:
+			conn.Close()
+		default:
+		}
+	})
+	addr := listener.Addr().(*net.TCPAddr)
+	m := &SMTPMailer{Host: addr.IP.String(), Port: addr.Port}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := m.Send(ctx, testEmail()); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Send to a silent server = %v, want %v", err, context.DeadlineExceeded)
+	}
+}
+
+func TestSMTPMailerSendRefused(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := listener.Addr().(*net.TCPAddr)
+	listener.Close()
+
+	m := &SMTPMailer{Host: addr.IP.String(), Port: addr.Port}
+	if err := m.Send(context.Background(), testEmail()); err == nil {
+		t.Error("Send to a closed port = nil, want an error")
+	}
+}
@@ -0,0 +1,45 @@
+package helpers
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+// ErrSuppressed is returned instead of sending to an address that bounced or
+// reported spam. Retrying will not help.
+var ErrSuppressed = errors.New("recipient address is suppressed")
+
+// SuppressionList tells the mail helpers which addresses must not be emailed.
+type SuppressionList interface {
+	IsSuppressed(ctx context.Context, address string) (bool, error)
+}
+
+var (
+	suppressionList   SuppressionList
+	suppressionListMu sync.RWMutex
+)
+
+// SetSuppressionList installs the list consulted before every templated email.
+func SetSuppressionList(list SuppressionList) {
+	suppressionListMu.Lock()
+	suppressionList = list
+	suppressionListMu.Unlock()
+}
+
+func checkSuppressed(ctx context.Context, address string) error {
+	suppressionListMu.RLock()
+	list := suppressionList
+	suppressionListMu.RUnlock()
+	if list == nil {
+		return nil
+	}
+	suppressed, err := list.IsSuppressed(ctx, address)
+	if err != nil {
+		return err
+	}
+	if suppressed {
+		return ErrSuppressed
+	}
+	return nil
+}
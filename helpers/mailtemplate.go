@@ -0,0 +1,252 @@
+package helpers
+
+import (
+	"bytes"
+	"context"
+	"embed"
+	"errors"
+	htmltemplate "html/template"
+	"io/fs"
+	"log"
+	"net/mail"
+	neturl "net/url"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	texttemplate "text/template"
+
+	"github.com/joho/godotenv"
+)
+
+// Kinds of transactional email. Each kind has one template file per locale
+// defining the "subject", "text" and "html" blocks.
+const (
+	MailVerification  = "verification"
+	MailPasswordReset = "password_reset"
+	MailWelcome       = "welcome"
+	MailAdminInvite   = "admin_invite"
+	MailSecurityAlert = "security_alert"
+	// MailEmailChange asks to confirm a new address, MailEmailChangeNotice
+	// tells the old address about the change and how to undo it.
+	MailEmailChange       = "email_change"
+	MailEmailChangeNotice = "email_change_notice"
+)
+
+var MailKinds = []string{MailVerification, MailPasswordReset, MailWelcome, MailAdminInvite, MailSecurityAlert, MailEmailChange, MailEmailChangeNotice}
+
+const defaultMailLocale = "en"
+
+//go:embed mailtemplates
+var embeddedMailTemplates embed.FS
+
+var ErrUnknownMailTemplate = errors.New("unknown email template")
+
+// MailData is the data a template is rendered with.
+type MailData map[string]interface{}
+
+type mailTemplate struct {
+	text *texttemplate.Template
+	html *htmltemplate.Template
+}
+
+// mailTemplates maps "<locale>/<kind>" to a parsed template.
+type mailTemplates map[string]mailTemplate
+
+var (
+	loadedMailTemplates mailTemplates
+	mailTemplatesMu     sync.RWMutex
+)
+
+// LoadMailTemplates parses the built in templates and then the files in dir,
+// laid out as <locale>/<kind>.tmpl, which replace or add to them. An empty dir
+// only loads the built in templates.
+func LoadMailTemplates(dir string) error {
+	templates := mailTemplates{}
+	root, _ := fs.Sub(embeddedMailTemplates, "mailtemplates")
+	if err := templates.parseFS(root); err != nil {
+		return err
+	}
+	if dir != "" {
+		if err := templates.parseFS(os.DirFS(dir)); err != nil {
+			return err
+		}
+	}
+	mailTemplatesMu.Lock()
+	loadedMailTemplates = templates
+	mailTemplatesMu.Unlock()
+	return nil
+}
+
+func (t mailTemplates) parseFS(fsys fs.FS) error {
+	files, err := fs.Glob(fsys, "*/*.tmpl")
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		source, err := fs.ReadFile(fsys, file)
+		if err != nil {
+			return err
+		}
+		text, err := texttemplate.New(file).Parse(string(source))
+		if err != nil {
+			return err
+		}
+		html, err := htmltemplate.New(file).Parse(string(source))
+		if err != nil {
+			return err
+		}
+		t[strings.TrimSuffix(file, ".tmpl")] = mailTemplate{text: text, html: html}
+	}
+	return nil
+}
+
+func getMailTemplates() mailTemplates {
+	mailTemplatesMu.RLock()
+	templates := loadedMailTemplates
+	mailTemplatesMu.RUnlock()
+	if templates != nil {
+		return templates
+	}
+	err := godotenv.Load()
+	if err != nil {
+		log.Fatal("Error loading Env File")
+	}
+	if err := LoadMailTemplates(os.Getenv("MAIL_TEMPLATE_DIR")); err != nil {
+		log.Fatal("Error loading email templates: ", err)
+	}
+	return getMailTemplates()
+}
+
+// MailLocales lists the locales that have a template for kind.
+func MailLocales(kind string) []string {
+	var locales []string
+	for key := range getMailTemplates() {
+		if locale, k := path.Split(key); k == kind {
+			locales = append(locales, strings.TrimSuffix(locale, "/"))
+		}
+	}
+	sort.Strings(locales)
+	return locales
+}
+
+// lookup finds the template for kind in the most specific matching locale,
+// falling back from "pt-BR" to "pt" and then to English.
+func (t mailTemplates) lookup(kind, locale string) (mailTemplate, string, bool) {
+	candidates := []string{locale}
+	if base, _, found := strings.Cut(locale, "-"); found {
+		candidates = append(candidates, base)
+	}
+	candidates = append(candidates, defaultMailLocale)
+	for _, candidate := range candidates {
+		if tmpl, ok := t[candidate+"/"+kind]; ok {
+			return tmpl, candidate, true
+		}
+	}
+	return mailTemplate{}, "", false
+}
+
+// RenderEmail renders the subject, text and HTML body of kind in the user's
+// preferred locale.
+func RenderEmail(kind, locale string, data MailData) (Email, error) {
+	tmpl, _, ok := getMailTemplates().lookup(kind, locale)
+	if !ok {
+		return Email{}, ErrUnknownMailTemplate
+	}
+	values := MailData{"AppName": AppName()}
+	for key, value := range data {
+		values[key] = value
+	}
+
+	var subject, text, html bytes.Buffer
+	if err := tmpl.text.ExecuteTemplate(&subject, "subject", values); err != nil {
+		return Email{}, err
+	}
+	if err := tmpl.text.ExecuteTemplate(&text, "text", values); err != nil {
+		return Email{}, err
+	}
+	if err := tmpl.html.ExecuteTemplate(&html, "html", values); err != nil {
+		return Email{}, err
+	}
+	return Email{
+		Subject: strings.TrimSpace(subject.String()),
+		Text:    strings.TrimSpace(text.String()),
+		HTML:    strings.TrimSpace(html.String()),
+	}, nil
+}
+
+// SendTemplatedEmail renders kind for the recipient's locale and sends it.
+func SendTemplatedEmail(ctx context.Context, to mail.Address, locale, kind string, data MailData) error {
+	values := MailData{"Name": to.Name, "Email": to.Address}
+	for key, value := range data {
+		values[key] = value
+	}
+	email, err := RenderEmail(kind, locale, values)
+	if err != nil {
+		return err
+	}
+	if err := checkSuppressed(ctx, to.Address); err != nil {
+		return err
+	}
+	email.From = MailFrom()
+	email.To = to
+	return GetMailer().Send(ctx, email)
+}
+
+// SampleMailData is used to preview a template without a real user.
+func SampleMailData(kind string) MailData {
+	data := MailData{"Name": "Jane Doe", "Email": "jane.doe@example.com"}
+	switch kind {
+	case MailVerification, MailPasswordReset:
+		data["Link"] = "https://example.com/" + kind + "?token=sample"
+	case MailAdminInvite:
+		data["Link"] = "https://example.com/invitations/accept?token=sample"
+		data["InvitedBy"] = "John Admin"
+		data["Role"] = "admin"
+		data["Company"] = "Example Ltd"
+		data["ExpiresAt"] = "2030-01-01 00:00 UTC"
+	case MailEmailChange:
+		data["Link"] = "https://example.com/email/confirm?token=sample"
+		data["ExpiresAt"] = "2030-01-01 00:00 UTC"
+	case MailEmailChangeNotice:
+		data["Link"] = "https://example.com/email/recover?token=sample"
+		data["NewEmail"] = "jane@example.org"
+		data["ExpiresAt"] = "2030-01-08 00:00 UTC"
+	case MailSecurityAlert:
+		data["Event"] = "new sign in"
+		data["Device"] = "Firefox on Linux"
+		data["IP"] = "203.0.113.7"
+	}
+	return data
+}
+
+// AppURL is the base URL of the web app that links in emails point to,
+// configured with APP_URL.
+func AppURL() string {
+	err := godotenv.Load()
+	if err != nil {
+		log.Fatal("Error loading Env File")
+	}
+	if url := os.Getenv("APP_URL"); url != "" {
+		return strings.TrimRight(url, "/")
+	}
+	return "http://localhost:3000"
+}
+
+// AppLink builds a link into the web app carrying a token.
+func AppLink(path, token string) string {
+	return AppURL() + path + "?token=" + neturl.QueryEscape(token)
+}
+
+// AppName is the product name shown in emails, configured with APP_NAME.
+func AppName() string {
+	err := godotenv.Load()
+	if err != nil {
+		log.Fatal("Error loading Env File")
+	}
+	if name := os.Getenv("APP_NAME"); name != "" {
+		return name
+	}
+	return "goapptest"
+}
@@ -0,0 +1,213 @@
+package helpers
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/joho/godotenv"
+)
+
+// PasswordPolicy describes the rules a new password has to satisfy. Every
+// deployment configures it through the PASSWORD_* environment variables.
+type PasswordPolicy struct {
+	MinLength      int
+	MaxLength      int
+	RequireUpper   bool
+	RequireLower   bool
+	RequireDigit   bool
+	RequireSymbol  bool
+	BreachedCorpus string
+	BreachedMin    int
+}
+
+// PasswordViolation is a single rule a password failed.
+type PasswordViolation struct {
+	Rule    string
+	Message string
+}
+
+// PasswordPolicyError lists every rule a password failed, so clients can show
+// them all at once.
+type PasswordPolicyError struct {
+	Violations []PasswordViolation
+}
+
+func (e *PasswordPolicyError) Error() string {
+	messages := make([]string, 0, len(e.Violations))
+	for _, v := range e.Violations {
+		messages = append(messages, v.Message)
+	}
+	return "password rejected: " + strings.Join(messages, "; ")
+}
+
+var (
+	passwordPolicy     PasswordPolicy
+	passwordPolicyOnce sync.Once
+)
+
+// GetPasswordPolicy returns the policy configured for this deployment.
+func GetPasswordPolicy() PasswordPolicy {
+	passwordPolicyOnce.Do(func() {
+		err := godotenv.Load()
+		if err != nil {
+			log.Fatal("Error loading Env File")
+		}
+		passwordPolicy = PasswordPolicy{
+			MinLength:      envInt("PASSWORD_MIN_LENGTH", 8),
+			MaxLength:      envInt("PASSWORD_MAX_LENGTH", 128),
+			RequireUpper:   envBool("PASSWORD_REQUIRE_UPPER", true),
+			RequireLower:   envBool("PASSWORD_REQUIRE_LOWER", true),
+			RequireDigit:   envBool("PASSWORD_REQUIRE_DIGIT", true),
+			RequireSymbol:  envBool("PASSWORD_REQUIRE_SYMBOL", false),
+			BreachedCorpus: os.Getenv("PASSWORD_BREACHED_CORPUS"),
+			BreachedMin:    envInt("PASSWORD_BREACHED_MIN_COUNT", 1),
+		}
+	})
+	return passwordPolicy
+}
+
+// CheckPassword validates pass against the configured policy. The email and
+// name of the account are used to reject passwords equal to them.
+func CheckPassword(pass, email, name string) error {
+	return GetPasswordPolicy().Check(pass, email, name)
+}
+
+func (p PasswordPolicy) Check(pass, email, name string) error {
+	var violations []PasswordViolation
+	length := utf8.RuneCountInString(pass)
+	if length < p.MinLength {
+		violations = append(violations, PasswordViolation{"min", "password must be at least " + strconv.Itoa(p.MinLength) + " characters long"})
+	}
+	if p.MaxLength > 0 && length > p.MaxLength {
+		violations = append(violations, PasswordViolation{"max", "password must be at most " + strconv.Itoa(p.MaxLength) + " characters long"})
+	}
+
+	var upper, lower, digit, symbol bool
+	for _, c := range pass {
+		switch {
+		case unicode.IsUpper(c):
+			upper = true
+		case unicode.IsLower(c):
+			lower = true
+		case unicode.IsDigit(c):
+			digit = true
+		case unicode.IsPunct(c) || unicode.IsSymbol(c) || unicode.IsSpace(c):
+			symbol = true
+		}
+	}
+	if p.RequireUpper && !upper {
+		violations = append(violations, PasswordViolation{"upper", "password must contain an uppercase letter"})
+	}
+	if p.RequireLower && !lower {
+		violations = append(violations, PasswordViolation{"lower", "password must contain a lowercase letter"})
+	}
+	if p.RequireDigit && !digit {
+		violations = append(violations, PasswordViolation{"digit", "password must contain a digit"})
+	}
+	if p.RequireSymbol && !symbol {
+		violations = append(violations, PasswordViolation{"symbol", "password must contain a symbol"})
+	}
+
+	if equalsIdentity(pass, email) || equalsIdentity(pass, name) {
+		violations = append(violations, PasswordViolation{"identity", "password must not be the same as your email or name"})
+	}
+
+	if p.BreachedCorpus != "" {
+		breached, err := p.IsBreached(pass)
+		if err != nil {
+			// an unreadable corpus must not lock every user out of signing up
+			log.Println("breached password check failed:", err)
+		} else if breached {
+			violations = append(violations, PasswordViolation{"breached", "password has appeared in a data breach, choose another one"})
+		}
+	}
+
+	if len(violations) > 0 {
+		return &PasswordPolicyError{Violations: violations}
+	}
+	return nil
+}
+
+func equalsIdentity(pass, identity string) bool {
+	if identity == "" {
+		return false
+	}
+	if strings.EqualFold(pass, identity) {
+		return true
+	}
+	// also catch the local part of an email address
+	if at := strings.IndexByte(identity, '@'); at > 0 {
+		return strings.EqualFold(pass, identity[:at])
+	}
+	return false
+}
+
+// IsBreached reports whether pass is listed in the local breached password
+// corpus. The corpus is a directory in the Have I Been Pwned range format: one
+// file per 5 character SHA-1 prefix (optionally with a .txt extension), each
+// line holding the remaining 35 characters of a hash and a count separated by
+// a colon. Only the file for the password's prefix is read.
+func (p PasswordPolicy) IsBreached(pass string) (bool, error) {
+	sum := sha1.Sum([]byte(pass))
+	digest := strings.ToUpper(hex.EncodeToString(sum[:]))
+	prefix, suffix := digest[:5], digest[5:]
+
+	file, err := openRangeFile(p.BreachedCorpus, prefix)
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		hash, count, _ := strings.Cut(line, ":")
+		if !strings.EqualFold(hash, suffix) {
+			continue
+		}
+		n, err := strconv.Atoi(count)
+		if err != nil {
+			// lines without a count are treated as a single occurrence
+			n = 1
+		}
+		return n >= p.BreachedMin, nil
+	}
+	return false, scanner.Err()
+}
+
+func openRangeFile(dir, prefix string) (*os.File, error) {
+	file, err := os.Open(filepath.Join(dir, prefix))
+	if errors.Is(err, os.ErrNotExist) {
+		file, err = os.Open(filepath.Join(dir, prefix+".txt"))
+	}
+	return file, err
+}
+
+func envInt(key string, fallback int) int {
+	value, err := strconv.Atoi(os.Getenv(key))
+	if err != nil {
+		return fallback
+	}
+	return value
+}
+
+func envBool(key string, fallback bool) bool {
+	value, err := strconv.ParseBool(os.Getenv(key))
+	if err != nil {
+		return fallback
+	}
+	return value
+}
@@ -0,0 +1,111 @@
+package helpers
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestPasswordPolicyCheck(t *testing.T) {
+	policy := PasswordPolicy{MinLength: 8, MaxLength: 16, RequireUpper: true, RequireLower: true, RequireDigit: true, RequireSymbol: true}
+	tests := []struct {
+		name  string
+		pass  string
+		email string
+		rules []string
+	}{
+		{"valid", "Sup3r-secret", "jane@example.com", nil},
+		{"too short", "Ab1-", "", []string{"min"}},
+		{"too long", "Abcdefgh1-abcdefgh", "", []string{"max"}},
+		{"counts runes", "Äöü1-äöü", "", nil},
+		{"no upper", "sup3r-secret", "", []string{"upper"}},
+		{"no lower", "SUP3R-SECRET", "", []string{"lower"}},
+		{"no digit", "Super-secret", "", []string{"digit"}},
+		{"no symbol", "Sup3rsecret", "", []string{"symbol"}},
+		{"every rule", "", "", []string{"min", "upper", "lower", "digit", "symbol"}},
+		{"is the email", "Jo@Ex.io1", "jo@ex.io1", []string{"identity"}},
+		{"is the local part", "Jane-2024X", "jane-2024x@example.com", []string{"identity"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := policy.Check(test.pass, test.email, "")
+			if got := violatedRules(t, err); !reflect.DeepEqual(got, test.rules) {
+				t.Errorf("Check(%q) violated %v, want %v", test.pass, got, test.rules)
+			}
+		})
+	}
+}
+
+func TestPasswordPolicyBreachedCorpus(t *testing.T) {
+	dir := t.TempDir()
+	writeRange(t, dir, "Breached1!", 3, ".txt")
+	writeRange(t, dir, "Seen-once1", 1, "")
+	policy := PasswordPolicy{BreachedCorpus: dir, BreachedMin: 2}
+
+	tests := []struct {
+		pass     string
+		breached bool
+	}{
+		{"Breached1!", true},
+		{"Seen-once1", false},
+		{"Unlisted-1", false},
+	}
+	for _, test := range tests {
+		breached, err := policy.IsBreached(test.pass)
+		if err != nil {
+			t.Fatalf("IsBreached(%q): %v", test.pass, err)
+		}
+		if breached != test.breached {
+			t.Errorf("IsBreached(%q) = %v, want %v", test.pass, breached, test.breached)
+		}
+	}
+	if rules := violatedRules(t, policy.Check("Breached1!", "", "")); !reflect.DeepEqual(rules, []string{"breached"}) {
+		t.Errorf("Check of a breached password violated %v, want [breached]", rules)
+	}
+}
+
+func TestPasswordPolicyUnreadableCorpus(t *testing.T) {
+	// a corpus that can't be read must not reject every password
+	dir := t.TempDir()
+	sum := sha1.Sum([]byte("Sup3r-secret"))
+	if err := os.Mkdir(filepath.Join(dir, strings.ToUpper(hex.EncodeToString(sum[:]))[:5]), 0o700); err != nil {
+		t.Fatal(err)
+	}
+	policy := PasswordPolicy{BreachedCorpus: dir, BreachedMin: 1}
+	if err := policy.Check("Sup3r-secret", "", ""); err != nil {
+		t.Errorf("Check with an unreadable corpus = %v, want nil", err)
+	}
+}
+
+// writeRange adds pass with count to the range file for its prefix in dir.
+func writeRange(t *testing.T, dir, pass string, count int, ext string) {
+	t.Helper()
+	sum := sha1.Sum([]byte(pass))
+	digest := strings.ToUpper(hex.EncodeToString(sum[:]))
+	lines := "0000000000000000000000000000000000A:12\n" + strings.ToLower(digest[5:]) + ":" + strconv.Itoa(count) + "\n"
+	if err := os.WriteFile(filepath.Join(dir, digest[:5]+ext), []byte(lines), 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func violatedRules(t *testing.T, err error) []string {
+	t.Helper()
+	if err == nil {
+		return nil
+	}
+	var policyErr *PasswordPolicyError
+	if !errors.As(err, &policyErr) {
+		t.Fatalf("got %v, want a *PasswordPolicyError", err)
+	}
+	var rules []string
+	for _, v := range policyErr.Violations {
+		rules = append(rules, v.Rule)
+	}
+	return rules
+}
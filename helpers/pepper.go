@@ -0,0 +1,94 @@
+package helpers
+
+import (
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	password "github.com/dwin/goSecretBoxPassword"
+	"github.com/joho/godotenv"
+)
+
+// Peppers are versioned so a leaked SECRET can be rotated without invalidating
+// existing passwords. SECRET is version 0 and PEPPERS adds newer versions as
+// "1:secret,2:secret". New hashes always use the highest configured version
+// and older hashes are upgraded on the next successful login.
+
+var (
+	peppers     map[int]string
+	peppersOnce sync.Once
+)
+
+func GetPeppers() map[int]string {
+	peppersOnce.Do(func() {
+		err := godotenv.Load()
+		if err != nil {
+			log.Fatal("Error loading Env File")
+		}
+		peppers = map[int]string{}
+		if secret := os.Getenv("SECRET"); secret != "" {
+			peppers[0] = secret
+		}
+		for _, entry := range strings.Split(os.Getenv("PEPPERS"), ",") {
+			entry = strings.TrimSpace(entry)
+			if entry == "" {
+				continue
+			}
+			version, secret, found := strings.Cut(entry, ":")
+			n, err := strconv.Atoi(version)
+			if !found || err != nil || n < 0 || secret == "" {
+				log.Fatal("Invalid PEPPERS entry, expected <version>:<secret>")
+			}
+			peppers[n] = secret
+		}
+		if len(peppers) == 0 {
+			log.Fatal("No password pepper configured, set SECRET or PEPPERS")
+		}
+	})
+	return peppers
+}
+
+// CurrentPepper returns the newest pepper version and its secret.
+func CurrentPepper() (int, string) {
+	current := -1
+	for version := range GetPeppers() {
+		if version > current {
+			current = version
+		}
+	}
+	return current, peppers[current]
+}
+
+func PepperSecret(version int) (string, bool) {
+	secret, ok := GetPeppers()[version]
+	return secret, ok
+}
+
+func pepperPrefix(version int) string {
+	return "$pv=" + strconv.Itoa(version)
+}
+
+// SplitPepperVersion returns the pepper version a hash was made with and the
+// hash without its version prefix. Hashes from before pepper rotation carry no
+// prefix and use version 0, except legacy secretbox hashes which record it as
+// their own master version.
+func SplitPepperVersion(hash string) (int, string) {
+	if strings.HasPrefix(hash, "$pv=") {
+		rest := strings.TrimPrefix(hash, "$pv=")
+		end := strings.IndexByte(rest, '$')
+		if end > 0 {
+			if version, err := strconv.Atoi(rest[:end]); err == nil {
+				return version, rest[end:]
+			}
+		}
+		return -1, hash
+	}
+	if strings.HasPrefix(hash, "secBoxv1$") {
+		if version, err := password.GetMasterVersion(hash); err == nil {
+			return version, hash
+		}
+	}
+	return 0, hash
+}
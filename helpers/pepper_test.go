@@ -0,0 +1,90 @@
+package helpers
+
+import (
+	"strings"
+	"testing"
+
+	password "github.com/dwin/goSecretBoxPassword"
+)
+
+func TestSplitPepperVersion(t *testing.T) {
+	legacyParams := password.ScryptParams{N: 4096, R: 8, P: 1}
+	legacy, err := password.Hash("correct horse", "legacy-master-secret", 3, legacyParams, legacyParams)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name    string
+		hash    string
+		version int
+		rest    string
+	}{
+		{"versioned", "$pv=2$argon2id$v=19$abc", 2, "$argon2id$v=19$abc"},
+		{"multi digit", "$pv=12$2a$04$abc", 12, "$2a$04$abc"},
+		{"unversioned", "$argon2id$v=19$abc", 0, "$argon2id$v=19$abc"},
+		{"not a number", "$pv=x$argon2id$abc", -1, "$pv=x$argon2id$abc"},
+		{"empty version", "$pv=$argon2id$abc", -1, "$pv=$argon2id$abc"},
+		{"unterminated", "$pv=2", -1, "$pv=2"},
+		{"legacy secretbox", legacy, 3, legacy},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			version, rest := SplitPepperVersion(test.hash)
+			if version != test.version || rest != test.rest {
+				t.Errorf("SplitPepperVersion(%q) = %d, %q, want %d, %q", test.hash, version, rest, test.version, test.rest)
+			}
+		})
+	}
+}
+
+func TestCurrentPepperIsNewest(t *testing.T) {
+	usePasswordConfig(t, testHashers[0], map[int]string{0: "pepper-0", 2: "pepper-2", 1: "pepper-1"})
+	if version, secret := CurrentPepper(); version != 2 || secret != "pepper-2" {
+		t.Errorf("CurrentPepper() = %d, %q, want 2, %q", version, secret, "pepper-2")
+	}
+}
+
+func TestPepperUpgrade(t *testing.T) {
+	usePasswordConfig(t, testHashers[0], map[int]string{0: "pepper-0"})
+	old, err := GenerateHash("correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	usePasswordConfig(t, testHashers[0], map[int]string{0: "pepper-0", 1: "pepper-1"})
+	if !ValidateHash(old, "correct horse") {
+		t.Error("ValidateHash of a hash with the previous pepper = false")
+	}
+	if !NeedsRehash(old) {
+		t.Error("NeedsRehash of a hash with the previous pepper = false")
+	}
+	upgraded, err := GenerateHash("correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(upgraded, "$pv=1$") {
+		t.Errorf("hash %q does not use the newest pepper", upgraded)
+	}
+	if NeedsRehash(upgraded) {
+		t.Error("NeedsRehash of a hash with the newest pepper = true")
+	}
+
+	// the same password under another pepper must not verify
+	usePasswordConfig(t, testHashers[0], map[int]string{0: "pepper-0", 1: "rotated-1"})
+	if ValidateHash(upgraded, "correct horse") {
+		t.Error("ValidateHash with a different secret for the pepper version = true")
+	}
+}
+
+func TestValidateHashWithUnknownPepper(t *testing.T) {
+	usePasswordConfig(t, testHashers[0], map[int]string{0: "pepper-0", 1: "pepper-1"})
+	hash, err := GenerateHash("correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// version 1 was removed from the configuration
+	usePasswordConfig(t, testHashers[0], map[int]string{0: "pepper-0"})
+	if ValidateHash(hash, "correct horse") {
+		t.Error("ValidateHash of a hash with an unconfigured pepper = true")
+	}
+}
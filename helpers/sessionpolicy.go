@@ -0,0 +1,97 @@
+package helpers
+
+import (
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/joho/godotenv"
+)
+
+// SessionPolicy limits how long a session lives and how many a user may have.
+// Lifetime counts from login and is never extended. IdleTimeout counts from the
+// last time the session was used and slides forward with every use. A user
+// with MaxSessions active sessions (0 means unlimited) either can't log in
+// again or loses their oldest session, depending on LimitStrategy.
+type SessionPolicy struct {
+	Lifetime      time.Duration
+	IdleTimeout   time.Duration
+	MaxSessions   int
+	LimitStrategy string
+}
+
+const (
+	SessionLimitReject      = "reject"
+	SessionLimitEvictOldest = "evict-oldest"
+)
+
+var (
+	defaultSessionPolicy = SessionPolicy{Lifetime: 24 * time.Hour, IdleTimeout: 2 * time.Hour, LimitStrategy: SessionLimitReject}
+	sessionPoliciesOnce  sync.Once
+)
+
+// GetSessionPolicy returns the policy for users with role. SESSION_LIFETIME,
+// SESSION_IDLE_TIMEOUT, MAX_SESSIONS and SESSION_LIMIT_STRATEGY set the
+// default, and the same variables with a _<ROLE> suffix override it per role,
+// e.g. SESSION_LIFETIME_ADMIN=8h.
+func GetSessionPolicy(role string) SessionPolicy {
+	sessionPoliciesOnce.Do(func() {
+		err := godotenv.Load()
+		if err != nil {
+			log.Fatal("Error loading Env File")
+		}
+		defaultSessionPolicy = SessionPolicy{
+			Lifetime:      envDuration("SESSION_LIFETIME", defaultSessionPolicy.Lifetime),
+			IdleTimeout:   envDuration("SESSION_IDLE_TIMEOUT", defaultSessionPolicy.IdleTimeout),
+			MaxSessions:   envInt("MAX_SESSIONS", 0),
+			LimitStrategy: envLimitStrategy("SESSION_LIMIT_STRATEGY", defaultSessionPolicy.LimitStrategy),
+		}.clamped()
+	})
+	if role == "" {
+		return defaultSessionPolicy
+	}
+	suffix := "_" + strings.ToUpper(role)
+	policy := SessionPolicy{
+		Lifetime:      envDuration("SESSION_LIFETIME"+suffix, defaultSessionPolicy.Lifetime),
+		IdleTimeout:   envDuration("SESSION_IDLE_TIMEOUT"+suffix, defaultSessionPolicy.IdleTimeout),
+		MaxSessions:   envInt("MAX_SESSIONS"+suffix, defaultSessionPolicy.MaxSessions),
+		LimitStrategy: envLimitStrategy("SESSION_LIMIT_STRATEGY"+suffix, defaultSessionPolicy.LimitStrategy),
+	}
+	return policy.clamped()
+}
+
+func (policy SessionPolicy) clamped() SessionPolicy {
+	if policy.IdleTimeout > policy.Lifetime {
+		policy.IdleTimeout = policy.Lifetime
+	}
+	if policy.MaxSessions < 0 {
+		policy.MaxSessions = 0
+	}
+	return policy
+}
+
+func envLimitStrategy(key, fallback string) string {
+	switch strategy := os.Getenv(key); strategy {
+	case SessionLimitReject, SessionLimitEvictOldest:
+		return strategy
+	case "":
+	default:
+		log.Printf("ignoring unknown %s %q", key, strategy)
+	}
+	return fallback
+}
+
+// DefaultSessionPolicy is the policy for roles without their own settings.
+func DefaultSessionPolicy() SessionPolicy {
+	return GetSessionPolicy("")
+}
+
+func envDuration(key string, fallback time.Duration) time.Duration {
+	value, err := time.ParseDuration(os.Getenv(key))
+	if err != nil || value <= 0 {
+		return fallback
+	}
+	return value
+}
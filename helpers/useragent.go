@@ -0,0 +1,106 @@
+package helpers
+
+import (
+	"log"
+	"mux-mongo-api/models"
+	"net"
+	"net/http"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/joho/godotenv"
+)
+
+var (
+	botPattern     = regexp.MustCompile(`(?i)bot|crawler|spider|curl|wget|httpclient|python-requests|go-http-client|postman`)
+	versionPattern = regexp.MustCompile(`^[0-9]+(\.[0-9]+)?`)
+)
+
+// userAgentBrowsers are checked in order, so browsers that also announce
+// themselves as Chrome or Safari come first.
+var userAgentBrowsers = []struct{ token, name string }{
+	{"Edg/", "Edge"},
+	{"OPR/", "Opera"},
+	{"SamsungBrowser/", "Samsung Internet"},
+	{"Firefox/", "Firefox"},
+	{"FxiOS/", "Firefox"},
+	{"CriOS/", "Chrome"},
+	{"Chrome/", "Chrome"},
+	{"Version/", "Safari"},
+}
+
+var userAgentSystems = []struct{ token, name string }{
+	{"Windows", "Windows"},
+	{"iPhone", "iOS"},
+	{"iPad", "iPadOS"},
+	{"Android", "Android"},
+	{"CrOS", "ChromeOS"},
+	{"Mac OS X", "macOS"},
+	{"Linux", "Linux"},
+}
+
+// ParseUserAgent makes a best effort guess at the device, operating system and
+// browser behind a User-Agent header. Unknown parts are left empty.
+func ParseUserAgent(userAgent string) models.DeviceInfo {
+	var device models.DeviceInfo
+	if userAgent == "" {
+		device.Type = models.DeviceOther
+		return device
+	}
+	for _, system := range userAgentSystems {
+		if strings.Contains(userAgent, system.token) {
+			device.OS = system.name
+			break
+		}
+	}
+	for _, browser := range userAgentBrowsers {
+		if i := strings.Index(userAgent, browser.token); i >= 0 {
+			device.Browser = browser.name
+			device.Version = versionPattern.FindString(userAgent[i+len(browser.token):])
+			break
+		}
+	}
+
+	switch {
+	case botPattern.MatchString(userAgent):
+		device.Type = models.DeviceBot
+	case strings.Contains(userAgent, "iPad") || strings.Contains(userAgent, "Tablet") ||
+		(device.OS == "Android" && !strings.Contains(userAgent, "Mobile")):
+		device.Type = models.DeviceTablet
+	case strings.Contains(userAgent, "Mobi") || device.OS == "iOS":
+		device.Type = models.DeviceMobile
+	case device.OS != "":
+		device.Type = models.DeviceDesktop
+	default:
+		device.Type = models.DeviceOther
+	}
+	return device
+}
+
+// TrustProxy reports whether X-Forwarded-For may be used to find the client
+// address, which is only safe behind a proxy that overwrites the header.
+func TrustProxy() bool {
+	err := godotenv.Load()
+	if err != nil {
+		log.Fatal("Error loading Env File")
+	}
+	trust, _ := strconv.ParseBool(os.Getenv("TRUST_PROXY"))
+	return trust
+}
+
+// ClientIP returns the address of the client that sent r.
+func ClientIP(r *http.Request) string {
+	if TrustProxy() {
+		if forwarded := r.Header.Get("X-Forwarded-For"); forwarded != "" {
+			first, _, _ := strings.Cut(forwarded, ",")
+			return strings.TrimSpace(first)
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
@@ -1,19 +1,65 @@
 package main
 
 import (
+	"context"
 	"log"
+	"mux-mongo-api/commands"
 	"mux-mongo-api/configs"
+	"mux-mongo-api/controllers"
+	"mux-mongo-api/events"
+	"mux-mongo-api/helpers"
+	"mux-mongo-api/migrations"
+	"mux-mongo-api/privacy"
 	"mux-mongo-api/routes"
+	"mux-mongo-api/workers"
 	"net/http"
+	"os"
+	"time"
 
 	"github.com/gorilla/mux"
 )
 
 func main() {
+	if len(os.Args) > 1 {
+		os.Exit(commands.Run(os.Args[1:]))
+	}
+
+	if err := configs.PingDB(context.Background()); err != nil {
+		log.Fatal("Error connecting to MongoDB: ", err)
+	}
+
 	router := mux.NewRouter()
-	configs.ConnectDB()
+	if configs.EnvMigrateOnStart() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+		_, err := migrations.Up(ctx, 0)
+		if err != nil {
+			log.Fatal("Error applying migrations: ", err)
+		}
+		reports, err := migrations.ApplyValidators(ctx, false)
+		if err != nil {
+			log.Fatal("Error applying collection validators: ", err)
+		}
+		for _, report := range reports {
+			if report.Invalid > 0 {
+				log.Printf("%d documents in %s do not match the schema, e.g. %v", report.Invalid, report.Collection, report.Samples)
+			}
+		}
+		cancel()
+	}
+	if err := helpers.LoadMailTemplates(configs.EnvMailTemplateDir()); err != nil {
+		log.Fatal("Error loading email templates: ", err)
+	}
+
+	helpers.SetSuppressionList(controllers.SuppressionList)
+	events.Subscribe(workers.WebhookSubscriber{})
+	go events.Run(context.Background())
+	go workers.RunEmailOutbox(context.Background())
+	go workers.RunWebhookDeliveries(context.Background())
+	go privacy.RunDataExports(context.Background())
 
 	routes.UserRoute(router)
+	routes.AdminRoute(router)
+	routes.WebhookRoute(router)
 	router.Use(mux.CORSMethodMiddleware(router))
 	log.Println("Server Started Successfully!")
 	log.Fatal(http.ListenAndServe(":8000", router))
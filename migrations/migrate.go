@@ -0,0 +1,228 @@
+package migrations
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"mux-mongo-api/configs"
+	"os"
+	"sort"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var migrationCollection *mongo.Collection = configs.GetCollection(configs.DB, "schema_migrations")
+var lockCollection *mongo.Collection = configs.GetCollection(configs.DB, "schema_migrations_lock")
+
+// Migration is one versioned schema change. Versions are applied in ascending
+// order and must never be renumbered once released. Up and Down should be safe
+// to run again if a previous attempt failed halfway.
+type Migration struct {
+	Version int
+	Name    string
+	Up      func(ctx context.Context) error
+	Down    func(ctx context.Context) error
+}
+
+// Applied is the record kept in schema_migrations for every applied version.
+type Applied struct {
+	Version   int       `bson:"_id" json:"version"`
+	Name      string    `json:"name"`
+	AppliedAt time.Time `json:"appliedat"`
+}
+
+// Status describes a known migration and whether it has been applied.
+type Status struct {
+	Migration
+	AppliedAt *time.Time
+}
+
+var registry []Migration
+
+func register(migration Migration) {
+	for _, m := range registry {
+		if m.Version == migration.Version {
+			panic(fmt.Sprintf("migrations: version %d registered twice", migration.Version))
+		}
+	}
+	registry = append(registry, migration)
+	sort.Slice(registry, func(i, j int) bool { return registry[i].Version < registry[j].Version })
+}
+
+// Latest returns the highest known version.
+func Latest() int {
+	if len(registry) == 0 {
+		return 0
+	}
+	return registry[len(registry)-1].Version
+}
+
+// Up applies every pending migration up to and including target, or all of
+// them when target is 0. It returns the migrations it applied.
+func Up(ctx context.Context, target int) ([]Migration, error) {
+	var done []Migration
+	err := withLock(ctx, func() error {
+		applied, err := appliedVersions(ctx)
+		if err != nil {
+			return err
+		}
+		for _, migration := range registry {
+			if target > 0 && migration.Version > target {
+				break
+			}
+			if _, ok := applied[migration.Version]; ok {
+				continue
+			}
+			log.Printf("migrations: applying %d %s", migration.Version, migration.Name)
+			if err := migration.Up(ctx); err != nil {
+				return fmt.Errorf("migration %d %s: %w", migration.Version, migration.Name, err)
+			}
+			_, err := migrationCollection.InsertOne(ctx, Applied{Version: migration.Version, Name: migration.Name, AppliedAt: time.Now()})
+			if err != nil {
+				return err
+			}
+			done = append(done, migration)
+		}
+		return nil
+	})
+	return done, err
+}
+
+// Down reverts the given number of most recently applied migrations.
+func Down(ctx context.Context, steps int) ([]Migration, error) {
+	var done []Migration
+	err := withLock(ctx, func() error {
+		applied, err := appliedVersions(ctx)
+		if err != nil {
+			return err
+		}
+		for i := len(registry) - 1; i >= 0 && len(done) < steps; i-- {
+			migration := registry[i]
+			if _, ok := applied[migration.Version]; !ok {
+				continue
+			}
+			if migration.Down == nil {
+				return fmt.Errorf("migration %d %s cannot be reverted", migration.Version, migration.Name)
+			}
+			log.Printf("migrations: reverting %d %s", migration.Version, migration.Name)
+			if err := migration.Down(ctx); err != nil {
+				return fmt.Errorf("migration %d %s: %w", migration.Version, migration.Name, err)
+			}
+			if _, err := migrationCollection.DeleteOne(ctx, bson.M{"_id": migration.Version}); err != nil {
+				return err
+			}
+			done = append(done, migration)
+		}
+		return nil
+	})
+	return done, err
+}
+
+// List returns every known migration with the time it was applied.
+func List(ctx context.Context) ([]Status, error) {
+	applied, err := appliedVersions(ctx)
+	if err != nil {
+		return nil, err
+	}
+	statuses := make([]Status, 0, len(registry))
+	for _, migration := range registry {
+		status := Status{Migration: migration}
+		if record, ok := applied[migration.Version]; ok {
+			status.AppliedAt = &record.AppliedAt
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses, nil
+}
+
+func appliedVersions(ctx context.Context) (map[int]Applied, error) {
+	results, err := migrationCollection.Find(ctx, bson.M{})
+	if err != nil {
+		return nil, err
+	}
+	var records []Applied
+	if err := results.All(ctx, &records); err != nil {
+		return nil, err
+	}
+	applied := make(map[int]Applied, len(records))
+	for _, record := range records {
+		applied[record.Version] = record
+	}
+	return applied, nil
+}
+
+const (
+	lockId         = "migrations"
+	lockLease      = 2 * time.Minute
+	lockRetryAfter = 2 * time.Second
+)
+
+// ErrLocked is returned when another process holds the migration lock for
+// longer than the caller's context allows.
+var ErrLocked = errors.New("migrations are locked by another process")
+
+// withLock runs fn while holding the migration lock so replicas starting at
+// the same time don't apply a migration twice. The lease is renewed while fn
+// runs and expires on its own if the holder dies.
+func withLock(ctx context.Context, fn func() error) error {
+	host, _ := os.Hostname()
+	owner := fmt.Sprintf("%s/%d/%s", host, os.Getpid(), primitive.NewObjectID().Hex())
+	for {
+		acquired, err := acquireLock(ctx, owner)
+		if err != nil {
+			return err
+		}
+		if acquired {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			return ErrLocked
+		case <-time.After(lockRetryAfter):
+		}
+	}
+
+	renewCtx, stopRenew := context.WithCancel(ctx)
+	defer func() {
+		stopRenew()
+		releaseCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		if _, err := lockCollection.DeleteOne(releaseCtx, bson.M{"_id": lockId, "owner": owner}); err != nil {
+			log.Println("migrations: releasing lock failed:", err)
+		}
+	}()
+	go func() {
+		ticker := time.NewTicker(lockLease / 4)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-renewCtx.Done():
+				return
+			case <-ticker.C:
+				_, err := lockCollection.UpdateOne(renewCtx, bson.M{"_id": lockId, "owner": owner},
+					bson.M{"$set": bson.M{"expiresat": time.Now().Add(lockLease)}})
+				if err != nil && renewCtx.Err() == nil {
+					log.Println("migrations: renewing lock failed:", err)
+				}
+			}
+		}
+	}()
+	return fn()
+}
+
+func acquireLock(ctx context.Context, owner string) (bool, error) {
+	now := time.Now()
+	_, err := lockCollection.UpdateOne(ctx,
+		bson.M{"_id": lockId, "expiresat": bson.M{"$lt": now}},
+		bson.M{"$set": bson.M{"owner": owner, "lockedat": now, "expiresat": now.Add(lockLease)}},
+		options.Update().SetUpsert(true))
+	if mongo.IsDuplicateKeyError(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
@@ -0,0 +1,391 @@
+package migrations
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"mux-mongo-api/configs"
+	"mux-mongo-api/helpers"
+	"mux-mongo-api/models"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+func init() {
+	register(Migration{
+		Version: 1,
+		Name:    "users_email_unique",
+		Up: func(ctx context.Context) error {
+			return createIndexes(ctx, "users", mongo.IndexModel{
+				Keys:    bson.D{{Key: "email", Value: 1}},
+				Options: options.Index().SetName("email_unique").SetUnique(true),
+			})
+		},
+		Down: func(ctx context.Context) error {
+			return dropIndexes(ctx, "users", "email_unique")
+		},
+	})
+	register(Migration{
+		Version: 2,
+		Name:    "usersession_indexes",
+		Up: func(ctx context.Context) error {
+			return createIndexes(ctx, "usersession",
+				mongo.IndexModel{Keys: bson.D{{Key: "accesstoken", Value: 1}}, Options: options.Index().SetName("accesstoken")},
+				mongo.IndexModel{Keys: bson.D{{Key: "refreshtoken", Value: 1}}, Options: options.Index().SetName("refreshtoken")},
+				mongo.IndexModel{Keys: bson.D{{Key: "user", Value: 1}, {Key: "tscreated", Value: -1}}, Options: options.Index().SetName("user_tscreated")},
+			)
+		},
+		Down: func(ctx context.Context) error {
+			return dropIndexes(ctx, "usersession", "accesstoken", "refreshtoken", "user_tscreated")
+		},
+	})
+	register(Migration{
+		Version: 3,
+		Name:    "users_superadmin_unique",
+		Up: func(ctx context.Context) error {
+			return createIndexes(ctx, "users", mongo.IndexModel{
+				Keys: bson.D{{Key: "role", Value: 1}},
+				Options: options.Index().SetName("superadmin_unique").SetUnique(true).
+					SetPartialFilterExpression(bson.M{"role": models.RoleSuperAdmin}),
+			})
+		},
+		Down: func(ctx context.Context) error {
+			return dropIndexes(ctx, "users", "superadmin_unique")
+		},
+	})
+	register(Migration{
+		Version: 4,
+		Name:    "usersession_hash_tokens",
+		Up:      hashSessionTokens,
+	})
+	register(Migration{
+		Version: 5,
+		Name:    "usersession_ttl",
+		Up:      expireSessions,
+		Down: func(ctx context.Context) error {
+			return dropIndexes(ctx, "usersession", "expiresat_ttl", "idleexpiresat_ttl")
+		},
+	})
+	register(Migration{
+		Version: 6,
+		Name:    "invitations_indexes",
+		Up: func(ctx context.Context) error {
+			return createIndexes(ctx, "invitations",
+				mongo.IndexModel{Keys: bson.D{{Key: "tokenhash", Value: 1}}, Options: options.Index().SetName("tokenhash_unique").SetUnique(true)},
+				mongo.IndexModel{
+					Keys: bson.D{{Key: "email", Value: 1}},
+					Options: options.Index().SetName("pending_email_unique").SetUnique(true).
+						SetPartialFilterExpression(bson.M{"status": models.InvitationPending}),
+				},
+				mongo.IndexModel{Keys: bson.D{{Key: "tscreated", Value: -1}}, Options: options.Index().SetName("tscreated")},
+			)
+		},
+		Down: func(ctx context.Context) error {
+			return dropIndexes(ctx, "invitations", "tokenhash_unique", "pending_email_unique", "tscreated")
+		},
+	})
+	register(Migration{
+		Version: 7,
+		Name:    "organizations_from_company",
+		Up:      organizationsFromCompany,
+		Down: func(ctx context.Context) error {
+			return dropIndexes(ctx, "users", "memberships_organization")
+		},
+	})
+	register(Migration{
+		Version: 8,
+		Name:    "groups_indexes",
+		Up: func(ctx context.Context) error {
+			return createIndexes(ctx, "groups",
+				mongo.IndexModel{Keys: bson.D{{Key: "organization", Value: 1}, {Key: "name", Value: 1}}, Options: options.Index().SetName("organization_name_unique").SetUnique(true)},
+				mongo.IndexModel{Keys: bson.D{{Key: "members", Value: 1}}, Options: options.Index().SetName("members")},
+				mongo.IndexModel{Keys: bson.D{{Key: "subgroups", Value: 1}}, Options: options.Index().SetName("subgroups")},
+			)
+		},
+		Down: func(ctx context.Context) error {
+			return dropIndexes(ctx, "groups", "organization_name_unique", "members", "subgroups")
+		},
+	})
+	register(Migration{
+		Version: 9,
+		Name:    "email_events_eventid_unique",
+		Up: func(ctx context.Context) error {
+			// events without an id are stored with an empty one
+			return createIndexes(ctx, "email_events", mongo.IndexModel{
+				Keys:    bson.D{{Key: "eventid", Value: 1}},
+				Options: options.Index().SetName("eventid_unique").SetUnique(true).SetPartialFilterExpression(bson.M{"eventid": bson.M{"$gt": ""}}),
+			})
+		},
+		Down: func(ctx context.Context) error {
+			return dropIndexes(ctx, "email_events", "eventid_unique")
+		},
+	})
+	register(Migration{
+		Version: 10,
+		Name:    "lowercase_emails",
+		Up:      lowercaseEmails,
+		Down: func(ctx context.Context) error {
+			// the original spelling is gone, lowercase addresses work either way
+			return nil
+		},
+	})
+}
+
+// organizationsFromCompany creates an organization for every distinct company
+// name users entered and makes those users members of it. The company field
+// is left in place.
+func organizationsFromCompany(ctx context.Context) error {
+	err := createIndexes(ctx, "organizations", mongo.IndexModel{
+		Keys:    bson.D{{Key: "slug", Value: 1}},
+		Options: options.Index().SetName("slug_unique").SetUnique(true),
+	})
+	if err != nil {
+		return err
+	}
+	err = createIndexes(ctx, "users", mongo.IndexModel{
+		Keys:    bson.D{{Key: "memberships.organization", Value: 1}},
+		Options: options.Index().SetName("memberships_organization"),
+	})
+	if err != nil {
+		return err
+	}
+
+	users := configs.GetCollection(configs.DB, "users")
+	organizations := configs.GetCollection(configs.DB, "organizations")
+	companies, err := users.Distinct(ctx, "company", bson.M{"company": bson.M{"$nin": bson.A{"", nil}}})
+	if err != nil {
+		return err
+	}
+	for _, value := range companies {
+		company, ok := value.(string)
+		if !ok || strings.TrimSpace(company) == "" {
+			continue
+		}
+		var organization models.Organization
+		err := organizations.FindOne(ctx, bson.M{"name": company}).Decode(&organization)
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			now := time.Now()
+			organization = models.Organization{Id: primitive.NewObjectID(), Name: company, TsCreated: now, TsUpdated: now}
+			base := slug(company)
+			for i := 1; ; i++ {
+				organization.Slug = base
+				if i > 1 {
+					organization.Slug = base + "-" + strconv.Itoa(i)
+				}
+				_, err = organizations.InsertOne(ctx, organization)
+				if !mongo.IsDuplicateKeyError(err) {
+					break
+				}
+			}
+		}
+		if err != nil {
+			return err
+		}
+		_, err = users.UpdateMany(ctx,
+			bson.M{"company": company, "memberships.organization": bson.M{"$ne": organization.Id}},
+			bson.M{"$push": bson.M{"memberships": models.Membership{Organization: organization.Id, Role: models.OrgRoleMember, TsJoined: time.Now()}}})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// lowercaseEmails normalizes stored email addresses, which requests now
+// lowercase, so accounts can still be found and the unique index on email
+// covers addresses differing only in case. Users whose addresses collide that
+// way must be merged by hand before the migration can finish.
+func lowercaseEmails(ctx context.Context) error {
+	lower := func(field string) bson.M {
+		return bson.M{"$toLower": "$" + field}
+	}
+	upper := bson.M{"$regex": "[A-Z]"}
+	users := configs.GetCollection(configs.DB, "users")
+	_, err := users.UpdateMany(ctx, bson.M{"email": upper}, bson.A{bson.M{"$set": bson.M{"email": lower("email")}}})
+	if mongo.IsDuplicateKeyError(err) {
+		return fmt.Errorf("users whose emails differ only in case must be merged first: %w", err)
+	}
+	if err != nil {
+		return err
+	}
+	_, err = users.UpdateMany(ctx, bson.M{"emailchange": bson.M{"$exists": true}}, bson.A{bson.M{"$set": bson.M{
+		"emailchange.oldemail": lower("emailchange.oldemail"),
+		"emailchange.newemail": lower("emailchange.newemail"),
+	}}})
+	if err != nil {
+		return err
+	}
+	_, err = configs.GetCollection(configs.DB, "invitations").UpdateMany(ctx, bson.M{"email": upper}, bson.A{bson.M{"$set": bson.M{"email": lower("email")}}})
+	if mongo.IsDuplicateKeyError(err) {
+		return fmt.Errorf("pending invitations whose emails differ only in case must be revoked first: %w", err)
+	}
+	return err
+}
+
+// sessionUser returns the id of the user a legacy session token was issued to,
+// or primitive.NilObjectID when the token expired or its user is gone.
+func sessionUser(ctx context.Context, users *mongo.Collection, token string) (primitive.ObjectID, error) {
+	email, err := helpers.TokenParser(token)
+	if err != nil {
+		return primitive.NilObjectID, nil
+	}
+	var user models.User
+	err = users.FindOne(ctx, bson.M{"email": email}).Decode(&user)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return primitive.NilObjectID, nil
+	}
+	return user.Id, err
+}
+
+// slug turns a name into a lowercase identifier of letters, digits and dashes.
+func slug(name string) string {
+	var b strings.Builder
+	dash := false
+	for _, r := range strings.ToLower(name) {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			b.WriteRune(r)
+			dash = false
+		} else if !dash && b.Len() > 0 {
+			b.WriteByte('-')
+			dash = true
+		}
+	}
+	s := strings.TrimSuffix(b.String(), "-")
+	if s == "" {
+		return "organization"
+	}
+	if runes := []rune(s); len(runes) > 60 {
+		s = strings.TrimSuffix(string(runes[:60]), "-")
+	}
+	return s
+}
+
+// expireSessions gives sessions created before expiry was tracked the default
+// lifetimes and lets TTL indexes delete sessions once either expiry passes.
+func expireSessions(ctx context.Context) error {
+	policy := helpers.DefaultSessionPolicy()
+	_, err := configs.GetCollection(configs.DB, "usersession").UpdateMany(ctx,
+		bson.M{"expiresat": bson.M{"$exists": false}},
+		mongo.Pipeline{{{Key: "$set", Value: bson.M{
+			"expiresat":     bson.M{"$add": bson.A{"$tscreated", policy.Lifetime.Milliseconds()}},
+			"idleexpiresat": bson.M{"$add": bson.A{bson.M{"$ifNull": bson.A{"$tslastused", "$tscreated"}}, policy.IdleTimeout.Milliseconds()}},
+			"idletimeout":   int64(policy.IdleTimeout / time.Second),
+		}}}})
+	if err != nil {
+		return err
+	}
+	return createIndexes(ctx, "usersession",
+		mongo.IndexModel{Keys: bson.D{{Key: "expiresat", Value: 1}}, Options: options.Index().SetName("expiresat_ttl").SetExpireAfterSeconds(0)},
+		mongo.IndexModel{Keys: bson.D{{Key: "idleexpiresat", Value: 1}}, Options: options.Index().SetName("idleexpiresat_ttl").SetExpireAfterSeconds(0)},
+	)
+}
+
+// hashSessionTokens replaces the plaintext tokens of existing sessions with
+// their hashes. Sessions from before sessions referenced their user get it
+// from the email in the token, or are deleted when that email no longer
+// belongs to anyone. It can't be reverted since the tokens are gone afterwards.
+func hashSessionTokens(ctx context.Context) error {
+	sessions := configs.GetCollection(configs.DB, "usersession")
+	users := configs.GetCollection(configs.DB, "users")
+	results, err := sessions.Find(ctx, bson.M{"$or": bson.A{
+		bson.M{"accesstoken": bson.M{"$exists": true}},
+		bson.M{"refreshtoken": bson.M{"$exists": true}},
+	}}, options.Find().SetProjection(bson.M{"accesstoken": 1, "refreshtoken": 1, "user": 1}))
+	if err != nil {
+		return err
+	}
+	defer results.Close(ctx)
+
+	var updates []mongo.WriteModel
+	flush := func() error {
+		if len(updates) == 0 {
+			return nil
+		}
+		_, err := sessions.BulkWrite(ctx, updates, options.BulkWrite().SetOrdered(false))
+		updates = updates[:0]
+		return err
+	}
+	for results.Next(ctx) {
+		var session struct {
+			Id           interface{}        `bson:"_id"`
+			AccessToken  string             `bson:"accesstoken"`
+			RefreshToken string             `bson:"refreshtoken"`
+			User         primitive.ObjectID `bson:"user,omitempty"`
+		}
+		if err := results.Decode(&session); err != nil {
+			return err
+		}
+		set := bson.M{}
+		if session.User.IsZero() {
+			// the refresh token outlives the access token, it names the user
+			// as long as the session can still be used
+			if session.User, err = sessionUser(ctx, users, session.RefreshToken); err != nil {
+				return err
+			}
+			if session.User.IsZero() {
+				updates = append(updates, mongo.NewDeleteOneModel().SetFilter(bson.M{"_id": session.Id}))
+				continue
+			}
+			set["user"] = session.User
+		}
+		if session.AccessToken != "" {
+			set["accesstokenhash"] = helpers.HashToken(session.AccessToken)
+		}
+		if session.RefreshToken != "" {
+			set["refreshtokenhash"] = helpers.HashToken(session.RefreshToken)
+		}
+		update := bson.M{"$unset": bson.M{"accesstoken": "", "refreshtoken": ""}}
+		if len(set) > 0 {
+			update["$set"] = set
+		}
+		updates = append(updates, mongo.NewUpdateOneModel().SetFilter(bson.M{"_id": session.Id}).SetUpdate(update))
+		if len(updates) >= 500 {
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+	}
+	if err := results.Err(); err != nil {
+		return err
+	}
+	if err := flush(); err != nil {
+		return err
+	}
+
+	if err := dropIndexes(ctx, "usersession", "accesstoken", "refreshtoken"); err != nil {
+		return err
+	}
+	// only tokens issued before the session id was embedded are looked up by hash
+	return createIndexes(ctx, "usersession",
+		mongo.IndexModel{Keys: bson.D{{Key: "accesstokenhash", Value: 1}}, Options: options.Index().SetName("accesstokenhash")},
+		mongo.IndexModel{Keys: bson.D{{Key: "refreshtokenhash", Value: 1}}, Options: options.Index().SetName("refreshtokenhash")},
+	)
+}
+
+func createIndexes(ctx context.Context, collection string, models ...mongo.IndexModel) error {
+	_, err := configs.GetCollection(configs.DB, collection).Indexes().CreateMany(ctx, models)
+	return err
+}
+
+// dropIndexes drops the named indexes, ignoring ones that don't exist.
+func dropIndexes(ctx context.Context, collection string, names ...string) error {
+	indexes := configs.GetCollection(configs.DB, collection).Indexes()
+	for _, name := range names {
+		_, err := indexes.DropOne(ctx, name)
+		var cmdErr mongo.CommandError
+		if errors.As(err, &cmdErr) && (cmdErr.Code == 27 || cmdErr.Code == 26) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,197 @@
+package migrations
+
+import (
+	"context"
+	"errors"
+	"mux-mongo-api/configs"
+	"mux-mongo-api/models"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// validated lists the collections whose documents the database checks against
+// a $jsonSchema generated from the model stored in them.
+var validated = []struct {
+	collection string
+	model      interface{}
+}{
+	{"users", models.User{}},
+	{"usersession", models.UserSession{}},
+	{"organizations", models.Organization{}},
+	{"groups", models.Group{}},
+}
+
+// ValidatorReport describes the validator of one collection and the existing
+// documents that do not match it.
+type ValidatorReport struct {
+	Collection string               `json:"collection"`
+	Schema     bson.M               `json:"schema"`
+	Invalid    int64                `json:"invalid"`
+	Samples    []primitive.ObjectID `json:"samples,omitempty"`
+}
+
+// ApplyValidators installs or updates the collection validators. With dryRun
+// it only reports documents that would violate them. Validation level is
+// moderate, so documents that are already invalid can still be updated and
+// only writes producing new invalid documents are affected.
+func ApplyValidators(ctx context.Context, dryRun bool) ([]ValidatorReport, error) {
+	var reports []ValidatorReport
+	for _, v := range validated {
+		schema := JSONSchema(v.model)
+		report, err := checkValidator(ctx, v.collection, schema)
+		if err != nil {
+			return reports, err
+		}
+		reports = append(reports, report)
+		if dryRun {
+			continue
+		}
+		if err := setValidator(ctx, v.collection, schema); err != nil {
+			return reports, err
+		}
+	}
+	return reports, nil
+}
+
+func checkValidator(ctx context.Context, collection string, schema bson.M) (ValidatorReport, error) {
+	report := ValidatorReport{Collection: collection, Schema: schema}
+	coll := configs.GetCollection(configs.DB, collection)
+	filter := bson.M{"$nor": bson.A{bson.M{"$jsonSchema": schema}}}
+	count, err := coll.CountDocuments(ctx, filter)
+	if err != nil {
+		return report, err
+	}
+	report.Invalid = count
+	if count == 0 {
+		return report, nil
+	}
+	results, err := coll.Find(ctx, filter, options.Find().SetProjection(bson.M{"_id": 1}).SetLimit(10))
+	if err != nil {
+		return report, err
+	}
+	var ids []struct {
+		Id primitive.ObjectID `bson:"_id"`
+	}
+	if err := results.All(ctx, &ids); err != nil {
+		return report, err
+	}
+	for _, id := range ids {
+		report.Samples = append(report.Samples, id.Id)
+	}
+	return report, nil
+}
+
+func setValidator(ctx context.Context, collection string, schema bson.M) error {
+	db := configs.GetCollection(configs.DB, collection).Database()
+	validator := bson.M{"$jsonSchema": schema}
+	err := db.RunCommand(ctx, bson.D{
+		{Key: "collMod", Value: collection},
+		{Key: "validator", Value: validator},
+		{Key: "validationLevel", Value: "moderate"},
+		{Key: "validationAction", Value: configs.EnvSchemaValidationAction()},
+	}).Err()
+	var cmdErr mongo.CommandError
+	if errors.As(err, &cmdErr) && cmdErr.Code == 26 {
+		return db.CreateCollection(ctx, collection, options.CreateCollection().
+			SetValidator(validator).
+			SetValidationLevel("moderate").
+			SetValidationAction(configs.EnvSchemaValidationAction()))
+	}
+	return err
+}
+
+var (
+	timeType     = reflect.TypeOf(time.Time{})
+	objectIdType = reflect.TypeOf(primitive.ObjectID{})
+)
+
+// JSONSchema builds a $jsonSchema document from a model struct. Property names
+// follow the bson field names. Fields tagged validate:"required" are required,
+// and the oneof, min and max rules become enum and length constraints.
+// Additional properties are allowed so older documents keep validating.
+func JSONSchema(model interface{}) bson.M {
+	return structSchema(reflect.TypeOf(model))
+}
+
+func structSchema(t reflect.Type) bson.M {
+	properties := bson.M{}
+	required := bson.A{}
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+		name := strings.ToLower(field.Name)
+		if tag, _, _ := strings.Cut(field.Tag.Get("bson"), ","); tag == "-" {
+			continue
+		} else if tag != "" {
+			name = tag
+		}
+		property := typeSchema(field.Type)
+		for _, rule := range strings.Split(field.Tag.Get("validate"), ",") {
+			rule, param, _ := strings.Cut(rule, "=")
+			switch rule {
+			case "required":
+				required = append(required, name)
+			case "oneof":
+				enum := bson.A{}
+				for _, value := range strings.Fields(param) {
+					enum = append(enum, value)
+				}
+				property["enum"] = enum
+			case "min", "max":
+				n, err := strconv.Atoi(param)
+				if err != nil || field.Type.Kind() != reflect.String {
+					continue
+				}
+				property[rule+"Length"] = n
+			}
+			if rule == "dive" {
+				break
+			}
+		}
+		properties[name] = property
+	}
+	schema := bson.M{"bsonType": "object", "properties": properties}
+	if len(required) > 0 {
+		schema["required"] = required
+	}
+	return schema
+}
+
+func typeSchema(t reflect.Type) bson.M {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	switch {
+	case t == timeType:
+		return bson.M{"bsonType": "date"}
+	case t == objectIdType:
+		return bson.M{"bsonType": "objectId"}
+	}
+	switch t.Kind() {
+	case reflect.String:
+		return bson.M{"bsonType": "string"}
+	case reflect.Bool:
+		return bson.M{"bsonType": "bool"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return bson.M{"bsonType": bson.A{"int", "long"}}
+	case reflect.Float32, reflect.Float64:
+		return bson.M{"bsonType": bson.A{"double", "int", "long", "decimal"}}
+	case reflect.Slice, reflect.Array:
+		return bson.M{"bsonType": bson.A{"array", "null"}, "items": typeSchema(t.Elem())}
+	case reflect.Struct:
+		return structSchema(t)
+	case reflect.Map:
+		return bson.M{"bsonType": "object"}
+	}
+	return bson.M{}
+}
@@ -0,0 +1,60 @@
+package models
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Delivery states of an email in the outbox.
+const (
+	EmailPending   = "pending"
+	EmailSending   = "sending"
+	EmailSent      = "sent"
+	EmailDead      = "dead"
+	EmailCancelled = "cancelled"
+)
+
+// OutboxEmail is an email waiting in (or done with) the email_outbox
+// collection. It stores the template kind and data rather than the rendered
+// message so retries pick up template fixes.
+type OutboxEmail struct {
+	Id             primitive.ObjectID     `json:"_id,omitempty" bson:"_id,omitempty"`
+	IdempotencyKey string                 `json:"idempotencykey" bson:"idempotencykey"`
+	User           primitive.ObjectID     `json:"user,omitempty" bson:"user,omitempty"`
+	Kind           string                 `json:"kind" bson:"kind"`
+	Locale         string                 `json:"locale,omitempty" bson:"locale,omitempty"`
+	ToName         string                 `json:"toname" bson:"toname"`
+	ToAddress      string                 `json:"toaddress" bson:"toaddress"`
+	Data           map[string]interface{} `json:"data,omitempty" bson:"data,omitempty"`
+	Status         string                 `json:"status" bson:"status"`
+	Attempts       int                    `json:"attempts" bson:"attempts"`
+	MaxAttempts    int                    `json:"maxattempts" bson:"maxattempts"`
+	LastError      string                 `json:"lasterror,omitempty" bson:"lasterror,omitempty"`
+	NextAttemptAt  time.Time              `json:"nextattempt_on" bson:"nextattemptat"`
+	LockedUntil    time.Time              `json:"-" bson:"lockeduntil,omitempty"`
+	TsCreated      time.Time              `json:"created_on" bson:"tscreated"`
+	TsUpdated      time.Time              `json:"updated_on" bson:"tsupdated"`
+	TsSent         *time.Time             `json:"sent_on,omitempty" bson:"tssent,omitempty"`
+}
+
+// EmailEvent is a delivery event reported by the email provider.
+type EmailEvent struct {
+	Id        primitive.ObjectID `json:"_id,omitempty" bson:"_id,omitempty"`
+	EventId   string             `json:"eventid" bson:"eventid"`
+	MessageId string             `json:"messageid,omitempty" bson:"messageid,omitempty"`
+	User      primitive.ObjectID `json:"user,omitempty" bson:"user,omitempty"`
+	Email     string             `json:"email" bson:"email"`
+	Event     string             `json:"event" bson:"event"`
+	Type      string             `json:"type,omitempty" bson:"type,omitempty"`
+	Reason    string             `json:"reason,omitempty" bson:"reason,omitempty"`
+	Timestamp time.Time          `json:"timestamp" bson:"timestamp"`
+	TsCreated time.Time          `json:"created_on" bson:"tscreated"`
+}
+
+// EmailSuppression blocks all further email to an address.
+type EmailSuppression struct {
+	Email     string    `json:"email" bson:"_id"`
+	Reason    string    `json:"reason" bson:"reason"`
+	TsCreated time.Time `json:"created_on" bson:"tscreated"`
+}
@@ -0,0 +1,66 @@
+package models
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Domain events recorded in the same transaction as the write they describe.
+const (
+	UserCreated       = "UserCreated"
+	UserActivated     = "UserActivated"
+	UserDeactivated   = "UserDeactivated"
+	UserDeleted       = "UserDeleted"
+	UserRoleChanged   = "UserRoleChanged"
+	UserEmailChanged  = "UserEmailChanged"
+	PasswordChanged   = "PasswordChanged"
+	UserErased        = "UserErased"
+	MembershipChanged = "MembershipChanged"
+	SessionStarted    = "SessionStarted"
+	SessionRevoked    = "SessionRevoked"
+)
+
+// DomainEvent is an entry of the domain_events outbox. Handled lists the
+// subscribers that already processed it and Claims holds short leases so two
+// dispatchers never hand the same event to the same subscriber concurrently.
+type DomainEvent struct {
+	Id           primitive.ObjectID   `json:"_id" bson:"_id"`
+	Type         string               `json:"type" bson:"type"`
+	Aggregate    primitive.ObjectID   `json:"aggregate" bson:"aggregate"`
+	Data         bson.Raw             `json:"-" bson:"data"`
+	Handled      []string             `json:"handled" bson:"handled"`
+	Claims       map[string]time.Time `json:"-" bson:"claims,omitempty"`
+	TsCreated    time.Time            `json:"created_on" bson:"tscreated"`
+	DispatchedAt *time.Time           `json:"dispatched_on,omitempty" bson:"dispatchedat,omitempty"`
+}
+
+// SessionEventData is the payload of session events. It never carries tokens.
+type SessionEventData struct {
+	Session   primitive.ObjectID `json:"session" bson:"session"`
+	User      primitive.ObjectID `json:"user" bson:"user"`
+	UserAgent string             `json:"useragent,omitempty" bson:"useragent,omitempty"`
+}
+
+// EmailChangeEventData is the payload of UserEmailChanged.
+type EmailChangeEventData struct {
+	User          User   `json:"user" bson:"user"`
+	PreviousEmail string `json:"previous_email" bson:"previousemail"`
+	Recovered     bool   `json:"recovered" bson:"recovered"`
+}
+
+// MembershipEventData is the payload of MembershipChanged. Role is empty when
+// the user left the organization, PreviousRole when they joined it.
+type MembershipEventData struct {
+	User         primitive.ObjectID `json:"user" bson:"user"`
+	Organization primitive.ObjectID `json:"organization" bson:"organization"`
+	Role         string             `json:"role,omitempty" bson:"role,omitempty"`
+	PreviousRole string             `json:"previousrole,omitempty" bson:"previousrole,omitempty"`
+}
+
+// RoleChangeEventData is the payload of UserRoleChanged.
+type RoleChangeEventData struct {
+	User         User   `json:"user" bson:"user"`
+	PreviousRole string `json:"previousrole" bson:"previousrole"`
+}
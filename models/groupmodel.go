@@ -0,0 +1,49 @@
+package models
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Permissions a role within an organization grants.
+const (
+	PermUsersRead          = "users:read"
+	PermUsersManage        = "users:manage"
+	PermGroupsManage       = "groups:manage"
+	PermInvitationsManage  = "invitations:manage"
+	PermOrganizationManage = "organization:manage"
+)
+
+// RolePermissions maps organization roles to their permissions. Global admins
+// hold every permission in every organization.
+var RolePermissions = map[string][]string{
+	OrgRoleAdmin:  {PermUsersRead, PermUsersManage, PermGroupsManage, PermInvitationsManage, PermOrganizationManage},
+	OrgRoleMember: {PermUsersRead},
+}
+
+// Group is a team of users within an organization. Members of a subgroup are
+// members of the group too, and every member holds the organization roles
+// the group grants.
+type Group struct {
+	Id           primitive.ObjectID   `json:"_id,omitempty" bson:"_id,omitempty"`
+	Organization primitive.ObjectID   `json:"organization" bson:"organization"`
+	Name         string               `json:"name" bson:"name" validate:"required,max=100"`
+	Description  string               `json:"description,omitempty" bson:"description,omitempty" validate:"max=500"`
+	Members      []primitive.ObjectID `json:"members" bson:"members"`
+	Subgroups    []primitive.ObjectID `json:"subgroups" bson:"subgroups"`
+	Roles        []string             `json:"roles" bson:"roles" validate:"dive,oneof=admin member"`
+	TsCreated    time.Time            `json:"created_on" bson:"tscreated"`
+	TsUpdated    time.Time            `json:"updated_on" bson:"tsupdated"`
+}
+
+// Access is what a user may do in an organization, resolved from their
+// membership and the groups they belong to directly or through subgroups.
+type Access struct {
+	User         primitive.ObjectID `json:"user"`
+	Organization primitive.ObjectID `json:"organization,omitempty"`
+	Role         string             `json:"role,omitempty"`
+	Global       bool               `json:"global"`
+	Groups       []Group            `json:"groups"`
+	Permissions  []string           `json:"permissions"`
+}
@@ -0,0 +1,50 @@
+package models
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// States of an invitation. Expired is never stored, a pending invitation
+// reports it once ExpiresAt has passed.
+const (
+	InvitationPending  = "pending"
+	InvitationAccepted = "accepted"
+	InvitationExpired  = "expired"
+	InvitationRevoked  = "revoked"
+)
+
+// Invitation lets an admin add a user by email. The invitee sets their own
+// password when accepting with the single-use token that was mailed to them.
+type Invitation struct {
+	Id      primitive.ObjectID `json:"_id,omitempty" bson:"_id,omitempty"`
+	Email   string             `json:"email" bson:"email"`
+	Name    string             `json:"name,omitempty" bson:"name,omitempty"`
+	Role    string             `json:"role" bson:"role"`
+	Company string             `json:"company,omitempty" bson:"company,omitempty"`
+	// Organization is joined with OrgRole when the invitation is accepted.
+	Organization primitive.ObjectID  `json:"organization,omitempty" bson:"organization,omitempty"`
+	OrgRole      string              `json:"orgrole,omitempty" bson:"orgrole,omitempty"`
+	Locale       string              `json:"locale,omitempty" bson:"locale,omitempty"`
+	Status       string              `json:"status" bson:"status"`
+	TokenHash    string              `json:"-" bson:"tokenhash"`
+	InvitedBy    string              `json:"invitedby" bson:"invitedby"`
+	Sends        int                 `json:"sends" bson:"sends"`
+	OutboxMail   primitive.ObjectID  `json:"-" bson:"outboxemail,omitempty"`
+	User         *primitive.ObjectID `json:"user,omitempty" bson:"user,omitempty"`
+	ExpiresAt    time.Time           `json:"expires_on" bson:"expiresat"`
+	AcceptedAt   *time.Time          `json:"accepted_on,omitempty" bson:"acceptedat,omitempty"`
+	RevokedAt    *time.Time          `json:"revoked_on,omitempty" bson:"revokedat,omitempty"`
+	TsCreated    time.Time           `json:"created_on" bson:"tscreated"`
+	TsUpdated    time.Time           `json:"updated_on" bson:"tsupdated"`
+}
+
+// CurrentStatus is Status with pending invitations past ExpiresAt reported
+// as expired.
+func (i Invitation) CurrentStatus(now time.Time) string {
+	if i.Status == InvitationPending && !i.ExpiresAt.After(now) {
+		return InvitationExpired
+	}
+	return i.Status
+}
@@ -0,0 +1,31 @@
+package models
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Roles of a user within an organization. Organization admins manage the
+// members of their organization only, unlike users with the global admin role.
+const (
+	OrgRoleAdmin  = "admin"
+	OrgRoleMember = "member"
+)
+
+// Organization is a tenant. Users belong to organizations through their
+// memberships.
+type Organization struct {
+	Id        primitive.ObjectID `json:"_id,omitempty" bson:"_id,omitempty"`
+	Name      string             `json:"name" bson:"name" validate:"required,max=100"`
+	Slug      string             `json:"slug" bson:"slug" validate:"required,max=64"`
+	TsCreated time.Time          `json:"created_on" bson:"tscreated"`
+	TsUpdated time.Time          `json:"updated_on" bson:"tsupdated"`
+}
+
+// Membership places a user in an organization with a role there.
+type Membership struct {
+	Organization primitive.ObjectID `json:"organization" bson:"organization"`
+	Role         string             `json:"role" bson:"role" validate:"oneof=admin member"`
+	TsJoined     time.Time          `json:"joined_on" bson:"tsjoined"`
+}
@@ -0,0 +1,53 @@
+package models
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// States of a data export.
+const (
+	ExportPending = "pending"
+	ExportRunning = "running"
+	ExportReady   = "ready"
+	ExportFailed  = "failed"
+)
+
+// Archive formats of a data export.
+const (
+	ExportJSON = "json"
+	ExportZip  = "zip"
+)
+
+// DataExport is a subject access request. The archive is built in the
+// background and kept in GridFS until ExpiresAt.
+type DataExport struct {
+	Id          primitive.ObjectID `json:"_id,omitempty" bson:"_id,omitempty"`
+	User        primitive.ObjectID `json:"user" bson:"user"`
+	RequestedBy string             `json:"requestedby" bson:"requestedby"`
+	Format      string             `json:"format" bson:"format"`
+	Status      string             `json:"status" bson:"status"`
+	File        primitive.ObjectID `json:"-" bson:"file,omitempty"`
+	FileName    string             `json:"filename,omitempty" bson:"filename,omitempty"`
+	Size        int64              `json:"size,omitempty" bson:"size,omitempty"`
+	Attempts    int                `json:"attempts" bson:"attempts"`
+	LastError   string             `json:"lasterror,omitempty" bson:"lasterror,omitempty"`
+	LockedUntil time.Time          `json:"-" bson:"lockeduntil,omitempty"`
+	TsCreated   time.Time          `json:"created_on" bson:"tscreated"`
+	TsUpdated   time.Time          `json:"updated_on" bson:"tsupdated"`
+	TsReady     *time.Time         `json:"ready_on,omitempty" bson:"tsready,omitempty"`
+	ExpiresAt   *time.Time         `json:"expires_on,omitempty" bson:"expiresat,omitempty"`
+}
+
+// ErasureRecord proves that a user's personal data was erased without
+// keeping it. SubjectDigest is a keyed hash of the erased email address, so
+// a later request about the same address can be matched to the record.
+type ErasureRecord struct {
+	Id            primitive.ObjectID `json:"_id,omitempty" bson:"_id,omitempty"`
+	User          primitive.ObjectID `json:"user" bson:"user"`
+	SubjectDigest string             `json:"subjectdigest" bson:"subjectdigest"`
+	RequestedBy   string             `json:"requestedby" bson:"requestedby"`
+	Counts        map[string]int64   `json:"counts" bson:"counts"`
+	TsErased      time.Time          `json:"erased_on" bson:"tserased"`
+}
@@ -6,24 +6,98 @@ import (
 	"go.mongodb.org/mongo-driver/bson/primitive"
 )
 
+const (
+	RoleSuperAdmin = "superadmin"
+	RoleAdmin      = "admin"
+	RoleUser       = "user"
+)
+
 type User struct {
-	Id        primitive.ObjectID `json:"_id,omitempty" bson:"_id,omitempty"`
-	Name      string             `json:"name,omitempty" validate:"required"`
-	Email     string             `json:"email,omitempty" validate:"required"`
-	Password  string             `json:"-"`
-	Company   string             `json:"company,omitempty"`
-	Role      string             `json:"role"`
-	IsActive  bool               `json:"isactive"`
-	TsCreated time.Time          `json:"created_on"`
-	TsUpdated time.Time          `json:"updated_on"`
+	Id       primitive.ObjectID `json:"_id,omitempty" bson:"_id,omitempty"`
+	Name     string             `json:"name,omitempty" validate:"required"`
+	Email    string             `json:"email,omitempty" validate:"required"`
+	Password string             `json:"-"`
+	// Company is free text kept for display, tenancy comes from Memberships.
+	Company     string         `json:"company,omitempty"`
+	Locale      string         `json:"locale,omitempty"`
+	Timezone    string         `json:"timezone,omitempty" bson:"timezone,omitempty"`
+	Avatar      string         `json:"avatar,omitempty" bson:"avatar,omitempty"`
+	Role        string         `json:"role" validate:"oneof=superadmin admin user"`
+	IsActive    bool           `json:"isactive"`
+	TsCreated   time.Time      `json:"created_on"`
+	TsUpdated   time.Time      `json:"updated_on"`
+	Delivery    *EmailDelivery `json:"emaildelivery,omitempty" bson:"emaildelivery,omitempty"`
+	EmailChange *EmailChange   `json:"emailchange,omitempty" bson:"emailchange,omitempty"`
+	ErasedAt    *time.Time     `json:"erased_on,omitempty" bson:"erasedat,omitempty"`
+	Memberships []Membership   `json:"memberships,omitempty" bson:"memberships,omitempty"`
+}
+
+// MembershipOf returns the user's membership in org, if any.
+func (u User) MembershipOf(org primitive.ObjectID) (Membership, bool) {
+	for _, membership := range u.Memberships {
+		if membership.Organization == org {
+			return membership, true
+		}
+	}
+	return Membership{}, false
+}
+
+// IsGlobalAdmin reports whether the user administers every organization.
+func (u User) IsGlobalAdmin() bool {
+	return u.Role == RoleAdmin || u.Role == RoleSuperAdmin
+}
+
+// EmailDelivery is the latest delivery state reported for a user's address.
+type EmailDelivery struct {
+	LastEvent     string    `json:"lastevent" bson:"lastevent"`
+	Reason        string    `json:"reason,omitempty" bson:"reason,omitempty"`
+	Undeliverable bool      `json:"undeliverable" bson:"undeliverable"`
+	TsUpdated     time.Time `json:"updated_on" bson:"tsupdated"`
+}
+
+// EmailChange tracks a change of a user's address. Until ConfirmedAt is set,
+// NewEmail waits for confirmation. Afterwards OldEmail can be restored with
+// the recovery token until RecoverUntil, and no one else may take it.
+type EmailChange struct {
+	OldEmail     string     `json:"oldemail" bson:"oldemail"`
+	NewEmail     string     `json:"newemail" bson:"newemail"`
+	ConfirmHash  string     `json:"-" bson:"confirmhash"`
+	ConfirmUntil time.Time  `json:"confirm_until" bson:"confirmuntil"`
+	RecoverHash  string     `json:"-" bson:"recoverhash"`
+	RecoverUntil time.Time  `json:"recover_until" bson:"recoveruntil"`
+	ConfirmedAt  *time.Time `json:"confirmed_on,omitempty" bson:"confirmedat,omitempty"`
 }
 
 type UserSession struct {
-	Id           primitive.ObjectID `json:"_id,omitempty" bson:"_id,omitempty"`
-	User         primitive.ObjectID `bson:"user,omitempty"`
-	AccessToken  string             `json:"accesstoken"`
-	RefreshToken string             `json:"refreshtoken"`
-	TsCreated    time.Time          `json:"created_on"`
-	TsUpdated    time.Time          `json:"updated_on"`
-	UserAgent    string             `bson:"useragent,omitempty"`
+	Id          primitive.ObjectID `json:"_id,omitempty" bson:"_id,omitempty"`
+	User        primitive.ObjectID `json:"user,omitempty" bson:"user,omitempty"`
+	Tenant      primitive.ObjectID `json:"tenant,omitempty" bson:"tenant,omitempty"`
+	AccessHash  string             `json:"-" bson:"accesstokenhash" validate:"required"`
+	RefreshHash string             `json:"-" bson:"refreshtokenhash" validate:"required"`
+	TsCreated   time.Time          `json:"created_on"`
+	TsUpdated   time.Time          `json:"updated_on"`
+	TsLastUsed  time.Time          `json:"last_used_on" bson:"tslastused,omitempty"`
+	ExpiresAt   time.Time          `json:"expires_on" bson:"expiresat,omitempty"`
+	IdleExpires time.Time          `json:"idle_expires_on" bson:"idleexpiresat,omitempty"`
+	IdleTimeout int64              `json:"-" bson:"idletimeout,omitempty"`
+	UserAgent   string             `json:"useragent,omitempty" bson:"useragent,omitempty"`
+	IP          string             `json:"ip,omitempty" bson:"ip,omitempty"`
+	Device      *DeviceInfo        `json:"device,omitempty" bson:"device,omitempty"`
+	Current     bool               `json:"current" bson:"-"`
 }
+
+// DeviceInfo is what could be told about a session's client from its user agent.
+type DeviceInfo struct {
+	Type    string `json:"type" bson:"type"`
+	OS      string `json:"os,omitempty" bson:"os,omitempty"`
+	Browser string `json:"browser,omitempty" bson:"browser,omitempty"`
+	Version string `json:"version,omitempty" bson:"version,omitempty"`
+}
+
+const (
+	DeviceDesktop = "desktop"
+	DeviceMobile  = "mobile"
+	DeviceTablet  = "tablet"
+	DeviceBot     = "bot"
+	DeviceOther   = "other"
+)
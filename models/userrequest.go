@@ -0,0 +1,133 @@
+package models
+
+// Request DTOs decoded from client bodies. They are kept separate from User so
+// clients can never set fields such as Id, IsActive or the password hash.
+
+type RegisterRequest struct {
+	Name     string `json:"name" validate:"required,max=100"`
+	Email    string `json:"email" validate:"required,email,max=254"`
+	Password string `json:"password" validate:"required"`
+	Company  string `json:"company" validate:"max=100"`
+	Locale   string `json:"locale" validate:"omitempty,bcp47_language_tag"`
+	// Role may only be user, admins are invited and the superadmin is
+	// created with the CLI.
+	Role string `json:"role" validate:"omitempty,eq=user"`
+}
+
+type CreateAdminRequest struct {
+	Name     string `json:"name" validate:"required,max=100"`
+	Email    string `json:"email" validate:"required,email,max=254"`
+	Password string `json:"password" validate:"required"`
+	Company  string `json:"company" validate:"max=100"`
+	Locale   string `json:"locale" validate:"omitempty,bcp47_language_tag"`
+}
+
+// CreateInvitationRequest invites someone by email. Superadmins are never
+// invited, there is only one and it is created with the CLI.
+type CreateInvitationRequest struct {
+	Email   string `json:"email" validate:"required,email,max=254"`
+	Name    string `json:"name" validate:"max=100"`
+	Role    string `json:"role" validate:"required,oneof=admin user"`
+	Company string `json:"company" validate:"max=100"`
+	Locale  string `json:"locale" validate:"omitempty,bcp47_language_tag"`
+	// Organization defaults to the inviting admin's organization.
+	Organization string `json:"organization" validate:"omitempty,hexadecimal,len=24"`
+	OrgRole      string `json:"orgrole" validate:"omitempty,oneof=admin member"`
+}
+
+type CreateOrganizationRequest struct {
+	Name string `json:"name" validate:"required,max=100"`
+	Slug string `json:"slug" validate:"required,max=64,lowercase,excludesall= /"`
+}
+
+type UpdateOrganizationRequest struct {
+	Name *string `json:"name" validate:"omitempty,min=1,max=100"`
+}
+
+type CreateGroupRequest struct {
+	Name        string   `json:"name" validate:"required,max=100"`
+	Description string   `json:"description" validate:"max=500"`
+	Roles       []string `json:"roles" validate:"omitempty,dive,oneof=admin member"`
+}
+
+type UpdateGroupRequest struct {
+	Name        *string   `json:"name" validate:"omitempty,min=1,max=100"`
+	Description *string   `json:"description" validate:"omitempty,max=500"`
+	Roles       *[]string `json:"roles" validate:"omitempty,dive,oneof=admin member"`
+}
+
+// MembershipRequest adds a user to an organization or changes their role there.
+type MembershipRequest struct {
+	Role string `json:"role" validate:"required,oneof=admin member"`
+}
+
+// AcceptInvitationRequest creates the invited account. Name may be left out
+// when the invitation already has one.
+type AcceptInvitationRequest struct {
+	Token    string `json:"token" validate:"required"`
+	Name     string `json:"name" validate:"max=100"`
+	Password string `json:"password" validate:"required"`
+}
+
+// UpdateUserRequest only changes the fields that are present in the body.
+type UpdateUserRequest struct {
+	Name    *string `json:"name" validate:"omitempty,min=1,max=100"`
+	Company *string `json:"company" validate:"omitempty,max=100"`
+	Locale  *string `json:"locale" validate:"omitempty,bcp47_language_tag"`
+	Role    *string `json:"role" validate:"omitempty,oneof=admin user"`
+}
+
+// UpdateProfileRequest is what users may change about themselves.
+type UpdateProfileRequest struct {
+	Name     *string `json:"name" validate:"omitempty,min=1,max=100"`
+	Company  *string `json:"company" validate:"omitempty,max=100"`
+	Locale   *string `json:"locale" validate:"omitempty,bcp47_language_tag"`
+	Timezone *string `json:"timezone" validate:"omitempty,timezone"`
+	Avatar   *string `json:"avatar" validate:"omitempty,url,startswith=https://,max=2048"`
+}
+
+// PasswordConfirmRequest confirms a destructive action on the own account,
+// such as deactivation or erasure, with the password.
+type PasswordConfirmRequest struct {
+	Password string `json:"password" validate:"required"`
+}
+
+type ChangePasswordRequest struct {
+	CurrentPassword string `json:"current_password" validate:"required"`
+	NewPassword     string `json:"new_password" validate:"required"`
+}
+
+type ChangeEmailRequest struct {
+	Email    string `json:"email" validate:"required,email,max=254"`
+	Password string `json:"password" validate:"required"`
+}
+
+// TokenRequest carries a token from an emailed link.
+type TokenRequest struct {
+	Token string `json:"token" validate:"required"`
+}
+
+type LoginRequest struct {
+	Email    string `json:"email" validate:"required,email"`
+	Password string `json:"password" validate:"required"`
+	// RevokeSession ends one of the user's sessions before logging in, so a
+	// user at the session limit can pick a device to log out.
+	RevokeSession string `json:"revoke_session,omitempty" validate:"omitempty,hexadecimal,len=24"`
+	// Organization picks the tenant the session acts in. It defaults to the
+	// user's only organization.
+	Organization string `json:"organization,omitempty" validate:"omitempty,hexadecimal,len=24"`
+}
+
+type CreateWebhookRequest struct {
+	URL         string   `json:"url" validate:"required,url,startswith=http"`
+	Events      []string `json:"events" validate:"required,min=1,dive,oneof=* user.registered user.activated user.deactivated user.deleted user.role_changed"`
+	Secret      string   `json:"secret" validate:"omitempty,min=16"`
+	Description string   `json:"description" validate:"max=200"`
+}
+
+type UpdateWebhookRequest struct {
+	URL         *string   `json:"url" validate:"omitempty,url,startswith=http"`
+	Events      *[]string `json:"events" validate:"omitempty,min=1,dive,oneof=* user.registered user.activated user.deactivated user.deleted user.role_changed"`
+	Description *string   `json:"description" validate:"omitempty,max=200"`
+	Active      *bool     `json:"active"`
+}
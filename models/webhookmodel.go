@@ -0,0 +1,61 @@
+package models
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// User lifecycle events sent to webhook subscribers.
+const (
+	EventUserRegistered  = "user.registered"
+	EventUserActivated   = "user.activated"
+	EventUserDeactivated = "user.deactivated"
+	EventUserDeleted     = "user.deleted"
+	EventUserRoleChanged = "user.role_changed"
+	EventWebhookTest     = "webhook.test"
+)
+
+// Delivery states of a webhook delivery.
+const (
+	WebhookPending   = "pending"
+	WebhookSending   = "sending"
+	WebhookDelivered = "delivered"
+	WebhookFailed    = "failed"
+)
+
+type WebhookSubscription struct {
+	Id          primitive.ObjectID `json:"_id,omitempty" bson:"_id,omitempty"`
+	URL         string             `json:"url" bson:"url"`
+	Events      []string           `json:"events" bson:"events"`
+	Secret      string             `json:"-" bson:"secret"`
+	Description string             `json:"description,omitempty" bson:"description,omitempty"`
+	Active      bool               `json:"active" bson:"active"`
+	TsCreated   time.Time          `json:"created_on" bson:"tscreated"`
+	TsUpdated   time.Time          `json:"updated_on" bson:"tsupdated"`
+}
+
+// WebhookDelivery is one event queued for one subscription, together with the
+// log of every attempt made to deliver it.
+type WebhookDelivery struct {
+	Id            primitive.ObjectID `json:"_id,omitempty" bson:"_id,omitempty"`
+	Subscription  primitive.ObjectID `json:"subscription" bson:"subscription"`
+	EventId       string             `json:"eventid" bson:"eventid"`
+	EventType     string             `json:"eventtype" bson:"eventtype"`
+	Payload       string             `json:"payload" bson:"payload"`
+	Status        string             `json:"status" bson:"status"`
+	Attempts      int                `json:"attempts" bson:"attempts"`
+	MaxAttempts   int                `json:"maxattempts" bson:"maxattempts"`
+	NextAttemptAt time.Time          `json:"nextattempt_on" bson:"nextattemptat"`
+	LockedUntil   time.Time          `json:"-" bson:"lockeduntil,omitempty"`
+	Log           []WebhookAttempt   `json:"log" bson:"log"`
+	TsCreated     time.Time          `json:"created_on" bson:"tscreated"`
+	TsUpdated     time.Time          `json:"updated_on" bson:"tsupdated"`
+}
+
+type WebhookAttempt struct {
+	At         time.Time `json:"at" bson:"at"`
+	StatusCode int       `json:"statuscode,omitempty" bson:"statuscode,omitempty"`
+	Error      string    `json:"error,omitempty" bson:"error,omitempty"`
+	DurationMs int64     `json:"durationms" bson:"durationms"`
+}
@@ -0,0 +1,192 @@
+package privacy
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"mux-mongo-api/configs"
+	"mux-mongo-api/events"
+	"mux-mongo-api/models"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var ErrAlreadyErased = errors.New("user has already been erased")
+
+// ErasedName replaces the name of erased users.
+const ErasedName = "Erased user"
+
+// Erase removes or pseudonymises the personal data of a user and records an
+// ErasureRecord as proof. The user document stays, anonymised, so references
+// from other collections don't dangle. Sessions, suppressions, invitations
+// and exports are deleted, the user leaves their organizations and groups,
+// audit events and webhook payloads keep only a pseudonym, and emails and
+// delivery events keep their status but lose the address.
+func Erase(ctx context.Context, userId primitive.ObjectID, requestedBy string) (models.ErasureRecord, error) {
+	var record models.ErasureRecord
+	var files []primitive.ObjectID
+	err := configs.WithTransaction(ctx, configs.DB, func(ctx context.Context) error {
+		var user models.User
+		if err := userCollection.FindOne(ctx, bson.M{"_id": userId}).Decode(&user); err != nil {
+			return err
+		}
+		if user.ErasedAt != nil {
+			return ErrAlreadyErased
+		}
+		now := time.Now()
+		pseudonym := "erased-" + userId.Hex()
+		address := pseudonym + "@erased.invalid"
+		counts := map[string]int64{}
+
+		_, err := userCollection.UpdateOne(ctx, bson.M{"_id": userId}, bson.M{
+			"$set":   bson.M{"name": ErasedName, "email": address, "password": "", "isactive": false, "erasedat": now, "tsupdated": now},
+			"$unset": bson.M{"company": "", "locale": "", "timezone": "", "avatar": "", "emaildelivery": "", "emailchange": "", "memberships": ""},
+		})
+		if err != nil {
+			return err
+		}
+
+		deleted, err := userSessionCollection.DeleteMany(ctx, bson.M{"user": userId})
+		if err != nil {
+			return err
+		}
+		counts["sessions"] = deleted.DeletedCount
+
+		var eventIds []string
+		results, err := domainEventCollection.Find(ctx, bson.M{"aggregate": userId}, options.Find().SetProjection(bson.M{"_id": 1}))
+		if err != nil {
+			return err
+		}
+		var domainEvents []models.DomainEvent
+		if err := results.All(ctx, &domainEvents); err != nil {
+			return err
+		}
+		for _, event := range domainEvents {
+			eventIds = append(eventIds, event.Id.Hex())
+		}
+		updated, err := domainEventCollection.UpdateMany(ctx, bson.M{"aggregate": userId},
+			bson.M{"$set": bson.M{"data": bson.M{"pseudonym": pseudonym}}})
+		if err != nil {
+			return err
+		}
+		counts["audit_events"] = updated.ModifiedCount
+		if len(eventIds) > 0 {
+			updated, err = webhookDeliveryCollection.UpdateMany(ctx, bson.M{"eventid": bson.M{"$in": eventIds}},
+				bson.M{"$set": bson.M{"payload": `{"pseudonym":"` + pseudonym + `"}`}})
+			if err != nil {
+				return err
+			}
+			counts["webhook_deliveries"] = updated.ModifiedCount
+		}
+
+		_, err = emailOutboxCollection.UpdateMany(ctx, bson.M{"user": userId, "status": models.EmailPending},
+			bson.M{"$set": bson.M{"status": models.EmailCancelled, "tsupdated": now}})
+		if err != nil {
+			return err
+		}
+		updated, err = emailOutboxCollection.UpdateMany(ctx, bson.M{"user": userId},
+			bson.M{"$set": bson.M{"toname": "", "toaddress": address}, "$unset": bson.M{"data": ""}})
+		if err != nil {
+			return err
+		}
+		counts["emails"] = updated.ModifiedCount
+
+		updated, err = emailEventCollection.UpdateMany(ctx, bson.M{"$or": bson.A{bson.M{"user": userId}, bson.M{"email": user.Email}}},
+			bson.M{"$set": bson.M{"email": address}})
+		if err != nil {
+			return err
+		}
+		counts["email_delivery_events"] = updated.ModifiedCount
+
+		emails := []string{strings.ToLower(user.Email)}
+		if user.EmailChange != nil {
+			emails = append(emails, strings.ToLower(user.EmailChange.OldEmail), strings.ToLower(user.EmailChange.NewEmail))
+		}
+		deleted, err = emailSuppressionCollection.DeleteMany(ctx, bson.M{"_id": bson.M{"$in": emails}})
+		if err != nil {
+			return err
+		}
+		counts["email_suppressions"] = deleted.DeletedCount
+
+		updated, err = groupCollection.UpdateMany(ctx, bson.M{"members": userId}, bson.M{"$pull": bson.M{"members": userId}})
+		if err != nil {
+			return err
+		}
+		counts["group_memberships"] = updated.ModifiedCount
+
+		deleted, err = invitationCollection.DeleteMany(ctx, bson.M{"$or": bson.A{bson.M{"user": userId}, bson.M{"email": bson.M{"$in": emails}}}})
+		if err != nil {
+			return err
+		}
+		counts["invitations"] = deleted.DeletedCount
+
+		var exports []models.DataExport
+		results, err = dataExportCollection.Find(ctx, bson.M{"user": userId})
+		if err != nil {
+			return err
+		}
+		if err := results.All(ctx, &exports); err != nil {
+			return err
+		}
+		files = files[:0]
+		for _, export := range exports {
+			if !export.File.IsZero() {
+				files = append(files, export.File)
+			}
+		}
+		deleted, err = dataExportCollection.DeleteMany(ctx, bson.M{"user": userId})
+		if err != nil {
+			return err
+		}
+		counts["data_exports"] = deleted.DeletedCount
+
+		record = models.ErasureRecord{
+			Id:            primitive.NewObjectID(),
+			User:          userId,
+			SubjectDigest: subjectDigest(user.Email),
+			RequestedBy:   requestedBy,
+			Counts:        counts,
+			TsErased:      now,
+		}
+		if _, err := erasureCollection.InsertOne(ctx, record); err != nil {
+			return err
+		}
+		return events.Record(ctx, models.UserErased, userId, bson.M{"erasure": record.Id})
+	})
+	if err == nil {
+		// GridFS writes can't join the transaction, so the archives go last
+		deleteExportFiles(files)
+	}
+	return record, err
+}
+
+// ListErasures returns the newest proofs of erasure.
+func ListErasures(ctx context.Context, limit int64) ([]models.ErasureRecord, error) {
+	results, err := erasureCollection.Find(ctx, bson.M{}, options.Find().SetSort(bson.M{"tserased": -1}).SetLimit(limit))
+	if err != nil {
+		return nil, err
+	}
+	records := []models.ErasureRecord{}
+	err = results.All(ctx, &records)
+	return records, err
+}
+
+// FindErasure looks up the proof of erasure for an email address.
+func FindErasure(ctx context.Context, email string) (models.ErasureRecord, error) {
+	var record models.ErasureRecord
+	err := erasureCollection.FindOne(ctx, bson.M{"subjectdigest": subjectDigest(email)}).Decode(&record)
+	return record, err
+}
+
+// subjectDigest is the keyed hash of email stored in erasure records.
+func subjectDigest(email string) string {
+	mac := hmac.New(sha256.New, []byte(configs.EnvErasureDigestSecret()))
+	mac.Write([]byte(strings.ToLower(email)))
+	return hex.EncodeToString(mac.Sum(nil))
+}
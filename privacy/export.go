@@ -0,0 +1,341 @@
+package privacy
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"mux-mongo-api/configs"
+	"mux-mongo-api/models"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/gridfs"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var userCollection *mongo.Collection = configs.GetCollection(configs.DB, "users")
+var userSessionCollection *mongo.Collection = configs.GetCollection(configs.DB, "usersession")
+var domainEventCollection *mongo.Collection = configs.GetCollection(configs.DB, "domain_events")
+var emailOutboxCollection *mongo.Collection = configs.GetCollection(configs.DB, "email_outbox")
+var emailEventCollection *mongo.Collection = configs.GetCollection(configs.DB, "email_events")
+var emailSuppressionCollection *mongo.Collection = configs.GetCollection(configs.DB, "email_suppressions")
+var webhookDeliveryCollection *mongo.Collection = configs.GetCollection(configs.DB, "webhook_deliveries")
+var dataExportCollection *mongo.Collection = configs.GetCollection(configs.DB, "data_exports")
+var invitationCollection *mongo.Collection = configs.GetCollection(configs.DB, "invitations")
+var groupCollection *mongo.Collection = configs.GetCollection(configs.DB, "groups")
+var erasureCollection *mongo.Collection = configs.GetCollection(configs.DB, "erasure_records")
+
+const (
+	exportBucket      = "data_exports"
+	exportLease       = 10 * time.Minute
+	exportMaxAttempts = 3
+)
+
+var ErrExportNotReady = errors.New("export is not ready")
+
+func exportFiles() (*gridfs.Bucket, error) {
+	return gridfs.NewBucket(userCollection.Database(), options.GridFSBucket().SetName(exportBucket))
+}
+
+// RequestExport queues an archive of everything held about user. While an
+// export of the user is still queued or being built, that one is returned.
+func RequestExport(ctx context.Context, user primitive.ObjectID, format, requestedBy string) (models.DataExport, error) {
+	var export models.DataExport
+	err := dataExportCollection.FindOne(ctx, bson.M{"user": user, "format": format, "status": bson.M{"$in": bson.A{models.ExportPending, models.ExportRunning}}}).Decode(&export)
+	if !errors.Is(err, mongo.ErrNoDocuments) {
+		return export, err
+	}
+	now := time.Now()
+	export = models.DataExport{
+		Id:          primitive.NewObjectID(),
+		User:        user,
+		RequestedBy: requestedBy,
+		Format:      format,
+		Status:      models.ExportPending,
+		TsCreated:   now,
+		TsUpdated:   now,
+	}
+	_, err = dataExportCollection.InsertOne(ctx, export)
+	return export, err
+}
+
+// ListExports returns the exports of user, newest first.
+func ListExports(ctx context.Context, user primitive.ObjectID) ([]models.DataExport, error) {
+	results, err := dataExportCollection.Find(ctx, bson.M{"user": user}, options.Find().SetSort(bson.M{"tscreated": -1}))
+	if err != nil {
+		return nil, err
+	}
+	exports := []models.DataExport{}
+	err = results.All(ctx, &exports)
+	return exports, err
+}
+
+// OpenExport returns a ready export of user and a reader for its archive.
+func OpenExport(ctx context.Context, user, id primitive.ObjectID) (models.DataExport, io.ReadCloser, error) {
+	var export models.DataExport
+	err := dataExportCollection.FindOne(ctx, bson.M{"_id": id, "user": user}).Decode(&export)
+	if err != nil {
+		return export, nil, err
+	}
+	if export.Status != models.ExportReady {
+		return export, nil, ErrExportNotReady
+	}
+	bucket, err := exportFiles()
+	if err != nil {
+		return export, nil, err
+	}
+	stream, err := bucket.OpenDownloadStream(export.File)
+	return export, stream, err
+}
+
+// RunDataExports builds queued exports and removes expired ones until ctx is
+// cancelled. Like the email outbox, every export is claimed with a lease so
+// several replicas can run it.
+func RunDataExports(ctx context.Context) {
+	_, err := dataExportCollection.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "status", Value: 1}, {Key: "tscreated", Value: 1}}},
+		{Keys: bson.D{{Key: "user", Value: 1}, {Key: "tscreated", Value: -1}}},
+		{Keys: bson.D{{Key: "expiresat", Value: 1}}, Options: options.Index().SetSparse(true)},
+	})
+	if err != nil {
+		log.Println("data exports: creating indexes failed:", err)
+	}
+
+	ticker := time.NewTicker(configs.EnvOutboxPollInterval())
+	defer ticker.Stop()
+	for {
+		for buildNextExport(ctx) {
+		}
+		removeExpiredExports(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func buildNextExport(ctx context.Context) bool {
+	now := time.Now()
+	var export models.DataExport
+	err := dataExportCollection.FindOneAndUpdate(
+		ctx,
+		bson.M{"$or": bson.A{
+			bson.M{"status": models.ExportPending},
+			bson.M{"status": models.ExportRunning, "lockeduntil": bson.M{"$lt": now}},
+		}},
+		bson.M{
+			"$set": bson.M{"status": models.ExportRunning, "lockeduntil": now.Add(exportLease), "tsupdated": now},
+			"$inc": bson.M{"attempts": 1},
+		},
+		options.FindOneAndUpdate().SetSort(bson.M{"tscreated": 1}).SetReturnDocument(options.After),
+	).Decode(&export)
+	if err != nil {
+		if !errors.Is(err, mongo.ErrNoDocuments) && ctx.Err() == nil {
+			log.Println("data exports: claiming export failed:", err)
+		}
+		return false
+	}
+
+	buildCtx, cancel := context.WithTimeout(ctx, exportLease)
+	defer cancel()
+	update := bson.M{"tsupdated": time.Now(), "lockeduntil": time.Time{}}
+	file, name, size, err := buildExport(buildCtx, export)
+	switch {
+	case err == nil:
+		ready := time.Now()
+		update["status"] = models.ExportReady
+		update["file"], update["filename"], update["size"] = file, name, size
+		update["tsready"] = ready
+		update["expiresat"] = ready.Add(configs.EnvExportTTL())
+		update["lasterror"] = ""
+	case export.Attempts >= exportMaxAttempts:
+		update["status"] = models.ExportFailed
+		update["lasterror"] = err.Error()
+		log.Println("data exports: giving up on", export.Id.Hex(), "after", export.Attempts, "attempts:", err)
+	default:
+		update["status"] = models.ExportPending
+		update["lasterror"] = err.Error()
+	}
+	result, err := dataExportCollection.UpdateOne(ctx, bson.M{"_id": export.Id, "status": models.ExportRunning}, bson.M{"$set": update})
+	if err != nil {
+		log.Println("data exports: recording export", export.Id.Hex(), "failed:", err)
+	}
+	if file, ok := update["file"].(primitive.ObjectID); ok && (err != nil || result.MatchedCount == 0) {
+		// the export was erased or taken over while it was being built
+		deleteExportFiles([]primitive.ObjectID{file})
+	}
+	return true
+}
+
+func buildExport(ctx context.Context, export models.DataExport) (primitive.ObjectID, string, int64, error) {
+	sections, err := collect(ctx, export.User)
+	if err != nil {
+		return primitive.NilObjectID, "", 0, err
+	}
+	var archive bytes.Buffer
+	name := "personal-data-" + export.User.Hex() + "-" + export.TsCreated.UTC().Format("20060102") + "." + export.Format
+	if export.Format == models.ExportZip {
+		err = writeZip(&archive, sections, export.TsCreated)
+	} else {
+		err = writeJSON(&archive, sections)
+	}
+	if err != nil {
+		return primitive.NilObjectID, "", 0, err
+	}
+	bucket, err := exportFiles()
+	if err != nil {
+		return primitive.NilObjectID, "", 0, err
+	}
+	size := int64(archive.Len())
+	file, err := bucket.UploadFromStream(name, &archive)
+	return file, name, size, err
+}
+
+func removeExpiredExports(ctx context.Context) {
+	results, err := dataExportCollection.Find(ctx, bson.M{"expiresat": bson.M{"$lt": time.Now()}}, options.Find().SetLimit(100))
+	if err != nil {
+		return
+	}
+	var exports []models.DataExport
+	if err := results.All(ctx, &exports); err != nil {
+		return
+	}
+	for _, export := range exports {
+		if !export.File.IsZero() {
+			deleteExportFiles([]primitive.ObjectID{export.File})
+		}
+		if _, err := dataExportCollection.DeleteOne(ctx, bson.M{"_id": export.Id}); err != nil {
+			log.Println("data exports: removing expired export", export.Id.Hex(), "failed:", err)
+		}
+	}
+}
+
+func deleteExportFiles(files []primitive.ObjectID) {
+	bucket, err := exportFiles()
+	if err != nil {
+		log.Println("data exports: opening bucket failed:", err)
+		return
+	}
+	for _, file := range files {
+		if err := bucket.Delete(file); err != nil && !errors.Is(err, gridfs.ErrFileNotFound) {
+			log.Println("data exports: deleting file", file.Hex(), "failed:", err)
+		}
+	}
+}
+
+type section struct {
+	name string
+	data interface{}
+}
+
+// collect gathers everything stored about a user. Links in queued emails are
+// left out since they carry live tokens.
+func collect(ctx context.Context, userId primitive.ObjectID) ([]section, error) {
+	var user models.User
+	if err := userCollection.FindOne(ctx, bson.M{"_id": userId}).Decode(&user); err != nil {
+		return nil, err
+	}
+
+	sessions := []models.UserSession{}
+	if err := findAll(ctx, userSessionCollection, bson.M{"user": userId}, &sessions); err != nil {
+		return nil, err
+	}
+
+	var domainEvents []models.DomainEvent
+	if err := findAll(ctx, domainEventCollection, bson.M{"aggregate": userId}, &domainEvents); err != nil {
+		return nil, err
+	}
+	type auditEntry struct {
+		Id        primitive.ObjectID `json:"_id"`
+		Type      string             `json:"type"`
+		Data      bson.M             `json:"data"`
+		TsCreated time.Time          `json:"created_on"`
+	}
+	audit := []auditEntry{}
+	for _, event := range domainEvents {
+		entry := auditEntry{Id: event.Id, Type: event.Type, TsCreated: event.TsCreated}
+		if err := bson.Unmarshal(event.Data, &entry.Data); err != nil {
+			return nil, err
+		}
+		delete(entry.Data, "password")
+		audit = append(audit, entry)
+	}
+
+	emails := []models.OutboxEmail{}
+	if err := findAll(ctx, emailOutboxCollection, bson.M{"user": userId}, &emails); err != nil {
+		return nil, err
+	}
+	for i := range emails {
+		delete(emails[i].Data, "Link")
+	}
+
+	emailEvents := []models.EmailEvent{}
+	if err := findAll(ctx, emailEventCollection, bson.M{"$or": bson.A{bson.M{"user": userId}, bson.M{"email": user.Email}}}, &emailEvents); err != nil {
+		return nil, err
+	}
+
+	suppressions := []models.EmailSuppression{}
+	if err := findAll(ctx, emailSuppressionCollection, bson.M{"_id": strings.ToLower(user.Email)}, &suppressions); err != nil {
+		return nil, err
+	}
+
+	return []section{
+		{"profile", user},
+		{"sessions", sessions},
+		{"audit_events", audit},
+		{"emails", emails},
+		{"email_delivery_events", emailEvents},
+		{"email_suppressions", suppressions},
+	}, nil
+}
+
+func findAll(ctx context.Context, collection *mongo.Collection, filter bson.M, results interface{}) error {
+	cursor, err := collection.Find(ctx, filter, options.Find().SetSort(bson.M{"_id": 1}))
+	if err != nil {
+		return err
+	}
+	return cursor.All(ctx, results)
+}
+
+func writeJSON(w io.Writer, sections []section) error {
+	document := map[string]interface{}{"generated_on": time.Now().UTC()}
+	for _, section := range sections {
+		document[section.name] = section.data
+	}
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(document)
+}
+
+func writeZip(w io.Writer, sections []section, created time.Time) error {
+	archive := zip.NewWriter(w)
+	readme, err := archive.CreateHeader(&zip.FileHeader{Name: "README.txt", Method: zip.Deflate, Modified: created})
+	if err != nil {
+		return err
+	}
+	io.WriteString(readme, "This archive contains the personal data we hold about you, generated on "+
+		time.Now().UTC().Format(time.RFC1123)+".\nEach file is a JSON document:\n\n")
+	for _, section := range sections {
+		io.WriteString(readme, "  "+section.name+".json\n")
+	}
+	for _, section := range sections {
+		file, err := archive.CreateHeader(&zip.FileHeader{Name: section.name + ".json", Method: zip.Deflate, Modified: created})
+		if err != nil {
+			return err
+		}
+		encoder := json.NewEncoder(file)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(section.data); err != nil {
+			return err
+		}
+	}
+	return archive.Close()
+}
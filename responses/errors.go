@@ -0,0 +1,152 @@
+package responses
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// ErrorCode is a stable, machine-readable identifier for an API error.
+// Clients should branch on the code rather than on the human readable detail.
+type ErrorCode string
+
+const (
+	CodeInvalidBody        ErrorCode = "INVALID_BODY"
+	CodeBodyTooLarge       ErrorCode = "BODY_TOO_LARGE"
+	CodeValidationFailed   ErrorCode = "VALIDATION_FAILED"
+	CodeInvalidID          ErrorCode = "INVALID_ID"
+	CodeInvalidCredentials ErrorCode = "INVALID_CREDENTIALS"
+	CodeTokenMissing       ErrorCode = "TOKEN_MISSING"
+	CodeTokenInvalid       ErrorCode = "TOKEN_INVALID"
+	CodeTokenExpired       ErrorCode = "TOKEN_EXPIRED"
+	CodeForbidden          ErrorCode = "FORBIDDEN"
+	CodeSignatureInvalid   ErrorCode = "SIGNATURE_INVALID"
+	CodeUserNotFound       ErrorCode = "USER_NOT_FOUND"
+	CodeSessionNotFound    ErrorCode = "SESSION_NOT_FOUND"
+	CodeSessionLimit       ErrorCode = "SESSION_LIMIT"
+	CodeEmailTaken         ErrorCode = "EMAIL_TAKEN"
+	CodeRoleTaken          ErrorCode = "ROLE_TAKEN"
+	CodeEmailUndeliverable ErrorCode = "EMAIL_UNDELIVERABLE"
+	CodeAccountInactive    ErrorCode = "ACCOUNT_INACTIVE"
+	CodeLinkInvalid        ErrorCode = "LINK_INVALID"
+	CodeNotFound           ErrorCode = "NOT_FOUND"
+	CodeConflict           ErrorCode = "CONFLICT"
+	CodeTimeout            ErrorCode = "TIMEOUT"
+	CodeInternal           ErrorCode = "INTERNAL"
+)
+
+// Error is the typed error returned by handlers and middlewares. It carries the
+// HTTP status and code to report, while Err keeps the underlying cause for logs.
+type Error struct {
+	Status int
+	Code   ErrorCode
+	Detail string
+	Fields []FieldError
+	// Extensions are additional members of the problem document.
+	Extensions map[string]interface{}
+	Err        error
+}
+
+// FieldError describes a single request field that failed validation.
+type FieldError struct {
+	Field   string `json:"field"`
+	Rule    string `json:"rule"`
+	Message string `json:"message"`
+}
+
+func (e *Error) Error() string {
+	if e.Err != nil {
+		return string(e.Code) + ": " + e.Detail + ": " + e.Err.Error()
+	}
+	return string(e.Code) + ": " + e.Detail
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+func NewError(status int, code ErrorCode, detail string) *Error {
+	return &Error{Status: status, Code: code, Detail: detail}
+}
+
+// Wrap attaches a cause to a new Error without exposing it to the client.
+func Wrap(err error, status int, code ErrorCode, detail string) *Error {
+	return &Error{Status: status, Code: code, Detail: detail, Err: err}
+}
+
+func ErrInvalidBody(err error) *Error {
+	return Wrap(err, http.StatusBadRequest, CodeInvalidBody, "request body is invalid")
+}
+
+func ErrBodyTooLarge(limit int64) *Error {
+	return NewError(http.StatusRequestEntityTooLarge, CodeBodyTooLarge, "request body must not be larger than "+strconv.FormatInt(limit, 10)+" bytes")
+}
+
+func ErrValidation(fields []FieldError) *Error {
+	return &Error{Status: http.StatusUnprocessableEntity, Code: CodeValidationFailed, Detail: "request failed validation", Fields: fields}
+}
+
+// ErrSessionLimit reports that a login was refused because the user already
+// has max active sessions, listing them so one can be revoked.
+func ErrSessionLimit(max int, sessions interface{}) *Error {
+	return &Error{
+		Status:     http.StatusConflict,
+		Code:       CodeSessionLimit,
+		Detail:     "maximum of " + strconv.Itoa(max) + " active sessions reached, revoke one to log in",
+		Extensions: map[string]interface{}{"max_sessions": max, "sessions": sessions},
+	}
+}
+
+func ErrInvalidID(id string) *Error {
+	return NewError(http.StatusBadRequest, CodeInvalidID, "'"+id+"' is not a valid id")
+}
+
+var (
+	ErrUserNotFound       = NewError(http.StatusNotFound, CodeUserNotFound, "user with given id not found")
+	ErrSessionNotFound    = NewError(http.StatusNotFound, CodeSessionNotFound, "session not found")
+	ErrEmailTaken         = NewError(http.StatusConflict, CodeEmailTaken, "email already exists")
+	ErrRoleTaken          = NewError(http.StatusConflict, CodeRoleTaken, "only one user can hold this role")
+	ErrInvalidCredentials = NewError(http.StatusUnauthorized, CodeInvalidCredentials, "invalid credentials")
+	ErrTokenMissing       = NewError(http.StatusUnauthorized, CodeTokenMissing, "authorization bearer token is missing")
+	ErrTokenInvalid       = NewError(http.StatusUnauthorized, CodeTokenInvalid, "token is invalid")
+	ErrSessionRevoked     = NewError(http.StatusUnauthorized, CodeTokenInvalid, "session has been revoked")
+	ErrSessionExpired     = NewError(http.StatusUnauthorized, CodeTokenExpired, "session has expired")
+	ErrTokenExpired       = NewError(http.StatusUnauthorized, CodeTokenExpired, "token expired")
+	ErrForbidden          = NewError(http.StatusForbidden, CodeForbidden, "you are not allowed to perform this action")
+	ErrLinkInvalid        = NewError(http.StatusBadRequest, CodeLinkInvalid, "link is invalid or has expired")
+	ErrEmailUndeliverable = NewError(http.StatusBadRequest, CodeEmailUndeliverable, "email address is undeliverable")
+	ErrAccountInactive    = NewError(http.StatusForbidden, CodeAccountInactive, "account is not active")
+)
+
+// FromError converts any error into an *Error. Typed errors pass through,
+// driver errors are mapped to the closest HTTP status, and everything else
+// becomes an opaque internal error so raw driver messages never reach clients.
+func FromError(err error) *Error {
+	var appErr *Error
+	if errors.As(err, &appErr) {
+		return appErr
+	}
+	switch {
+	case errors.Is(err, mongo.ErrNoDocuments):
+		return Wrap(err, http.StatusNotFound, CodeNotFound, "resource not found")
+	case mongo.IsDuplicateKeyError(err):
+		return Wrap(err, http.StatusConflict, CodeConflict, "resource already exists")
+	case errors.Is(err, context.DeadlineExceeded), mongo.IsTimeout(err):
+		return Wrap(err, http.StatusGatewayTimeout, CodeTimeout, "the database did not respond in time")
+	case mongo.IsNetworkError(err):
+		return Wrap(err, http.StatusServiceUnavailable, CodeInternal, "the database is unavailable")
+	}
+	return Wrap(err, http.StatusInternalServerError, CodeInternal, "internal server error")
+}
+
+// NotFoundAs maps mongo.ErrNoDocuments to the given typed error and leaves
+// every other error untouched.
+func NotFoundAs(err error, notFound *Error) error {
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return notFound
+	}
+	return err
+}
@@ -0,0 +1,72 @@
+package responses
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+)
+
+const ProblemContentType = "application/problem+json"
+
+// Problem is an RFC 7807 problem details document extended with the error code.
+type Problem struct {
+	Type     string       `json:"type"`
+	Title    string       `json:"title"`
+	Status   int          `json:"status"`
+	Detail   string       `json:"detail,omitempty"`
+	Instance string       `json:"instance,omitempty"`
+	Code     ErrorCode    `json:"code"`
+	Errors   []FieldError `json:"errors,omitempty"`
+
+	Extensions map[string]interface{} `json:"-"`
+}
+
+// MarshalJSON adds the extension members next to the standard ones.
+func (p Problem) MarshalJSON() ([]byte, error) {
+	type problem Problem
+	data, err := json.Marshal(problem(p))
+	if err != nil || len(p.Extensions) == 0 {
+		return data, err
+	}
+	members := map[string]json.RawMessage{}
+	if err := json.Unmarshal(data, &members); err != nil {
+		return nil, err
+	}
+	for key, value := range p.Extensions {
+		if _, ok := members[key]; ok {
+			continue
+		}
+		raw, err := json.Marshal(value)
+		if err != nil {
+			return nil, err
+		}
+		members[key] = raw
+	}
+	return json.Marshal(members)
+}
+
+func NewProblem(e *Error, instance string) Problem {
+	return Problem{
+		Type:       "/errors/" + strings.ToLower(strings.ReplaceAll(string(e.Code), "_", "-")),
+		Title:      http.StatusText(e.Status),
+		Status:     e.Status,
+		Detail:     e.Detail,
+		Instance:   instance,
+		Code:       e.Code,
+		Errors:     e.Fields,
+		Extensions: e.Extensions,
+	}
+}
+
+// WriteError writes err as an application/problem+json response. It is the
+// single place controllers and middlewares report failures through.
+func WriteError(w http.ResponseWriter, r *http.Request, err error) {
+	appErr := FromError(err)
+	if appErr.Err != nil || appErr.Status >= http.StatusInternalServerError {
+		log.Println(r.Method, r.URL.Path, appErr.Error())
+	}
+	w.Header().Set("Content-Type", ProblemContentType)
+	w.WriteHeader(appErr.Status)
+	json.NewEncoder(w).Encode(NewProblem(appErr, r.URL.Path))
+}
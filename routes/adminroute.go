@@ -0,0 +1,62 @@
+package routes
+
+import (
+	"mux-mongo-api/controllers"
+	"net/http"
+
+	"github.com/gorilla/mux"
+)
+
+// admin routes can be used by organization admins, scoped to their
+// organization, as well as by global admins.
+func admin(handler http.HandlerFunc) http.Handler {
+	return middlewareAccess(middlewareAdmin(handler))
+}
+
+// globalAdmin routes concern the whole installation.
+func globalAdmin(handler http.HandlerFunc) http.Handler {
+	return middlewareAccess(middlewareGlobalAdmin(handler))
+}
+
+func AdminRoute(router *mux.Router) {
+	router.Handle("/admin/users/{userId}/sessions", admin(controllers.ListUserSessions)).Methods("GET")
+	router.Handle("/admin/users/{userId}/sessions/{sessionId}", admin(controllers.RevokeUserSession)).Methods("DELETE")
+	router.Handle("/admin/users/{userId}/exports", globalAdmin(controllers.RequestUserExport)).Methods("POST")
+	router.Handle("/admin/users/{userId}/exports", globalAdmin(controllers.ListUserExports)).Methods("GET")
+	router.Handle("/admin/users/{userId}/exports/{exportId}/download", globalAdmin(controllers.DownloadUserExport)).Methods("GET")
+	router.Handle("/admin/users/{userId}/erase", globalAdmin(controllers.EraseUser)).Methods("POST")
+	router.Handle("/admin/erasures", globalAdmin(controllers.ListErasures)).Methods("GET")
+	router.Handle("/admin/organizations", admin(controllers.ListOrganizations)).Methods("GET")
+	router.Handle("/admin/organizations", globalAdmin(controllers.CreateOrganization)).Methods("POST")
+	router.Handle("/admin/organizations/{orgId}", admin(controllers.GetOrganization)).Methods("GET")
+	router.Handle("/admin/organizations/{orgId}", admin(controllers.UpdateOrganization)).Methods("PATCH")
+	router.Handle("/admin/organizations/{orgId}/members", admin(controllers.ListMembers)).Methods("GET")
+	router.Handle("/admin/organizations/{orgId}/members/{userId}", admin(controllers.SetMember)).Methods("PUT")
+	router.Handle("/admin/organizations/{orgId}/members/{userId}", admin(controllers.RemoveMember)).Methods("DELETE")
+	router.Handle("/admin/users/{userId}/access", admin(controllers.GetUserAccess)).Methods("GET")
+	router.Handle("/admin/groups", admin(controllers.ListGroups)).Methods("GET")
+	router.Handle("/admin/groups", admin(controllers.CreateGroup)).Methods("POST")
+	router.Handle("/admin/groups/{groupId}", admin(controllers.GetGroup)).Methods("GET")
+	router.Handle("/admin/groups/{groupId}", admin(controllers.UpdateGroup)).Methods("PATCH")
+	router.Handle("/admin/groups/{groupId}", admin(controllers.DeleteGroup)).Methods("DELETE")
+	router.Handle("/admin/groups/{groupId}/members/{userId}", admin(controllers.AddGroupMember)).Methods("PUT")
+	router.Handle("/admin/groups/{groupId}/members/{userId}", admin(controllers.RemoveGroupMember)).Methods("DELETE")
+	router.Handle("/admin/groups/{groupId}/subgroups/{subgroupId}", admin(controllers.AddSubgroup)).Methods("PUT")
+	router.Handle("/admin/groups/{groupId}/subgroups/{subgroupId}", admin(controllers.RemoveSubgroup)).Methods("DELETE")
+	router.Handle("/admin/invitations", admin(controllers.ListInvitations)).Methods("GET")
+	router.Handle("/admin/invitations", admin(controllers.CreateInvitation)).Methods("POST")
+	router.Handle("/admin/invitations/{invitationId}/resend", admin(controllers.ResendInvitation)).Methods("POST")
+	router.Handle("/admin/invitations/{invitationId}", admin(controllers.RevokeInvitation)).Methods("DELETE")
+	router.Handle("/admin/peppers", globalAdmin(controllers.PepperReport)).Methods("GET")
+	router.Handle("/admin/email-templates", globalAdmin(controllers.ListEmailTemplates)).Methods("GET")
+	router.Handle("/admin/email-templates/{kind}/preview", globalAdmin(controllers.PreviewEmailTemplate)).Methods("GET")
+	router.Handle("/admin/email-outbox", globalAdmin(controllers.ListOutboxEmails)).Methods("GET")
+	router.Handle("/admin/email-outbox/{emailId}/retry", globalAdmin(controllers.RetryOutboxEmail)).Methods("POST")
+	router.Handle("/admin/email-outbox/{emailId}/cancel", globalAdmin(controllers.CancelOutboxEmail)).Methods("POST")
+	router.Handle("/admin/webhooks", globalAdmin(controllers.ListWebhooks)).Methods("GET")
+	router.Handle("/admin/webhooks", globalAdmin(controllers.CreateWebhook)).Methods("POST")
+	router.Handle("/admin/webhooks/{webhookId}", globalAdmin(controllers.UpdateWebhook)).Methods("PATCH")
+	router.Handle("/admin/webhooks/{webhookId}", globalAdmin(controllers.DeleteWebhook)).Methods("DELETE")
+	router.Handle("/admin/webhooks/{webhookId}/test", globalAdmin(controllers.TestWebhook)).Methods("POST")
+	router.Handle("/admin/webhooks/{webhookId}/deliveries", globalAdmin(controllers.ListWebhookDeliveries)).Methods("GET")
+}
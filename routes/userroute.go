@@ -2,7 +2,7 @@ package routes
 
 import (
 	"context"
-	"encoding/json"
+	"errors"
 	"mux-mongo-api/controllers"
 	"mux-mongo-api/helpers"
 	"mux-mongo-api/responses"
@@ -10,24 +10,37 @@ import (
 	"strings"
 
 	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 )
 
+// tokenError maps a token validation failure to the error reported to clients.
+func tokenError(err error) *responses.Error {
+	if errors.Is(err, helpers.ErrTokenExpired) {
+		return responses.ErrTokenExpired
+	}
+	return responses.Wrap(err, http.StatusUnauthorized, responses.CodeTokenInvalid, "token is invalid")
+}
+
 func middlewareAccess(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		authHeader := strings.Split(r.Header.Get("Authorization"), "Bearer ")
 		if len(authHeader) != 2 {
-			w.WriteHeader(http.StatusUnauthorized)
-			response := responses.UserResponse{Status: http.StatusUnauthorized, Message: "error", Data: map[string]interface{}{"data": "Invalid Token"}}
-			json.NewEncoder(w).Encode(response)
+			responses.WriteError(w, r, responses.ErrTokenMissing)
 			return
 		}
-		user_id, err := helpers.ValidateAccessToken(authHeader[1])
+		claims, err := helpers.ValidateAccessToken(authHeader[1])
 		if err != nil {
-			w.WriteHeader(http.StatusUnauthorized)
-			response := responses.UserResponse{Status: http.StatusUnauthorized, Message: "error", Data: map[string]interface{}{"data": "Token Expired"}}
-			json.NewEncoder(w).Encode(response)
+			responses.WriteError(w, r, tokenError(err))
+			return
 		}
-		ctx := context.WithValue(r.Context(), "user-id", user_id)
+		session, err := controllers.AuthenticateSession(r.Context(), claims, authHeader[1])
+		if err != nil {
+			responses.WriteError(w, r, err)
+			return
+		}
+		ctx := context.WithValue(r.Context(), "user-id", claims.UserId)
+		ctx = context.WithValue(ctx, "session-id", session.Id)
+		ctx = context.WithValue(ctx, "tenant-id", session.Tenant)
 		next.ServeHTTP(w, r.WithContext(ctx))
 	})
 }
@@ -36,30 +49,88 @@ func middlewareRefresh(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		authHeader := strings.Split(r.Header.Get("Authorization"), "Bearer ")
 		if len(authHeader) != 2 {
-			w.WriteHeader(http.StatusUnauthorized)
-			response := responses.UserResponse{Status: http.StatusUnauthorized, Message: "error", Data: map[string]interface{}{"data": "Invalid Token"}}
-			json.NewEncoder(w).Encode(response)
+			responses.WriteError(w, r, responses.ErrTokenMissing)
+			return
+		}
+		claims, err := helpers.ValidateRefreshToken(authHeader[1])
+		if err != nil {
+			responses.WriteError(w, r, tokenError(err))
 			return
 		}
-		user_id, err := helpers.ValidateRefreshToken(authHeader[1])
+		session, err := controllers.AuthenticateRefresh(r.Context(), claims, authHeader[1])
 		if err != nil {
-			w.WriteHeader(http.StatusUnauthorized)
-			response := responses.UserResponse{Status: http.StatusUnauthorized, Message: "error", Data: map[string]interface{}{"data": "Token Expired"}}
-			json.NewEncoder(w).Encode(response)
+			responses.WriteError(w, r, err)
+			return
 		}
-		ctx := context.WithValue(r.Context(), "user-id", user_id)
+		ctx := context.WithValue(r.Context(), "user-id", claims.UserId)
+		ctx = context.WithValue(ctx, "session-id", session.Id)
+		ctx = context.WithValue(ctx, "tenant-id", session.Tenant)
 		next.ServeHTTP(w, r.WithContext(ctx))
 	})
 }
 
+// middlewareAdmin must run after middlewareAccess and only lets global admins
+// and admins of the session's organization through.
+func middlewareAdmin(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		email, _ := r.Context().Value("user-id").(string)
+		tenant, _ := r.Context().Value("tenant-id").(primitive.ObjectID)
+		admin, err := controllers.IsAdmin(r.Context(), email, tenant)
+		if err != nil {
+			responses.WriteError(w, r, err)
+			return
+		}
+		if !admin {
+			responses.WriteError(w, r, responses.ErrForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// middlewareGlobalAdmin must run after middlewareAccess and only lets global
+// admins through, for APIs that concern the whole installation.
+func middlewareGlobalAdmin(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		email, _ := r.Context().Value("user-id").(string)
+		admin, err := controllers.IsGlobalAdmin(r.Context(), email)
+		if err != nil {
+			responses.WriteError(w, r, err)
+			return
+		}
+		if !admin {
+			responses.WriteError(w, r, responses.ErrForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
 func UserRoute(router *mux.Router) {
 	router.HandleFunc("/user/register", controllers.Register).Methods("POST")
-	router.HandleFunc("/user/{userId}", controllers.GetUser).Methods("GET")
-	router.HandleFunc("/user/", controllers.GetAllUser).Methods("GET")
+	router.Handle("/user/me", middlewareAccess(http.HandlerFunc(controllers.GetMe))).Methods("GET")
+	router.Handle("/user/me", middlewareAccess(http.HandlerFunc(controllers.UpdateMe))).Methods("PATCH")
+	router.Handle("/user/me", middlewareAccess(http.HandlerFunc(controllers.DeleteMe))).Methods("DELETE")
+	router.Handle("/user/me/password", middlewareAccess(http.HandlerFunc(controllers.ChangePassword))).Methods("POST")
+	router.Handle("/user/me/email", middlewareAccess(http.HandlerFunc(controllers.RequestEmailChange))).Methods("POST")
+	router.HandleFunc("/user/email/confirm", controllers.ConfirmEmailChange).Methods("POST")
+	router.HandleFunc("/user/email/recover", controllers.RecoverEmail).Methods("POST")
+	router.HandleFunc("/user/invitations/accept", controllers.AcceptInvitation).Methods("POST")
+	router.Handle("/user/me/exports", middlewareAccess(http.HandlerFunc(controllers.RequestMyExport))).Methods("POST")
+	router.Handle("/user/me/exports", middlewareAccess(http.HandlerFunc(controllers.ListMyExports))).Methods("GET")
+	router.Handle("/user/me/exports/{exportId}/download", middlewareAccess(http.HandlerFunc(controllers.DownloadMyExport))).Methods("GET")
+	router.Handle("/user/me/erase", middlewareAccess(http.HandlerFunc(controllers.EraseMe))).Methods("POST")
+	router.Handle("/user/me/access", middlewareAccess(http.HandlerFunc(controllers.GetMyAccess))).Methods("GET")
+	router.Handle("/user/me/organizations", middlewareAccess(http.HandlerFunc(controllers.ListMyOrganizations))).Methods("GET")
+	router.Handle("/user/me/sessions", middlewareAccess(http.HandlerFunc(controllers.ListMySessions))).Methods("GET")
+	router.Handle("/user/me/sessions/{sessionId}", middlewareAccess(http.HandlerFunc(controllers.RevokeMySession))).Methods("DELETE")
+	router.Handle("/user/{userId}", middlewareAccess(http.HandlerFunc(controllers.GetUser))).Methods("GET")
+	router.Handle("/user/", middlewareAccess(http.HandlerFunc(controllers.GetAllUser))).Methods("GET")
+	router.Handle("/user/{userId}", middlewareAccess(http.HandlerFunc(controllers.UpdateUser))).Methods("PATCH")
 	router.Handle("/user/{userId}", middlewareAccess(http.HandlerFunc(controllers.DeleteUser))).Methods("DELETE")
 	// router.HandleFunc("/user/{userId}", controllers.DeleteUser).Methods("DELETE")
-	router.HandleFunc("/user/activate/{userId}", controllers.ActivateUser).Methods("POST")
+	router.Handle("/user/activate/{userId}", middlewareAccess(middlewareAdmin(http.HandlerFunc(controllers.ActivateUser)))).Methods("POST")
 	router.HandleFunc("/user/login", controllers.LoginUser).Methods("POST")
-	router.Handle("/user/create", middlewareAccess(http.HandlerFunc(controllers.CreateAdmin))).Methods("POST")
+	router.Handle("/user/create", middlewareAccess(middlewareGlobalAdmin(http.HandlerFunc(controllers.CreateAdmin)))).Methods("POST")
 	router.Handle("/user/refresh", middlewareRefresh(http.HandlerFunc(controllers.RefreshToken))).Methods("POST")
 }
@@ -0,0 +1,11 @@
+package routes
+
+import (
+	"mux-mongo-api/controllers"
+
+	"github.com/gorilla/mux"
+)
+
+func WebhookRoute(router *mux.Router) {
+	router.HandleFunc("/webhooks/sendgrid", controllers.SendGridWebhook).Methods("POST")
+}
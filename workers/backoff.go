@@ -0,0 +1,19 @@
+package workers
+
+import (
+	"math/rand"
+	"time"
+)
+
+// backoff doubles base with every attempt up to max and adds up to 20% jitter
+// so failed jobs don't all retry at the same moment.
+func backoff(attempts int, base, max time.Duration) time.Duration {
+	delay := base
+	for i := 1; i < attempts && delay < max; i++ {
+		delay *= 2
+	}
+	if delay > max {
+		delay = max
+	}
+	return delay + time.Duration(rand.Int63n(int64(delay)/5+1))
+}
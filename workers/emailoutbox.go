@@ -0,0 +1,245 @@
+package workers
+
+import (
+	"context"
+	"errors"
+	"log"
+	"mux-mongo-api/configs"
+	"mux-mongo-api/helpers"
+	"mux-mongo-api/models"
+	"net/mail"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var emailOutboxCollection *mongo.Collection = configs.GetCollection(configs.DB, "email_outbox")
+
+var ErrOutboxStateConflict = errors.New("email is not in a state that allows this operation")
+
+// sealedMailData are the template data keys holding secrets, like links with
+// tokens. They are stored encrypted and never listed.
+var sealedMailData = []string{"Link"}
+
+const (
+	outboxBaseBackoff = 30 * time.Second
+	outboxMaxBackoff  = 6 * time.Hour
+	outboxLease       = 2 * time.Minute
+)
+
+// EnqueueEmail stores an email in the outbox for the background worker to
+// deliver. Enqueueing the same idempotency key twice keeps the first email,
+// so handlers can safely retry.
+func EnqueueEmail(ctx context.Context, key string, user primitive.ObjectID, to mail.Address, locale, kind string, data helpers.MailData) (primitive.ObjectID, error) {
+	data, err := sealMailData(data)
+	if err != nil {
+		return primitive.NilObjectID, err
+	}
+	now := time.Now()
+	email := models.OutboxEmail{
+		Id:             primitive.NewObjectID(),
+		IdempotencyKey: key,
+		User:           user,
+		Kind:           kind,
+		Locale:         locale,
+		ToName:         to.Name,
+		ToAddress:      to.Address,
+		Data:           data,
+		Status:         models.EmailPending,
+		MaxAttempts:    configs.EnvOutboxMaxAttempts(),
+		NextAttemptAt:  now,
+		TsCreated:      now,
+		TsUpdated:      now,
+	}
+	var stored models.OutboxEmail
+	err = emailOutboxCollection.FindOneAndUpdate(
+		ctx,
+		bson.M{"idempotencykey": key},
+		bson.M{"$setOnInsert": email},
+		options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After),
+	).Decode(&stored)
+	if mongo.IsDuplicateKeyError(err) {
+		// lost an upsert race against the same key, the other insert wins
+		err = emailOutboxCollection.FindOne(ctx, bson.M{"idempotencykey": key}).Decode(&stored)
+	}
+	return stored.Id, err
+}
+
+// RunEmailOutbox delivers due emails until ctx is cancelled. Several replicas
+// can run it at once since every email is claimed with a lease first.
+func RunEmailOutbox(ctx context.Context) {
+	_, err := emailOutboxCollection.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "idempotencykey", Value: 1}}, Options: options.Index().SetUnique(true)},
+		{Keys: bson.D{{Key: "status", Value: 1}, {Key: "nextattemptat", Value: 1}}},
+	})
+	if err != nil {
+		log.Println("email outbox: creating indexes failed:", err)
+	}
+
+	ticker := time.NewTicker(configs.EnvOutboxPollInterval())
+	defer ticker.Stop()
+	for {
+		for deliverNextEmail(ctx) {
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// deliverNextEmail claims and sends a single due email. It reports whether an
+// email was processed so the caller can drain the queue before sleeping.
+func deliverNextEmail(ctx context.Context) bool {
+	now := time.Now()
+	var email models.OutboxEmail
+	err := emailOutboxCollection.FindOneAndUpdate(
+		ctx,
+		bson.M{"$or": bson.A{
+			bson.M{"status": models.EmailPending, "nextattemptat": bson.M{"$lte": now}},
+			// a worker died while sending, its lease ran out
+			bson.M{"status": models.EmailSending, "lockeduntil": bson.M{"$lt": now}},
+		}},
+		bson.M{
+			"$set": bson.M{"status": models.EmailSending, "lockeduntil": now.Add(outboxLease), "tsupdated": now},
+			"$inc": bson.M{"attempts": 1},
+		},
+		options.FindOneAndUpdate().SetSort(bson.M{"nextattemptat": 1}).SetReturnDocument(options.After),
+	).Decode(&email)
+	if err != nil {
+		if !errors.Is(err, mongo.ErrNoDocuments) && ctx.Err() == nil {
+			log.Println("email outbox: claiming email failed:", err)
+		}
+		return false
+	}
+
+	sendCtx, cancel := context.WithTimeout(ctx, time.Minute)
+	defer cancel()
+	to := mail.Address{Name: email.ToName, Address: email.ToAddress}
+	data, err := openMailData(email.Data)
+	if err == nil {
+		err = helpers.SendTemplatedEmail(sendCtx, to, email.Locale, email.Kind, data)
+	}
+
+	update := bson.M{"tsupdated": time.Now(), "lockeduntil": time.Time{}}
+	switch {
+	case err == nil:
+		update["status"] = models.EmailSent
+		update["tssent"] = time.Now()
+		update["lasterror"] = ""
+	case errors.Is(err, helpers.ErrUnknownMailTemplate), errors.Is(err, helpers.ErrSuppressed), email.Attempts >= email.MaxAttempts:
+		update["status"] = models.EmailDead
+		update["lasterror"] = err.Error()
+		log.Println("email outbox: giving up on", email.Id.Hex(), "after", email.Attempts, "attempts:", err)
+	default:
+		update["status"] = models.EmailPending
+		update["lasterror"] = err.Error()
+		update["nextattemptat"] = time.Now().Add(backoff(email.Attempts, outboxBaseBackoff, outboxMaxBackoff))
+	}
+	_, err = emailOutboxCollection.UpdateOne(ctx, bson.M{"_id": email.Id, "status": models.EmailSending}, bson.M{"$set": update})
+	if err != nil {
+		log.Println("email outbox: recording delivery of", email.Id.Hex(), "failed:", err)
+	}
+	return true
+}
+
+// ListOutboxEmails returns the newest emails, optionally only one status.
+func ListOutboxEmails(ctx context.Context, status string, limit int64) ([]models.OutboxEmail, error) {
+	filter := bson.M{}
+	if status != "" {
+		filter["status"] = status
+	}
+	results, err := emailOutboxCollection.Find(ctx, filter, options.Find().SetSort(bson.M{"tscreated": -1}).SetLimit(limit))
+	if err != nil {
+		return nil, err
+	}
+	emails := []models.OutboxEmail{}
+	err = results.All(ctx, &emails)
+	for i := range emails {
+		redactMailData(&emails[i])
+	}
+	return emails, err
+}
+
+// RetryOutboxEmail puts a dead, cancelled or waiting email back at the front of
+// the queue with a fresh attempt budget.
+func RetryOutboxEmail(ctx context.Context, id primitive.ObjectID) (models.OutboxEmail, error) {
+	return updateOutboxState(ctx, id,
+		[]string{models.EmailDead, models.EmailCancelled, models.EmailPending},
+		bson.M{"status": models.EmailPending, "attempts": 0, "nextattemptat": time.Now(), "tsupdated": time.Now()},
+	)
+}
+
+// CancelOutboxEmail stops an email that has not been sent yet.
+func CancelOutboxEmail(ctx context.Context, id primitive.ObjectID) (models.OutboxEmail, error) {
+	return updateOutboxState(ctx, id,
+		[]string{models.EmailPending, models.EmailDead},
+		bson.M{"status": models.EmailCancelled, "tsupdated": time.Now()},
+	)
+}
+
+func updateOutboxState(ctx context.Context, id primitive.ObjectID, from []string, set bson.M) (models.OutboxEmail, error) {
+	var email models.OutboxEmail
+	err := emailOutboxCollection.FindOneAndUpdate(
+		ctx,
+		bson.M{"_id": id, "status": bson.M{"$in": from}},
+		bson.M{"$set": set},
+		options.FindOneAndUpdate().SetReturnDocument(options.After),
+	).Decode(&email)
+	redactMailData(&email)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		if count, _ := emailOutboxCollection.CountDocuments(ctx, bson.M{"_id": id}); count > 0 {
+			return email, ErrOutboxStateConflict
+		}
+	}
+	return email, err
+}
+
+// sealMailData returns a copy of data with the secret values encrypted.
+func sealMailData(data helpers.MailData) (helpers.MailData, error) {
+	sealed := helpers.MailData{}
+	for key, value := range data {
+		sealed[key] = value
+	}
+	for _, key := range sealedMailData {
+		value, ok := sealed[key].(string)
+		if !ok {
+			continue
+		}
+		var err error
+		if sealed[key], err = helpers.Seal(value); err != nil {
+			return nil, err
+		}
+	}
+	return sealed, nil
+}
+
+// openMailData decrypts the secret values sealMailData encrypted.
+func openMailData(data map[string]interface{}) (helpers.MailData, error) {
+	opened := helpers.MailData{}
+	for key, value := range data {
+		opened[key] = value
+	}
+	for _, key := range sealedMailData {
+		value, ok := opened[key].(string)
+		if !ok {
+			continue
+		}
+		var err error
+		if opened[key], err = helpers.Open(value); err != nil {
+			return nil, err
+		}
+	}
+	return opened, nil
+}
+
+// redactMailData drops the secret values of an email before it is shown.
+func redactMailData(email *models.OutboxEmail) {
+	for _, key := range sealedMailData {
+		delete(email.Data, key)
+	}
+}
@@ -0,0 +1,301 @@
+package workers
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mux-mongo-api/configs"
+	"mux-mongo-api/models"
+	"net/http"
+	"strconv"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var webhookSubscriptionCollection *mongo.Collection = configs.GetCollection(configs.DB, "webhook_subscriptions")
+var webhookDeliveryCollection *mongo.Collection = configs.GetCollection(configs.DB, "webhook_deliveries")
+
+// Headers sent with every webhook request. The signature is the hex HMAC-SHA256
+// of "<timestamp>.<body>" keyed with the subscription secret, so receivers can
+// verify the sender and reject replays of old timestamps.
+const (
+	WebhookIdHeader        = "X-Webhook-Id"
+	WebhookEventHeader     = "X-Webhook-Event"
+	WebhookTimestampHeader = "X-Webhook-Timestamp"
+	WebhookSignatureHeader = "X-Webhook-Signature"
+)
+
+const (
+	webhookMaxAttempts = 10
+	webhookBaseBackoff = 15 * time.Second
+	webhookMaxBackoff  = 6 * time.Hour
+	webhookLease       = time.Minute
+	webhookLogLimit    = 20
+)
+
+var webhookClient = &http.Client{Timeout: 10 * time.Second}
+
+// WebhookEvent is the JSON body posted to subscribers.
+type WebhookEvent struct {
+	Id      string      `json:"id"`
+	Type    string      `json:"type"`
+	Created time.Time   `json:"created"`
+	Data    interface{} `json:"data"`
+}
+
+// WebhookSubscriber forwards user domain events to webhook subscriptions.
+type WebhookSubscriber struct{}
+
+func (WebhookSubscriber) Name() string { return "webhooks" }
+
+func (WebhookSubscriber) Handle(ctx context.Context, event models.DomainEvent) error {
+	var eventType string
+	var data interface{}
+	switch event.Type {
+	case models.UserCreated, models.UserActivated, models.UserDeactivated, models.UserDeleted:
+		var user models.User
+		if err := bson.Unmarshal(event.Data, &user); err != nil {
+			return err
+		}
+		eventType = map[string]string{
+			models.UserCreated:     models.EventUserRegistered,
+			models.UserActivated:   models.EventUserActivated,
+			models.UserDeactivated: models.EventUserDeactivated,
+			models.UserDeleted:     models.EventUserDeleted,
+		}[event.Type]
+		data = user
+	case models.UserRoleChanged:
+		var change models.RoleChangeEventData
+		if err := bson.Unmarshal(event.Data, &change); err != nil {
+			return err
+		}
+		eventType, data = models.EventUserRoleChanged, change
+	default:
+		return nil
+	}
+	return EmitWebhookEvent(ctx, event.Id.Hex(), eventType, data)
+}
+
+// EmitWebhookEvent queues eventType for every active subscription listening to
+// it. Delivery happens in the background, so emitting never blocks on a slow
+// subscriber. Emitting the same event id twice queues it only once.
+func EmitWebhookEvent(ctx context.Context, eventId, eventType string, data interface{}) error {
+	results, err := webhookSubscriptionCollection.Find(ctx, bson.M{"active": true, "events": bson.M{"$in": bson.A{eventType, "*"}}})
+	if err != nil {
+		return err
+	}
+	var subscriptions []models.WebhookSubscription
+	if err = results.All(ctx, &subscriptions); err != nil {
+		return err
+	}
+	if len(subscriptions) == 0 {
+		return nil
+	}
+
+	event := WebhookEvent{Id: eventId, Type: eventType, Created: time.Now().UTC(), Data: data}
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	deliveries := make([]interface{}, 0, len(subscriptions))
+	for _, subscription := range subscriptions {
+		deliveries = append(deliveries, newWebhookDelivery(subscription.Id, event, payload))
+	}
+	_, err = webhookDeliveryCollection.InsertMany(ctx, deliveries, options.InsertMany().SetOrdered(false))
+	if mongo.IsDuplicateKeyError(err) {
+		return nil
+	}
+	return err
+}
+
+func newWebhookDelivery(subscription primitive.ObjectID, event WebhookEvent, payload []byte) models.WebhookDelivery {
+	now := time.Now()
+	return models.WebhookDelivery{
+		Id:            primitive.NewObjectID(),
+		Subscription:  subscription,
+		EventId:       event.Id,
+		EventType:     event.Type,
+		Payload:       string(payload),
+		Status:        models.WebhookPending,
+		MaxAttempts:   webhookMaxAttempts,
+		NextAttemptAt: now,
+		Log:           []models.WebhookAttempt{},
+		TsCreated:     now,
+		TsUpdated:     now,
+	}
+}
+
+// SendTestWebhook delivers a webhook.test event to subscription right away and
+// returns the logged delivery. Failed test deliveries are not retried.
+func SendTestWebhook(ctx context.Context, subscription models.WebhookSubscription) (models.WebhookDelivery, error) {
+	event := WebhookEvent{
+		Id:      primitive.NewObjectID().Hex(),
+		Type:    models.EventWebhookTest,
+		Created: time.Now().UTC(),
+		Data:    map[string]interface{}{"message": "this is a test event"},
+	}
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return models.WebhookDelivery{}, err
+	}
+	delivery := newWebhookDelivery(subscription.Id, event, payload)
+	delivery.MaxAttempts = 1
+	delivery.Status = models.WebhookSending
+	delivery.Attempts = 1
+	delivery.LockedUntil = time.Now().Add(webhookLease)
+	if _, err = webhookDeliveryCollection.InsertOne(ctx, delivery); err != nil {
+		return delivery, err
+	}
+	return deliverWebhook(ctx, delivery, subscription)
+}
+
+// RunWebhookDeliveries delivers due webhooks until ctx is cancelled.
+func RunWebhookDeliveries(ctx context.Context) {
+	_, err := webhookDeliveryCollection.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "status", Value: 1}, {Key: "nextattemptat", Value: 1}}},
+		{Keys: bson.D{{Key: "subscription", Value: 1}, {Key: "tscreated", Value: -1}}},
+		{Keys: bson.D{{Key: "subscription", Value: 1}, {Key: "eventid", Value: 1}}, Options: options.Index().SetUnique(true)},
+	})
+	if err != nil {
+		log.Println("webhooks: creating indexes failed:", err)
+	}
+
+	ticker := time.NewTicker(configs.EnvOutboxPollInterval())
+	defer ticker.Stop()
+	for {
+		for deliverNextWebhook(ctx) {
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func deliverNextWebhook(ctx context.Context) bool {
+	now := time.Now()
+	var delivery models.WebhookDelivery
+	err := webhookDeliveryCollection.FindOneAndUpdate(
+		ctx,
+		bson.M{"$or": bson.A{
+			bson.M{"status": models.WebhookPending, "nextattemptat": bson.M{"$lte": now}},
+			bson.M{"status": models.WebhookSending, "lockeduntil": bson.M{"$lt": now}},
+		}},
+		bson.M{
+			"$set": bson.M{"status": models.WebhookSending, "lockeduntil": now.Add(webhookLease), "tsupdated": now},
+			"$inc": bson.M{"attempts": 1},
+		},
+		options.FindOneAndUpdate().SetSort(bson.M{"nextattemptat": 1}).SetReturnDocument(options.After),
+	).Decode(&delivery)
+	if err != nil {
+		if !errors.Is(err, mongo.ErrNoDocuments) && ctx.Err() == nil {
+			log.Println("webhooks: claiming delivery failed:", err)
+		}
+		return false
+	}
+
+	var subscription models.WebhookSubscription
+	err = webhookSubscriptionCollection.FindOne(ctx, bson.M{"_id": delivery.Subscription}).Decode(&subscription)
+	if err != nil || !subscription.Active {
+		// the subscription was removed or paused after the event was queued
+		delivery.MaxAttempts = delivery.Attempts
+	}
+	if _, err := deliverWebhook(ctx, delivery, subscription); err != nil {
+		log.Println("webhooks: recording delivery", delivery.Id.Hex(), "failed:", err)
+	}
+	return true
+}
+
+// deliverWebhook makes one attempt at posting delivery and records the outcome.
+func deliverWebhook(ctx context.Context, delivery models.WebhookDelivery, subscription models.WebhookSubscription) (models.WebhookDelivery, error) {
+	attempt := models.WebhookAttempt{At: time.Now()}
+	if subscription.Id.IsZero() || !subscription.Active {
+		attempt.Error = "subscription is missing or inactive"
+	} else {
+		attempt.StatusCode, attempt.Error = postWebhook(ctx, subscription, delivery)
+	}
+	attempt.DurationMs = time.Since(attempt.At).Milliseconds()
+
+	set := bson.M{"tsupdated": time.Now(), "lockeduntil": time.Time{}}
+	switch {
+	case attempt.Error == "":
+		set["status"] = models.WebhookDelivered
+	case delivery.Attempts >= delivery.MaxAttempts:
+		set["status"] = models.WebhookFailed
+	default:
+		set["status"] = models.WebhookPending
+		set["nextattemptat"] = time.Now().Add(backoff(delivery.Attempts, webhookBaseBackoff, webhookMaxBackoff))
+	}
+	var updated models.WebhookDelivery
+	err := webhookDeliveryCollection.FindOneAndUpdate(
+		ctx,
+		bson.M{"_id": delivery.Id},
+		bson.M{
+			"$set":  set,
+			"$push": bson.M{"log": bson.M{"$each": bson.A{attempt}, "$slice": -webhookLogLimit}},
+		},
+		options.FindOneAndUpdate().SetReturnDocument(options.After),
+	).Decode(&updated)
+	return updated, err
+}
+
+// postWebhook sends the signed payload and returns the response status and,
+// unless it was a 2xx, a description of the failure.
+func postWebhook(ctx context.Context, subscription models.WebhookSubscription, delivery models.WebhookDelivery) (int, string) {
+	ctx, cancel := context.WithTimeout(ctx, webhookClient.Timeout)
+	defer cancel()
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, subscription.URL, bytes.NewBufferString(delivery.Payload))
+	if err != nil {
+		return 0, err.Error()
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("User-Agent", "mux-mongo-api-webhooks/1.0")
+	request.Header.Set(WebhookIdHeader, delivery.EventId)
+	request.Header.Set(WebhookEventHeader, delivery.EventType)
+	request.Header.Set(WebhookTimestampHeader, timestamp)
+	request.Header.Set(WebhookSignatureHeader, "v1="+SignWebhook(subscription.Secret, timestamp, []byte(delivery.Payload)))
+
+	response, err := webhookClient.Do(request)
+	if err != nil {
+		return 0, err.Error()
+	}
+	defer response.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(response.Body, 64<<10))
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return response.StatusCode, fmt.Sprintf("subscriber responded %d", response.StatusCode)
+	}
+	return response.StatusCode, ""
+}
+
+// SignWebhook computes the signature receivers should compare against.
+func SignWebhook(secret, timestamp string, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(payload)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// ListWebhookDeliveries returns the newest deliveries of a subscription.
+func ListWebhookDeliveries(ctx context.Context, subscription primitive.ObjectID, limit int64) ([]models.WebhookDelivery, error) {
+	results, err := webhookDeliveryCollection.Find(ctx, bson.M{"subscription": subscription}, options.Find().SetSort(bson.M{"tscreated": -1}).SetLimit(limit))
+	if err != nil {
+		return nil, err
+	}
+	deliveries := []models.WebhookDelivery{}
+	err = results.All(ctx, &deliveries)
+	return deliveries, err
+}
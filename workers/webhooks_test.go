@@ -0,0 +1,115 @@
+package workers
+
+import (
+	"context"
+	"crypto/hmac"
+	"io"
+	"mux-mongo-api/models"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// receivedWebhook is what the test subscriber saw of one request.
+type receivedWebhook struct {
+	header http.Header
+	body   string
+}
+
+// webhookSubscriber serves status to every request and passes what it received
+// on the returned channel.
+func webhookSubscriber(t *testing.T, status int) (*httptest.Server, <-chan receivedWebhook) {
+	t.Helper()
+	received := make(chan receivedWebhook, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		received <- receivedWebhook{header: r.Header.Clone(), body: string(body)}
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(server.Close)
+	return server, received
+}
+
+func testDelivery() models.WebhookDelivery {
+	return models.WebhookDelivery{
+		EventId:   "evt-1",
+		EventType: "user.created",
+		Payload:   `{"type":"user.created","data":{"email":"jane@example.com"}}`,
+	}
+}
+
+func TestPostWebhookSignsThePayload(t *testing.T) {
+	server, received := webhookSubscriber(t, http.StatusNoContent)
+	subscription := models.WebhookSubscription{URL: server.URL, Secret: "whsec-test", Active: true}
+	delivery := testDelivery()
+
+	before := time.Now().Unix()
+	status, failure := postWebhook(context.Background(), subscription, delivery)
+	if status != http.StatusNoContent || failure != "" {
+		t.Fatalf("postWebhook = %d, %q, want %d and no failure", status, failure, http.StatusNoContent)
+	}
+
+	request := <-received
+	if request.body != delivery.Payload {
+		t.Errorf("body = %q, want %q", request.body, delivery.Payload)
+	}
+	if got := request.header.Get(WebhookIdHeader); got != delivery.EventId {
+		t.Errorf("%s = %q, want %q", WebhookIdHeader, got, delivery.EventId)
+	}
+	if got := request.header.Get(WebhookEventHeader); got != delivery.EventType {
+		t.Errorf("%s = %q, want %q", WebhookEventHeader, got, delivery.EventType)
+	}
+
+	timestamp := request.header.Get(WebhookTimestampHeader)
+	sent, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil || sent < before || sent > time.Now().Unix() {
+		t.Errorf("%s = %q, want the unix time of the request", WebhookTimestampHeader, timestamp)
+	}
+
+	// verify the way a receiver would, from the timestamp and raw body
+	signature := request.header.Get(WebhookSignatureHeader)
+	if !strings.HasPrefix(signature, "v1=") {
+		t.Fatalf("%s = %q, want a v1= signature", WebhookSignatureHeader, signature)
+	}
+	signature = strings.TrimPrefix(signature, "v1=")
+	if !hmac.Equal([]byte(signature), []byte(SignWebhook(subscription.Secret, timestamp, []byte(request.body)))) {
+		t.Error("the signature does not match the payload and timestamp")
+	}
+	if hmac.Equal([]byte(signature), []byte(SignWebhook("other-secret", timestamp, []byte(request.body)))) {
+		t.Error("the signature also matches another secret")
+	}
+}
+
+func TestPostWebhookReportsFailedResponses(t *testing.T) {
+	server, received := webhookSubscriber(t, http.StatusInternalServerError)
+	subscription := models.WebhookSubscription{URL: server.URL, Secret: "whsec-test", Active: true}
+
+	status, failure := postWebhook(context.Background(), subscription, testDelivery())
+	<-received
+	if status != http.StatusInternalServerError || failure != "subscriber responded 500" {
+		t.Errorf("postWebhook = %d, %q, want %d, %q", status, failure, http.StatusInternalServerError, "subscriber responded 500")
+	}
+}
+
+func TestPostWebhookUnreachable(t *testing.T) {
+	server := httptest.NewServer(http.NotFoundHandler())
+	server.Close()
+	subscription := models.WebhookSubscription{URL: server.URL, Secret: "whsec-test", Active: true}
+
+	status, failure := postWebhook(context.Background(), subscription, testDelivery())
+	if status != 0 || failure == "" {
+		t.Errorf("postWebhook to a closed server = %d, %q, want 0 and a failure", status, failure)
+	}
+}
+
+func TestSignWebhook(t *testing.T) {
+	// computed independently with
+	// printf '1700000000.{}' | openssl dgst -sha256 -hmac secret
+	const want = "b8569b78799ff9e3cbff0fc2d63a33a2b57f3282abd07c37ae5e8e7d79a5f163"
+	if got := SignWebhook("secret", "1700000000", []byte("{}")); got != want {
+		t.Errorf("SignWebhook = %q, want %q", got, want)
+	}
+}